@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// StockEventType is the kind of stock alert sent to webhooks
+type StockEventType string
+
+const (
+	LowStockEvent   StockEventType = "low-stock"
+	OutOfStockEvent StockEventType = "out-of-stock"
+	// RestockedEvent is sent when a product that was low goes back above its warning level
+	RestockedEvent StockEventType = "restocked"
+)
+
+var stockEventTypes = []string{string(LowStockEvent), string(OutOfStockEvent), string(RestockedEvent)}
+
+type StockEvent struct {
+	ID       string
+	Type     StockEventType
+	Location string
+	Product  string
+	// Quantity is the stock that can be sold, expired lots aren't counted
+	Quantity   int
+	LowWarning int
+	Timestamp  time.Time
+}
+
+// alertState remembers which alerts were sent for a product at a location, so they're only sent once until restock
+type alertState struct {
+	low bool
+	out bool
+}
+
+// alertStates is keyed by location/product and guarded by inventoryLock
+var alertStates = make(map[string]*alertState)
+
+// CheckStockAlerts sends events for the alerts the sellable stock has crossed into or out of since they were last
+// sent. It has to be called after every change to Quantity or LowWarning. Damaged stock isn't sold, so it never
+// alerts. MUST be called with inventoryLock held
+func CheckStockAlerts(inv *InventoryStock) {
+	if l, ok := LocationMap[inv.Location]; ok && l.Type == DamagedLocation {
+		return
+	}
+	key := inv.Location + "/" + inv.Product
+	state, ok := alertStates[key]
+	if !ok {
+		state = &alertState{}
+		alertStates[key] = state
+	}
+	sellable := inv.Sellable(time.Now())
+	low := sellable <= inv.LowWarning
+	out := sellable <= 0
+	switch {
+	case out && !state.out:
+		EmitStockEvent(OutOfStockEvent, inv, sellable)
+	case low && !state.low && !out:
+		EmitStockEvent(LowStockEvent, inv, sellable)
+	case !low && state.low:
+		EmitStockEvent(RestockedEvent, inv, sellable)
+	}
+	state.low = low
+	state.out = out
+}
+
+// Webhook is an endpoint stock events are posted to, signed with Secret
+type Webhook struct {
+	ID     string
+	URL    string
+	Secret string `json:"-"`
+	// Events is the list of event types to send, all of them if empty
+	Events []string
+}
+
+var WebhookMap = make(map[string]*Webhook)
+
+// webhookLock guards WebhookMap
+var webhookLock sync.RWMutex
+
+const (
+	webhookAttempts = 5
+	webhookBackoff  = 2 * time.Second
+)
+
+// EmitStockEvent sends the event for the sellable quantity of the stock to every webhook that wants it, delivery
+// happens in the background
+func EmitStockEvent(t StockEventType, inv *InventoryStock, sellable int) {
+	event := &StockEvent{uuid.Must(uuid.NewRandom()).String(), t, inv.Location, inv.Product, sellable, inv.LowWarning, time.Now()}
+	webhookLock.RLock()
+	defer webhookLock.RUnlock()
+	for _, w := range WebhookMap {
+		if len(w.Events) > 0 && !StringSliceContains(w.Events, string(t)) {
+			continue
+		}
+		go deliverWebhook(*w, event)
+	}
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of body with secret
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the event, retrying with exponential backoff until it gets a 2xx response
+func deliverWebhook(w Webhook, event *StockEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		req, err := http.NewRequest("POST", w.URL, bytes.NewBuffer(body))
+		if err != nil {
+			return
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("X-Event-ID", event.ID)
+		req.Header.Add("X-Event-Type", string(event.Type))
+		req.Header.Add("X-Signature", "sha256="+SignWebhook(w.Secret, body))
+		response, err := http.DefaultClient.Do(req)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode >= 200 && response.StatusCode < 300 {
+				return
+			}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("giving up on webhook %s for event %s after %d attempts", w.ID, event.ID, webhookAttempts)
+}
+
+func getWebhooks(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookLock.RLock()
+		defer webhookLock.RUnlock()
+		c.JSON(http.StatusOK, WebhookMap)
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+func createWebhook(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateWebhookRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "url must be an absolute http(s) url"})
+			return
+		}
+		if req.Secret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "secret field missing"})
+			return
+		}
+		for _, e := range req.Events {
+			if !StringSliceContains(stockEventTypes, e) {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "event " + e + " is not allowed, allowed events: [low-stock, out-of-stock, restocked]"})
+				return
+			}
+		}
+		w := &Webhook{uuid.Must(uuid.NewRandom()).String(), req.URL, req.Secret, req.Events}
+		webhookLock.Lock()
+		defer webhookLock.Unlock()
+		WebhookMap[w.ID] = w
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+func deleteWebhook(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("ID")
+		webhookLock.Lock()
+		defer webhookLock.Unlock()
+		if _, ok := WebhookMap[id]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "webhook " + id + " not found"})
+			return
+		}
+		delete(WebhookMap, id)
+		c.JSON(http.StatusOK, gin.H{"Message": "webhook " + id + " deleted"})
+	}
+}
+
+// getLowStock lists the stock at or below its warning level, optionally for a single location
+func getLowStock(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		location := c.Query("location")
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		low := make([]*InventoryStock, 0)
+		for l, stock := range StockMap {
+			if location != "" && l != location {
+				continue
+			}
+			for _, inv := range stock {
+				if inv.Quantity <= inv.LowWarning {
+					low = append(low, inv)
+				}
+			}
+		}
+		sort.Slice(low, func(i, j int) bool {
+			if low[i].Location != low[j].Location {
+				return low[i].Location < low[j].Location
+			}
+			return low[i].Product < low[j].Product
+		})
+		c.JSON(http.StatusOK, low)
+	}
+}
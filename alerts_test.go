@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckStockAlerts(t *testing.T) {
+	events := make(chan *StockEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e StockEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- &e
+	}))
+	defer hook.Close()
+	webhookLock.Lock()
+	WebhookMap["alerts-test"] = &Webhook{"alerts-test", hook.URL, "secret", nil}
+	webhookLock.Unlock()
+	t.Cleanup(func() {
+		webhookLock.Lock()
+		delete(WebhookMap, "alerts-test")
+		webhookLock.Unlock()
+		inventoryLock.Lock()
+		delete(alertStates, "WH1/ALERTS")
+		delete(alertStates, "DMG/ALERTS")
+		inventoryLock.Unlock()
+	})
+
+	inv := &InventoryStock{"ALERTS", 5, 2, "WH1", 0, nil}
+	expired := []*Lot{{"OLD", time.Now().Add(-time.Hour), 9}}
+	steps := []struct {
+		quantity int
+		lots     []*Lot
+		want     StockEventType
+	}{
+		{2, nil, LowStockEvent},
+		// an alert is only sent once until the stock goes back up
+		{1, nil, ""},
+		{0, nil, OutOfStockEvent},
+		{0, nil, ""},
+		{10, nil, RestockedEvent},
+		{2, nil, LowStockEvent},
+		// expired lots can't be sold
+		{10, expired, ""},
+		{9, expired, OutOfStockEvent},
+	}
+	for i, step := range steps {
+		inventoryLock.Lock()
+		inv.Quantity, inv.Lots = step.quantity, step.lots
+		CheckStockAlerts(inv)
+		inventoryLock.Unlock()
+		if step.want == "" {
+			continue
+		}
+		select {
+		case e := <-events:
+			if e.Type != step.want || e.Quantity != inv.Sellable(time.Now()) {
+				t.Errorf("step %d: got %s for %d, want %s for %d", i, e.Type, e.Quantity, step.want, inv.Sellable(time.Now()))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("step %d: no %s event", i, step.want)
+		}
+	}
+
+	// damaged stock never alerts
+	inventoryLock.Lock()
+	CheckStockAlerts(&InventoryStock{"ALERTS", 0, 2, "DMG", 0, nil})
+	inventoryLock.Unlock()
+	select {
+	case e := <-events:
+		t.Errorf("got an unexpected %s event at %s", e.Type, e.Location)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
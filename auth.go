@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strings"
 
@@ -69,6 +70,9 @@ func userinfo(s *Server) gin.HandlerFunc {
 			return
 		}
 		user, ok := LoggedInUsers[token]
+		if !ok && isServiceToken(s, token) {
+			user, ok = &User{"service", "", "Internal service", token, ServiceRole}, true
+		}
 		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{"Message": "bad credentials"})
 			return
@@ -77,6 +81,11 @@ func userinfo(s *Server) gin.HandlerFunc {
 	}
 }
 
+// isServiceToken tells whether token is the one the services share, there's no service token unless one is configured
+func isServiceToken(s *Server, token string) bool {
+	return s.config.serviceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.serviceToken)) == 1
+}
+
 func users(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := ParseBearerToken(c.GetHeader("Authorization"))
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServiceToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		configured, sent string
+		want             *PermissionRole
+	}{
+		{"internal-secret", "internal-secret", rolePtr(ServiceRole)},
+		{"internal-secret", "internal-secre", nil},
+		{"internal-secret", "someone-else", nil},
+		// no service token is configured, so nothing is the service token
+		{"", "anything", nil},
+	}
+	for _, tt := range tests {
+		s := &Server{gin.New(), "auth", &Config{serviceToken: tt.configured}}
+		AuthRoutes(s)
+		ts := httptest.NewServer(s.router)
+		user := FetchUser(ts.URL, tt.sent)
+		ts.Close()
+		switch {
+		case tt.want == nil && user != nil:
+			t.Errorf("%q with %q configured is %+v", tt.sent, tt.configured, user)
+		case tt.want != nil && (user == nil || user.Role != *tt.want):
+			t.Errorf("%q with %q configured is %+v, want %s", tt.sent, tt.configured, user, *tt.want)
+		}
+	}
+}
+
+func rolePtr(r PermissionRole) *PermissionRole {
+	return &r
+}
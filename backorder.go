@@ -0,0 +1,352 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackorderType says why a line couldn't be taken from stock when it was ordered
+type BackorderType string
+
+const (
+	// NoBackorders rejects orders for more than is in stock, it's what products without a policy get
+	NoBackorders BackorderType = "none"
+	// Backordered lines are waiting for stock of a product that's sold out
+	Backordered BackorderType = "backorder"
+	// PreOrdered lines are for a product that hasn't been released yet
+	PreOrdered BackorderType = "preorder"
+)
+
+// BackorderPolicy says whether a product can still be ordered when there isn't enough stock
+type BackorderPolicy struct {
+	Product string
+	Policy  BackorderType
+	// MaxQuantity is the most that can be backordered on one order line, 0 means there's no limit
+	MaxQuantity int
+	// ReleaseDate is when a pre-order product goes on sale, everything ordered before it is pre-ordered
+	ReleaseDate time.Time
+}
+
+// BackorderPolicyMap is keyed by product ID and guarded by inventoryLock
+var BackorderPolicyMap = map[string]*BackorderPolicy{
+	"0001": &BackorderPolicy{"0001", Backordered, 10, time.Time{}},
+}
+
+// Accepts tells whether qty units that aren't in stock can be backordered
+func (p *BackorderPolicy) Accepts(qty int) bool {
+	if p == nil || p.Policy == NoBackorders || p.Policy == "" {
+		return false
+	}
+	return p.MaxQuantity == 0 || qty <= p.MaxQuantity
+}
+
+// PreOrdering tells whether the product hasn't been released yet, so nothing can be taken from stock for it
+func (p *BackorderPolicy) PreOrdering(now time.Time) bool {
+	return p != nil && p.Policy == PreOrdered && now.Before(p.ReleaseDate)
+}
+
+// Backorder is an order line waiting for stock at a location, they're allocated in the order they were placed
+type Backorder struct {
+	ID        int
+	OrderID   string
+	Location  string
+	Product   string
+	Type      BackorderType
+	Quantity  int
+	Allocated int
+	// Cancelled is how much was released before stock arrived for it
+	Cancelled int
+	Lots      []*LotAllocation
+	PlacedAt  time.Time
+}
+
+// Outstanding is how much of the backorder still needs stock
+func (b *Backorder) Outstanding() int {
+	return b.Quantity - b.Allocated - b.Cancelled
+}
+
+// BackorderAllocation tells the order service that stock was taken for a backordered line
+type BackorderAllocation struct {
+	OrderID  string
+	Product  string
+	Quantity int
+	Lots     []*LotAllocation
+}
+
+// BackorderList holds the backorders in the order they were placed and is guarded by inventoryLock
+var BackorderList = make([]*Backorder, 0)
+
+// pendingAllocations are the allocations the order service hasn't been told about yet, guarded by inventoryLock
+var pendingAllocations = make([]*BackorderAllocation, 0)
+
+// allocateBackorders takes the sellable stock of a product at a location for the backorders waiting on it, oldest first.
+// MUST be called with inventoryLock held
+func allocateBackorders(location, product string) []*BackorderAllocation {
+	allocations := make([]*BackorderAllocation, 0)
+	now := time.Now()
+	for _, b := range BackorderList {
+		if b.Location != location || b.Product != product || b.Outstanding() == 0 {
+			continue
+		}
+		inv, ok := StockAt(location, product)
+		if !ok {
+			break
+		}
+		qty := b.Outstanding()
+		if sellable := inv.Sellable(now); sellable < qty {
+			qty = sellable
+		}
+		if qty <= 0 {
+			break
+		}
+		lots := PostAllocated(&StockMovement{Location: location, Product: product, Type: SaleMovement, Delta: -qty, OrderID: b.OrderID, Reference: "backorder " + strconv.Itoa(b.ID), User: "backorders"}, false)
+		b.Allocated += qty
+		b.Lots = append(b.Lots, lots...)
+		allocations = append(allocations, &BackorderAllocation{b.OrderID, product, qty, lots})
+	}
+	return allocations
+}
+
+// NotifyBackordersMiddleware tells the order service about any backorders the request allocated stock to.
+// Allocations that can't be sent, or are for orders the order service doesn't have yet, are kept for the next request
+func NotifyBackordersMiddleware(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		inventoryLock.Lock()
+		allocations := pendingAllocations
+		pendingAllocations = make([]*BackorderAllocation, 0)
+		inventoryLock.Unlock()
+		if len(allocations) == 0 {
+			return
+		}
+		go func() {
+			unknown, err := SendBackorderAllocations(s.config.orderEndpoint, s.config.serviceToken, allocations)
+			if err != nil {
+				log.Printf("unable to send %d backorder allocations: %s", len(allocations), err)
+				unknown = allocations
+			}
+			inventoryLock.Lock()
+			defer inventoryLock.Unlock()
+			pendingAllocations = append(stillHeld(unknown), pendingAllocations...)
+		}()
+	}
+}
+
+// stillHeld drops the allocations for stock that's been released since, an order that failed to be placed gives
+// its stock back so the order service will never know about it. MUST be called with inventoryLock held
+func stillHeld(allocations []*BackorderAllocation) []*BackorderAllocation {
+	held := make([]*BackorderAllocation, 0, len(allocations))
+	for _, a := range allocations {
+		for _, h := range HeldForOrder(a.OrderID) {
+			if h.product == a.Product && h.quantity > 0 {
+				held = append(held, a)
+				break
+			}
+		}
+	}
+	if dropped := len(allocations) - len(held); dropped > 0 {
+		log.Printf("dropped %d backorder allocations for orders that no longer hold the stock", dropped)
+	}
+	return held
+}
+
+func getBackorderPolicies(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		c.JSON(http.StatusOK, BackorderPolicyMap)
+	}
+}
+
+// setBackorderPolicy sets the policy of a product from the policy, max and release form fields
+func setBackorderPolicy(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := BackorderType(c.PostForm("policy"))
+		if policy != NoBackorders && policy != Backordered && policy != PreOrdered {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "policy must be one of none, backorder or preorder"})
+			return
+		}
+		limit := 0
+		if v := c.PostForm("max"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "max value must be a number that isn't negative"})
+				return
+			}
+		}
+		release, ok := parseTimeField(c, "release", time.Time{})
+		if !ok {
+			return
+		}
+		if policy == PreOrdered && release.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "pre-orders need a release date"})
+			return
+		}
+		p := &BackorderPolicy{c.Param("ID"), policy, limit, release}
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		BackorderPolicyMap[p.Product] = p
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// getBackorders lists the backorders, only the outstanding ones unless all is set, optionally for one order
+func getBackorders(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID := c.Query("order")
+		all := c.Query("all") == "true"
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		backorders := make([]*Backorder, 0)
+		for _, b := range BackorderList {
+			if (orderID != "" && b.OrderID != orderID) || (!all && b.Outstanding() == 0) {
+				continue
+			}
+			backorders = append(backorders, b)
+		}
+		c.JSON(http.StatusOK, backorders)
+	}
+}
+
+type BackorderRequest struct {
+	OrderID  string
+	Location string
+	// Policy is the order's fulfilment policy, orders that ship what's available don't wait for stock
+	Policy FulfilmentPolicy
+	// Lines are keyed by product ID, their Type is worked out from the product's backorder policy
+	Lines map[string]*BackorderLine
+}
+
+// backorderType is the type of backorder a line for a product accepting backorders is placed as
+func backorderType(policy *BackorderPolicy, now time.Time) BackorderType {
+	if policy.PreOrdering(now) {
+		return PreOrdered
+	}
+	return Backordered
+}
+
+// placeBackorders queues the lines of an order that couldn't be taken from stock.
+// Any stock that's already there is allocated straight away and returned, earlier backorders go first
+func placeBackorders(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BackorderRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.OrderID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "order ID is required to backorder products"})
+			return
+		}
+		if req.Policy == ShipAvailable {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "orders that ship what's available can't backorder products"})
+			return
+		}
+		location := locationParam(req.Location)
+		now := time.Now()
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		for id, l := range req.Lines {
+			if l.Product != id || l.Quantity <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "backorder lines need their product ID and a positive quantity"})
+				return
+			}
+			policy := BackorderPolicyMap[l.Product]
+			if !policy.Accepts(l.Quantity) {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "product with ID " + l.Product + " can't be backordered"})
+				return
+			}
+		}
+		allocations := make([]*BackorderAllocation, 0)
+		for _, l := range req.Lines {
+			l.Type = backorderType(BackorderPolicyMap[l.Product], now)
+			BackorderList = append(BackorderList, &Backorder{len(BackorderList) + 1, req.OrderID, location, l.Product, l.Type, l.Quantity, 0, 0, nil, now})
+			// stock being held for a release date is still given out, it's taken by pre-orders first
+			for _, a := range allocateBackorders(location, l.Product) {
+				if a.OrderID == req.OrderID {
+					allocations = append(allocations, a)
+				} else {
+					pendingAllocations = append(pendingAllocations, a)
+				}
+			}
+		}
+		c.JSON(http.StatusOK, allocations)
+	}
+}
+
+// BackorderLine is the part of an order line that's waiting for stock
+type BackorderLine struct {
+	Product   string
+	Type      BackorderType
+	Quantity  int
+	Allocated int
+}
+
+const (
+	// StockAllocated orders have all their stock, the other stock statuses are waiting for some of it
+	StockAllocated   = "allocated"
+	StockBackordered = "backordered"
+	StockPreOrdered  = "pre-ordered"
+)
+
+// BackorderStatus is the stock status of an order, it's allocated once all its backordered lines are
+func (o *Order) BackorderStatus() string {
+	status := StockAllocated
+	for _, l := range o.Backorders {
+		if l.Allocated >= l.Quantity {
+			continue
+		}
+		if l.Type == Backordered {
+			return StockBackordered
+		}
+		status = StockPreOrdered
+	}
+	return status
+}
+
+// Allocate records stock taken for a backordered line of the order
+func (o *Order) Allocate(a *BackorderAllocation) {
+	l, ok := o.Backorders[a.Product]
+	if !ok {
+		return
+	}
+	l.Allocated += a.Quantity
+	if o.Lots == nil {
+		o.Lots = make(map[string][]*LotAllocation)
+	}
+	o.Lots[a.Product] = append(o.Lots[a.Product], a.Lots...)
+	o.StockStatus = o.BackorderStatus()
+}
+
+// BackorderAllocationsResponse lists the allocations for orders the order service doesn't have yet. Backorders are
+// placed before the order is saved, so stock can arrive for an order that's still being placed
+type BackorderAllocationsResponse struct {
+	Message string
+	Unknown []*BackorderAllocation
+}
+
+// backordersAllocated is called by the inventory service when stock arrives for backordered lines
+func backordersAllocated(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var allocations []*BackorderAllocation
+		if err := c.BindJSON(&allocations); err != nil {
+			return
+		}
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		unknown := make([]*BackorderAllocation, 0)
+		for _, a := range allocations {
+			o, ok := OrdersMap[a.OrderID]
+			if !ok {
+				unknown = append(unknown, a)
+				continue
+			}
+			o.Allocate(a)
+		}
+		c.JSON(http.StatusOK, BackorderAllocationsResponse{strconv.Itoa(len(allocations)-len(unknown)) + " allocations recorded", unknown})
+	}
+}
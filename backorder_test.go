@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPlaceBackorders(t *testing.T) {
+	cl := newCluster(t)
+	release := time.Now().Add(24 * time.Hour)
+	inventoryLock.Lock()
+	queued := len(BackorderList)
+	BackorderPolicyMap["0098"] = &BackorderPolicy{"0098", Backordered, 5, time.Time{}}
+	BackorderPolicyMap["0099"] = &BackorderPolicy{"0099", PreOrdered, 0, release}
+	inventoryLock.Unlock()
+	t.Cleanup(func() {
+		inventoryLock.Lock()
+		BackorderList = BackorderList[:queued]
+		delete(BackorderPolicyMap, "0098")
+		delete(BackorderPolicyMap, "0099")
+		inventoryLock.Unlock()
+	})
+	line := func(product, typ string, qty int) string {
+		return `"` + product + `": {"Product": "` + product + `", "Type": "` + typ + `", "Quantity": ` + strconv.Itoa(qty) + `}`
+	}
+	tests := []struct {
+		name, token, body string
+		want              int
+	}{
+		{"user", cl.token, `{"OrderID": "B1", "Lines": {` + line("0098", "backorder", 1) + `}}`, http.StatusForbidden},
+		{"no order", cl.service(), `{"Lines": {` + line("0098", "backorder", 1) + `}}`, http.StatusBadRequest},
+		{"ships what's available", cl.service(), `{"OrderID": "B1", "Policy": "ship-available", "Lines": {` + line("0098", "backorder", 1) + `}}`, http.StatusBadRequest},
+		{"zero", cl.service(), `{"OrderID": "B1", "Lines": {` + line("0098", "backorder", 0) + `}}`, http.StatusBadRequest},
+		{"negative", cl.service(), `{"OrderID": "B1", "Lines": {` + line("0098", "backorder", -3) + `}}`, http.StatusBadRequest},
+		{"over the limit", cl.service(), `{"OrderID": "B1", "Lines": {` + line("0098", "backorder", 6) + `}}`, http.StatusBadRequest},
+		{"no policy", cl.service(), `{"OrderID": "B1", "Lines": {` + line("0097", "backorder", 1) + `}}`, http.StatusBadRequest},
+		{"line under another product", cl.service(), `{"OrderID": "B1", "Lines": {"0098": {"Product": "0099", "Quantity": 1}}}`, http.StatusBadRequest},
+		// the types sent are swapped, they're worked out from the products' policies
+		{"placed", cl.service(), `{"OrderID": "B1", "Policy": "split", "Lines": {` + line("0098", "preorder", 2) + `, ` + line("0099", "backorder", 3) + `}}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := cl.send(t, "inventory", "POST", "/backorders", tt.token, tt.body); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+	placed := BackorderList[queued:]
+	if len(placed) != 2 {
+		t.Fatalf("%d backorders placed, want 2", len(placed))
+	}
+	for _, b := range placed {
+		want := map[string]BackorderType{"0098": Backordered, "0099": PreOrdered}[b.Product]
+		if b.OrderID != "B1" || b.Type != want {
+			t.Errorf("backorder %+v, want a %s for order B1", b, want)
+		}
+	}
+}
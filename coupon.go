@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Coupon is a code that can be handed to a customer and redeemed at checkout for a Discount
+type Coupon struct {
+	Code string
+	// Spec describes the Discount the coupon maps to
+	Spec DiscountSpec
+	// MaxRedemptions caps the total number of redemptions, 0 means unlimited and 1 makes it single-use
+	MaxRedemptions int
+	// PerCustomerLimit caps redemptions per customer, 0 means unlimited. A coupon with a limit requires a customer
+	PerCustomerLimit int
+	// ExpiresAt is the moment the coupon stops being valid, the zero value means it never expires
+	ExpiresAt time.Time
+	// MinBasket is the minimum cart value (before discounts) needed to use the coupon, it's set in BaseCurrency and
+	// converted to the currency of the cart at the exchange rate
+	MinBasket           Money
+	Redemptions         int
+	CustomerRedemptions map[string]int
+}
+
+// DiscountSpec is a serialisable description of a Discount, so coupons can be created over http
+type DiscountSpec struct {
+	// Type is one of [percent, x-for-y]
+	Type       string
+	ProductID  string   `json:",omitempty"`
+	ProductIDs []string `json:",omitempty"`
+	Percentage float64  `json:",omitempty"`
+	X          int      `json:",omitempty"`
+	Y          int      `json:",omitempty"`
+}
+
+// Build returns the Discount described by the spec
+func (d DiscountSpec) Build() (Discount, error) {
+	switch d.Type {
+	case "percent":
+		if d.ProductID == "" || d.Percentage <= 0 || d.Percentage > 100 {
+			return nil, errors.New("percent discount needs a ProductID and a Percentage between 0 and 100")
+		}
+		return &PercentDiscount{d.ProductID, d.Percentage}, nil
+	case "x-for-y":
+		if len(d.ProductIDs) == 0 || d.X <= d.Y || d.Y < 0 {
+			return nil, errors.New("x-for-y discount needs ProductIDs and X bigger than Y")
+		}
+		return &AnyXForY{d.ProductIDs, d.X, d.Y}, nil
+	default:
+		return nil, errors.New("discount type " + d.Type + " is not allowed, allowed types: [percent, x-for-y]")
+	}
+}
+
+// Check returns the reason the coupon can't be used, or an empty string if it can. basket is the value of the cart
+// in its own currency, which is rate units per unit of BaseCurrency
+func (cp *Coupon) Check(customerID string, basket Money, rate *big.Rat, now time.Time) string {
+	if !cp.ExpiresAt.IsZero() && now.After(cp.ExpiresAt) {
+		return "coupon expired"
+	}
+	if cp.MaxRedemptions > 0 && cp.Redemptions >= cp.MaxRedemptions {
+		return "coupon has reached its redemption limit"
+	}
+	if cp.PerCustomerLimit > 0 {
+		if customerID == "" {
+			return "coupon can only be used by a loyalty customer"
+		}
+		if cp.CustomerRedemptions[customerID] >= cp.PerCustomerLimit {
+			return "customer has reached the redemption limit for this coupon"
+		}
+	}
+	if minimum := cp.MinBasket.Convert(rate, basket.Currency); basket.LessThan(minimum) {
+		return fmt.Sprintf("cart value is below the minimum of %s %s for this coupon", minimum, basket.Currency)
+	}
+	return ""
+}
+
+// NormaliseCouponCode makes coupon codes case and whitespace insensitive
+func NormaliseCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+var CouponMap = map[string]*Coupon{
+	"WELCOME10": &Coupon{
+		Code:                "WELCOME10",
+		Spec:                DiscountSpec{Type: "percent", ProductID: "0001", Percentage: 10},
+		PerCustomerLimit:    1,
+		CustomerRedemptions: map[string]int{},
+	},
+}
+
+// CouponRedemption is the coupons an order used up, kept so they can be given back if the order fails
+type CouponRedemption struct {
+	OrderID    string
+	CustomerID string
+	Codes      []string
+}
+
+// CouponRedemptions maps order IDs to the coupons they redeemed
+var CouponRedemptions = make(map[string]*CouponRedemption)
+
+// couponLock guards CouponMap and CouponRedemptions so that redemption limits can't be overrun by concurrent orders
+var couponLock sync.Mutex
+
+// ApplyCoupons validates codes against the cart and returns the discount taken by each valid coupon,
+// as well as the reason each invalid one was rejected. products and basket are priced in the currency of the cart,
+// which is rate units per unit of BaseCurrency. MUST be called with couponLock held
+func ApplyCoupons(codes []string, customerID string, cart map[string]*ProductOrder, products map[string]*Product, basket Money, rate *big.Rat, now time.Time) (applied []string, discounts []*AppliedDiscount, rejected map[string]string) {
+	applied = make([]string, 0)
+	discounts = make([]*AppliedDiscount, 0)
+	rejected = make(map[string]string)
+	for _, raw := range codes {
+		code := NormaliseCouponCode(raw)
+		if StringSliceContains(applied, code) {
+			rejected[raw] = "coupon already applied"
+			continue
+		}
+		cp, ok := CouponMap[code]
+		if !ok {
+			rejected[raw] = "coupon not found"
+			continue
+		}
+		if reason := cp.Check(customerID, basket, rate, now); reason != "" {
+			rejected[raw] = reason
+			continue
+		}
+		d, err := cp.Spec.Build()
+		if err != nil {
+			rejected[raw] = err.Error()
+			continue
+		}
+		value, reason := d.Discount(cart, products)
+		if value.IsZero() || reason == "" {
+			rejected[raw] = "coupon does not apply to any product in the cart"
+			continue
+		}
+		applied = append(applied, code)
+		discounts = append(discounts, &AppliedDiscount{"COUPON-" + code, d, value, reason + " (coupon " + code + ")"})
+	}
+	return applied, discounts, rejected
+}
+
+func getCoupons(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		couponLock.Lock()
+		defer couponLock.Unlock()
+		c.JSON(http.StatusOK, CouponMap)
+	}
+}
+
+func createCoupon(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var cp Coupon
+		if err := c.BindJSON(&cp); err != nil {
+			return
+		}
+		cp.Code = NormaliseCouponCode(cp.Code)
+		if cp.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "code field missing"})
+			return
+		}
+		if _, err := cp.Spec.Build(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+			return
+		}
+		if cp.MaxRedemptions < 0 || cp.PerCustomerLimit < 0 || cp.MinBasket.Amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "limits and minimum basket cannot be negative"})
+			return
+		}
+		couponLock.Lock()
+		defer couponLock.Unlock()
+		if _, ok := CouponMap[cp.Code]; ok {
+			c.JSON(http.StatusConflict, gin.H{"Message": "coupon with code " + cp.Code + " already exists"})
+			return
+		}
+		cp.Redemptions = 0
+		cp.CustomerRedemptions = make(map[string]int)
+		CouponMap[cp.Code] = &cp
+		c.JSON(http.StatusOK, cp)
+	}
+}
+
+func deleteCoupon(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := NormaliseCouponCode(c.Param("code"))
+		couponLock.Lock()
+		defer couponLock.Unlock()
+		if _, ok := CouponMap[code]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "coupon with code " + code + " not found"})
+			return
+		}
+		delete(CouponMap, code)
+		c.JSON(http.StatusOK, gin.H{"Message": "coupon " + code + " deleted"})
+	}
+}
+
+type RedeemCouponsRequest struct {
+	Codes      []string
+	CustomerID string
+	OrderID    string
+	Cart       map[string]*ProductOrder
+	// Currency is the currency the cart was priced in, an empty currency means BaseCurrency
+	Currency string
+}
+
+// redeemCoupons records the redemption of all codes by an order, or none of them if any is no longer valid.
+// Redeeming for an order that already redeemed its coupons does nothing, so the request can be retried
+func redeemCoupons(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RedeemCouponsRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.OrderID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "OrderID field missing"})
+			return
+		}
+		currency := NormaliseCurrency(req.Currency)
+		rate, err := RateFor(currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+			return
+		}
+		products, err := ProductsAt(ProductMap, currency, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+			return
+		}
+		basket, err := CartSubtotal(req.Cart, products, currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+			return
+		}
+		couponLock.Lock()
+		defer couponLock.Unlock()
+		if r, ok := CouponRedemptions[req.OrderID]; ok {
+			c.JSON(http.StatusOK, gin.H{"Message": "coupons already redeemed", "Codes": r.Codes, "OrderID": req.OrderID})
+			return
+		}
+		applied, _, rejected := ApplyCoupons(req.Codes, req.CustomerID, req.Cart, products, basket, rate, time.Now())
+		if len(rejected) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"Message": "unable to redeem coupons", "Rejected": rejected})
+			return
+		}
+		for _, code := range applied {
+			cp := CouponMap[code]
+			cp.Redemptions++
+			if req.CustomerID != "" {
+				cp.CustomerRedemptions[req.CustomerID]++
+			}
+		}
+		CouponRedemptions[req.OrderID] = &CouponRedemption{req.OrderID, req.CustomerID, applied}
+		c.JSON(http.StatusOK, gin.H{"Message": "coupons redeemed", "Codes": applied, "OrderID": req.OrderID})
+	}
+}
+
+type ReleaseCouponsRequest struct {
+	OrderID string
+}
+
+// releaseCoupons gives back the coupons redeemed by an order that failed. An order that didn't redeem any, or
+// already gave them back, has nothing to release
+func releaseCoupons(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReleaseCouponsRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		couponLock.Lock()
+		defer couponLock.Unlock()
+		r, ok := CouponRedemptions[req.OrderID]
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"Message": "no coupons to release", "OrderID": req.OrderID})
+			return
+		}
+		for _, code := range r.Codes {
+			// a coupon deleted since has nothing to give back to
+			cp, ok := CouponMap[code]
+			if !ok {
+				continue
+			}
+			if cp.Redemptions > 0 {
+				cp.Redemptions--
+			}
+			if r.CustomerID != "" && cp.CustomerRedemptions[r.CustomerID] > 0 {
+				cp.CustomerRedemptions[r.CustomerID]--
+			}
+		}
+		delete(CouponRedemptions, req.OrderID)
+		c.JSON(http.StatusOK, gin.H{"Message": "coupons released", "Codes": r.Codes, "OrderID": req.OrderID})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCouponCheck(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	euro := DecimalRat(1.17)
+	cp := &Coupon{
+		Code:                "SPEND20",
+		MaxRedemptions:      10,
+		PerCustomerLimit:    1,
+		ExpiresAt:           now.Add(time.Hour),
+		MinBasket:           gbp(2000),
+		Redemptions:         3,
+		CustomerRedemptions: map[string]int{"000001": 1},
+	}
+	tests := []struct {
+		name     string
+		customer string
+		basket   Money
+		rate     *big.Rat
+		at       time.Time
+		want     string
+	}{
+		{"valid", "000002", gbp(2000), big.NewRat(1, 1), now, ""},
+		{"expired", "000002", gbp(2000), big.NewRat(1, 1), now.Add(2 * time.Hour), "coupon expired"},
+		{"no customer", "", gbp(2000), big.NewRat(1, 1), now, "coupon can only be used by a loyalty customer"},
+		{"used by customer", "000001", gbp(2000), big.NewRat(1, 1), now, "customer has reached the redemption limit for this coupon"},
+		{"below minimum", "000002", gbp(1999), big.NewRat(1, 1), now, "cart value is below the minimum of 20.00 GBP for this coupon"},
+		// 20.00 GBP is 23.40 EUR, so 22.00 EUR isn't enough even though 22 is over 20
+		{"below converted minimum", "000002", NewMoney(2200, "EUR"), euro, now, "cart value is below the minimum of 23.40 EUR for this coupon"},
+		{"converted minimum", "000002", NewMoney(2340, "EUR"), euro, now, ""},
+	}
+	for _, tt := range tests {
+		if got := cp.Check(tt.customer, tt.basket, tt.rate, tt.at); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	cp.Redemptions = cp.MaxRedemptions
+	if got := cp.Check("000002", gbp(2000), big.NewRat(1, 1), now); got != "coupon has reached its redemption limit" {
+		t.Errorf("coupon used up: got %q", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExchangeRate is how many units of Currency one unit of BaseCurrency buys
+type ExchangeRate struct {
+	Currency  string
+	Rate      float64
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+var ExchangeRateMap = map[string]*ExchangeRate{
+	"EUR": &ExchangeRate{"EUR", 1.17, "antero", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	"USD": &ExchangeRate{"USD", 1.27, "antero", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+// rateLock guards ExchangeRateMap, rates are read on every calculation and written by managers
+var rateLock sync.RWMutex
+
+// NormaliseCurrency upper-cases a currency code, an empty code means BaseCurrency
+func NormaliseCurrency(currency string) string {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return BaseCurrency
+	}
+	return currency
+}
+
+// RateFor returns the exchange rate from BaseCurrency to currency
+func RateFor(currency string) (*big.Rat, error) {
+	if currency == BaseCurrency {
+		return big.NewRat(1, 1), nil
+	}
+	rateLock.RLock()
+	defer rateLock.RUnlock()
+	r, ok := ExchangeRateMap[currency]
+	if !ok {
+		return nil, errors.New("no exchange rate for currency " + currency)
+	}
+	return DecimalRat(r.Rate), nil
+}
+
+// Convert changes m into currency at rate units of currency per unit of m's currency
+func (m Money) Convert(rate *big.Rat, currency string) Money {
+	if !m.Valid() {
+		return invalidMoney
+	}
+	return MoneyFromRat(new(big.Rat).Mul(m.Rat(), rate), currency, MoneyRounding)
+}
+
+// ToBase converts m back to BaseCurrency at rate units of m's currency per unit of BaseCurrency
+func (m Money) ToBase(rate *big.Rat) Money {
+	if !m.Valid() {
+		return invalidMoney
+	}
+	return MoneyFromRat(new(big.Rat).Quo(m.Rat(), rate), BaseCurrency, MoneyRounding)
+}
+
+// PriceAt returns the price of the product in currency at the given time, using an override if one was set
+// and the exchange rate otherwise. MUST be called with priceLock held
+func (p *Product) PriceAt(currency string, at time.Time) (Money, error) {
+	if price, ok := listPriceAt(p, currency, at); ok {
+		return price, nil
+	}
+	rate, err := RateFor(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	price, _ := listPriceAt(p, p.Price.Currency, at)
+	return price.Convert(rate, currency), nil
+}
+
+// ProductsAt returns a copy of products priced in currency at the given time, so discounts can be worked out with it
+func ProductsAt(products map[string]*Product, currency string, at time.Time) (map[string]*Product, error) {
+	priceLock.RLock()
+	defer priceLock.RUnlock()
+	priced := make(map[string]*Product, len(products))
+	for id, p := range products {
+		price, err := p.PriceAt(currency, at)
+		if err != nil {
+			return nil, err
+		}
+		var overrides map[string]Money
+		if currency == p.Price.Currency {
+			overrides = overridesAt(p, at)
+		}
+		priced[id] = &Product{p.ID, p.Name, price, overrides, p.TaxClass, p.Weight}
+	}
+	return priced, nil
+}
+
+func getRates(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rateLock.RLock()
+		defer rateLock.RUnlock()
+		c.JSON(http.StatusOK, ExchangeRateMap)
+	}
+}
+
+func setRate(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rateStr string
+		currency := NormaliseCurrency(c.Param("currency"))
+		if currency == BaseCurrency {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "cannot set an exchange rate for the base currency " + BaseCurrency})
+			return
+		}
+		if rateStr = c.PostForm("rate"); rateStr == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "rate field missing"})
+			return
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "rate value must be a decimal number and bigger than 0"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		rateLock.Lock()
+		defer rateLock.Unlock()
+		er := &ExchangeRate{currency, rate, user.Username, time.Now()}
+		ExchangeRateMap[currency] = er
+		c.JSON(http.StatusOK, er)
+	}
+}
+
+func deleteRate(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currency := NormaliseCurrency(c.Param("currency"))
+		rateLock.Lock()
+		defer rateLock.Unlock()
+		if _, ok := ExchangeRateMap[currency]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "Message": "no exchange rate for currency " + currency})
+			return
+		}
+		delete(ExchangeRateMap, currency)
+		c.JSON(http.StatusOK, gin.H{"Message": "exchange rate for " + currency + " deleted"})
+	}
+}
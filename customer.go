@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// customerLock guards CustomerMap and the customers in it
+var customerLock sync.Mutex
+
+// phoneNumber is what's left of a phone number once spaces, dashes, dots and brackets are taken out
+var phoneNumber = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// resolveCustomer finds a customer by their card number, following merges to the account that's left.
+// MUST be called with customerLock held
+func resolveCustomer(id string) (*Customer, bool) {
+	customer, ok := CustomerMap[id]
+	for ok && customer.MergedInto != "" {
+		customer, ok = CustomerMap[customer.MergedInto]
+	}
+	return customer, ok
+}
+
+// openCustomer finds a customer whose account hasn't been merged into another or deleted.
+// MUST be called with customerLock held
+func openCustomer(id string) (*Customer, bool) {
+	customer, ok := CustomerMap[id]
+	if !ok || customer.MergedInto != "" || customer.Deleted {
+		return nil, false
+	}
+	return customer, true
+}
+
+// nextCardNumber returns the card number after the highest one given out. Deleted customers keep their numbers and
+// numbers in the points ledger aren't given out again either. MUST be called with customerLock held
+func nextCardNumber() string {
+	highest := 0
+	for id := range CustomerMap {
+		if n, err := strconv.Atoi(id); err == nil && n > highest {
+			highest = n
+		}
+	}
+	for _, t := range PointsLedger {
+		if n, err := strconv.Atoi(t.CustomerID); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return fmt.Sprintf("%06d", highest+1)
+}
+
+// normaliseEmail returns the lowercase address, or an error if it isn't a valid email address
+func normaliseEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.Index(email, "@"):], ".") {
+		return "", fmt.Errorf("%s is not a valid email address", email)
+	}
+	return email, nil
+}
+
+// normalisePhone strips the formatting out of a phone number, or returns an error if it isn't one
+func normalisePhone(phone string) (string, error) {
+	stripped := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -.()", r) {
+			return -1
+		}
+		return r
+	}, phone)
+	if !phoneNumber.MatchString(stripped) {
+		return "", fmt.Errorf("%s is not a valid phone number", phone)
+	}
+	return stripped, nil
+}
+
+// contactTaken returns the active customer other than id that already has the email or phone.
+// MUST be called with customerLock held
+func contactTaken(id, email, phone string) *Customer {
+	for _, other := range CustomerMap {
+		if other.ID == id || !other.Active {
+			continue
+		}
+		if (email != "" && other.Email == email) || (phone != "" && other.Phone == phone) {
+			return other
+		}
+	}
+	return nil
+}
+
+type CustomerRequest struct {
+	// Name, Email, Phone and MarketingConsent are left as they are when updating a customer if they're missing
+	Name             *string
+	Email            *string
+	Phone            *string
+	MarketingConsent *bool
+}
+
+// apply validates the request and makes the changes to customer. Customers need a name and an email or phone
+func (req *CustomerRequest) apply(customer *Customer) error {
+	updated := *customer
+	if req.Name != nil {
+		updated.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Email != nil {
+		updated.Email = ""
+		if strings.TrimSpace(*req.Email) != "" {
+			email, err := normaliseEmail(*req.Email)
+			if err != nil {
+				return err
+			}
+			updated.Email = email
+		}
+	}
+	if req.Phone != nil {
+		updated.Phone = ""
+		if strings.TrimSpace(*req.Phone) != "" {
+			phone, err := normalisePhone(*req.Phone)
+			if err != nil {
+				return err
+			}
+			updated.Phone = phone
+		}
+	}
+	if req.MarketingConsent != nil {
+		updated.MarketingConsent = *req.MarketingConsent
+	}
+	if updated.Name == "" {
+		return fmt.Errorf("customers need a name")
+	}
+	if updated.Email == "" && updated.Phone == "" {
+		return fmt.Errorf("customers need an email or phone number")
+	}
+	*customer = updated
+	return nil
+}
+
+// enrollCustomer signs a customer up to the loyalty scheme and gives them a card number
+func enrollCustomer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CustomerRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer := &Customer{nextCardNumber(), "", "", "", false, 0, true, "", time.Now(), false}
+		if err := req.apply(customer); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		if other := contactTaken(customer.ID, customer.Email, customer.Phone); other != nil {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "customer " + other.ID + " already has that email or phone number"})
+			return
+		}
+		CustomerMap[customer.ID] = customer
+		c.JSON(http.StatusOK, customer)
+	}
+}
+
+// findCustomer looks a customer up by exactly one of ?card=, ?email= or ?phone=, merged cards find the account
+// they were merged into
+func findCustomer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		card, email, phone := c.Query("card"), c.Query("email"), c.Query("phone")
+		given := 0
+		for _, q := range []string{card, email, phone} {
+			if q != "" {
+				given++
+			}
+		}
+		if given != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "look customers up by one of card, email or phone"})
+			return
+		}
+		var err error
+		if email != "" {
+			if email, err = normaliseEmail(email); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+				return
+			}
+		}
+		if phone != "" {
+			if phone, err = normalisePhone(phone); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+				return
+			}
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		if card != "" {
+			if customer, ok := resolveCustomer(card); ok && !customer.Deleted {
+				c.JSON(http.StatusOK, customer)
+				return
+			}
+		}
+		for _, customer := range CustomerMap {
+			if customer.MergedInto == "" && !customer.Deleted && ((email != "" && customer.Email == email) || (phone != "" && customer.Phone == phone)) {
+				c.JSON(http.StatusOK, customer)
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"Message": "customer not found"})
+	}
+}
+
+func updateCustomer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CustomerRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := openCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		updated := *customer
+		if err := req.apply(&updated); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		if other := contactTaken(customer.ID, updated.Email, updated.Phone); other != nil {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "customer " + other.ID + " already has that email or phone number"})
+			return
+		}
+		*customer = updated
+		c.JSON(http.StatusOK, customer)
+	}
+}
+
+// deactivateCustomer stops a customer earning and spending points, their account and points are kept
+func deactivateCustomer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := openCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		customer.Active = false
+		c.JSON(http.StatusOK, customer)
+	}
+}
+
+type MergeCustomersRequest struct {
+	// Duplicate is the card number of the account merged into the one in the URL
+	Duplicate string
+}
+
+// mergeCustomers moves the points of a duplicate account onto a customer and closes it. The duplicate's card
+// number keeps working, it finds the customer it was merged into, so its orders can still be refunded
+func mergeCustomers(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MergeCustomersRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := openCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		duplicate, ok := openCustomer(req.Duplicate)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + req.Duplicate + " not found"})
+			return
+		}
+		if duplicate.ID == customer.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "a customer can't be merged into itself"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		if points := duplicate.Points; points != 0 {
+			postPoints(duplicate, &PointsTransaction{0, "", MergeTransaction, -points, 0, "", "", "merged into " + customer.ID, user.Username, time.Time{}})
+			postPoints(customer, &PointsTransaction{0, "", MergeTransaction, points, 0, "", "", "merged from " + duplicate.ID, user.Username, time.Time{}})
+		}
+		if customer.Email == "" {
+			customer.Email = duplicate.Email
+		}
+		if customer.Phone == "" {
+			customer.Phone = duplicate.Phone
+		}
+		// consent is only kept if it was given on both accounts
+		customer.MarketingConsent = customer.MarketingConsent && duplicate.MarketingConsent
+		duplicate.Active = false
+		duplicate.MergedInto = customer.ID
+		c.JSON(http.StatusOK, customer)
+	}
+}
+
+// deleteCustomer removes the details of a customer and the accounts merged into it. The accounts are kept, closed,
+// so the orders they were used on can still be refunded and their points reversed
+func deleteCustomer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := openCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		ids := make([]string, 0)
+		for id := range CustomerMap {
+			if merged, _ := resolveCustomer(id); merged == customer {
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			deleted := CustomerMap[id]
+			deleted.Name, deleted.Email, deleted.Phone = "", "", ""
+			deleted.MarketingConsent, deleted.Active, deleted.Deleted = false, false, true
+		}
+		c.JSON(http.StatusOK, gin.H{"Message": "customer " + customer.ID + " deleted"})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// send makes a request to a service of the cluster as the user with token, and returns the status
+func (cl *cluster) send(t *testing.T, service, method, path, token, body string) int {
+	req, _ := http.NewRequest(method, cl.servers[service].URL+path, bytes.NewBufferString(body))
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestCustomerRoutesNeedAManager(t *testing.T) {
+	cl := newCluster(t)
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	customerLock.Lock()
+	CustomerMap["000900"] = &Customer{"000900", "Carol White", "carol@example.com", "", false, 0, true, "", time.Time{}, false}
+	customerLock.Unlock()
+	t.Cleanup(func() {
+		customerLock.Lock()
+		delete(CustomerMap, "000900")
+		customerLock.Unlock()
+	})
+	tests := []struct {
+		method, path, body string
+	}{
+		{"GET", "/manager/customers?email=carol@example.com", ""},
+		{"PUT", "/manager/customers/000900", `{"Name": "Carol Black"}`},
+		{"POST", "/manager/customers/000900/deactivate", ""},
+		{"DELETE", "/manager/customers/000900", ""},
+	}
+	for _, tt := range tests {
+		if code := cl.send(t, "loyalty", tt.method, tt.path, cl.token, tt.body); code != http.StatusUnauthorized && code != http.StatusForbidden {
+			t.Errorf("%s %s by a user: status %d", tt.method, tt.path, code)
+		}
+	}
+	customerLock.Lock()
+	if c := CustomerMap["000900"]; c.Name != "Carol White" || !c.Active || c.Deleted {
+		t.Errorf("users changed the customer to %+v", c)
+	}
+	customerLock.Unlock()
+	for _, tt := range tests {
+		if code := cl.send(t, "loyalty", tt.method, tt.path, manager.Token, tt.body); code != http.StatusOK {
+			t.Errorf("%s %s by a manager: status %d", tt.method, tt.path, code)
+		}
+	}
+}
+
+func TestDeletedCustomerCanStillBeRefunded(t *testing.T) {
+	cl := newCluster(t)
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	carol := &Customer{"000901", "Carol White", "carol@example.com", "07700900999", true, 0, true, "", time.Time{}, false}
+	dup := &Customer{"000902", "C White", "", "", false, 0, false, "000901", time.Time{}, false}
+	useLedger(t, carol, dup)
+	postPoints(carol, &PointsTransaction{0, "", EarnTransaction, 40, 0, "ORDER-1", "", "", "test", time.Time{}})
+
+	if code := cl.send(t, "loyalty", "DELETE", "/manager/customers/000901", manager.Token, ""); code != http.StatusOK {
+		t.Fatalf("delete status %d", code)
+	}
+	customerLock.Lock()
+	for _, c := range []*Customer{carol, dup} {
+		if CustomerMap[c.ID] != c || !c.Deleted || c.Active || c.Name != "" || c.Email != "" || c.Phone != "" || c.MarketingConsent {
+			t.Errorf("deleted customer is %+v", c)
+		}
+	}
+	customerLock.Unlock()
+	// the details are gone, so the customer can't be found or changed
+	for _, path := range []string{"/manager/customers?card=000902", "/manager/customers?email=carol@example.com"} {
+		if code := cl.send(t, "loyalty", "GET", path, manager.Token, ""); code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d", path, code)
+		}
+	}
+	if code := cl.send(t, "loyalty", "PUT", "/manager/customers/000901", manager.Token, `{"Name": "Carol"}`); code != http.StatusNotFound {
+		t.Errorf("update of a deleted customer: status %d", code)
+	}
+	// the orders of the card merged into them can still be refunded
+	if err := SendReversePointsRequest(cl.servers["loyalty"].URL, "test-service-token", &ReversePointsRequest{"000902", "ORDER-1", 40, 0, false}); err != nil {
+		t.Fatal(err)
+	}
+	customerLock.Lock()
+	defer customerLock.Unlock()
+	if carol.Points != 0 {
+		t.Errorf("deleted customer has %d points after the reversal", carol.Points)
+	}
+}
+
+func TestPointsDontShowCustomerDetails(t *testing.T) {
+	cl := newCluster(t)
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	req, _ := http.NewRequest("GET", cl.servers["loyalty"].URL+"/points/000001", nil)
+	req.Header.Add("Authorization", "Bearer "+cl.token)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var res map[string]map[string]interface{}
+	json.NewDecoder(response.Body).Decode(&res)
+	if len(res["Customer"]) != 2 || res["Customer"]["ID"] != "000001" || res["Customer"]["Points"] == nil {
+		t.Errorf("points of a customer show %v, want only their ID and points", res["Customer"])
+	}
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{cl.token, http.StatusForbidden},
+		{manager.Token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := cl.send(t, "loyalty", "GET", "/points/000001/transactions", tt.token, ""); code != tt.want {
+			t.Errorf("statement for %s: status %d, want %d", LoggedInUsers[tt.token].Username, code, tt.want)
+		}
+	}
+}
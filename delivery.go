@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeliveryLineID is the line delivery is taxed under, it can't clash with product IDs as those are numbers
+const DeliveryLineID = "delivery"
+
+// DeliveryTaxClass is the tax class charged on delivery
+const DeliveryTaxClass = StandardTax
+
+// DeliveryAddress is where an order is delivered to
+type DeliveryAddress struct {
+	Name     string
+	Line1    string
+	Line2    string `json:",omitempty"`
+	City     string
+	Postcode string
+	Country  string
+}
+
+type deliveryAddressJSON DeliveryAddress
+
+var trailingPostcode = regexp.MustCompile(`([A-Za-z]{1,2}[0-9][A-Za-z0-9]?\s*[0-9][A-Za-z]{2})\s*$`)
+
+// UnmarshalJSON accepts the address object as well as a single line string, as sent before addresses were structured.
+// The postcode is taken from the end of the string if there's one
+func (a *DeliveryAddress) UnmarshalJSON(b []byte) error {
+	var line string
+	if err := json.Unmarshal(b, &line); err == nil {
+		*a = DeliveryAddress{Line1: line}
+		if m := trailingPostcode.FindStringSubmatch(line); m != nil {
+			a.Postcode = m[1]
+		}
+		return nil
+	}
+	return json.Unmarshal(b, (*deliveryAddressJSON)(a))
+}
+
+// NormalisePostcode upper-cases a postcode and removes its spaces
+func NormalisePostcode(postcode string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+}
+
+// DeliveryMethod is how an order gets to the customer
+type DeliveryMethod string
+
+const (
+	StandardDelivery DeliveryMethod = "standard"
+	ExpressDelivery  DeliveryMethod = "express"
+	// ClickAndCollect orders are picked up from a shop, so they need no address and are free
+	ClickAndCollect DeliveryMethod = "click-and-collect"
+)
+
+var deliveryMethods = []string{string(StandardDelivery), string(ExpressDelivery), string(ClickAndCollect)}
+
+// DeliveryZone groups postcodes that are charged the same for delivery
+type DeliveryZone struct {
+	ID   string
+	Name string
+	// PostcodePrefixes are matched against the start of a postcode, the longest match wins.
+	// Prefixes made only of letters are postcode areas, so "G" matches "G1 1AA" but not "GU1 1AA"
+	PostcodePrefixes []string
+}
+
+// ShippingRate is the price of delivering with Method to ZoneID, for carts up to MaxWeight
+type ShippingRate struct {
+	ZoneID string
+	Method DeliveryMethod
+	// MaxWeight in grams this rate covers, 0 means any weight
+	MaxWeight int
+	Price     Money
+	// FreeOver makes delivery free for carts worth at least this much after discounts, the zero value never does
+	FreeOver Money
+}
+
+var DeliveryZoneMap = map[string]*DeliveryZone{
+	"LOCAL":     &DeliveryZone{"LOCAL", "Edinburgh", []string{"EH"}},
+	"MAINLAND":  &DeliveryZone{"MAINLAND", "UK Mainland", []string{""}},
+	"HIGHLANDS": &DeliveryZone{"HIGHLANDS", "Highlands and Islands", []string{"HS", "IV", "KW", "ZE", "PA20", "PA4", "PA6", "PA7", "PH17", "PH4", "PH5"}},
+}
+
+var ShippingRateList = []*ShippingRate{
+	&ShippingRate{"LOCAL", StandardDelivery, 0, NewMoney(300, BaseCurrency), NewMoney(5000, BaseCurrency)},
+	&ShippingRate{"LOCAL", ExpressDelivery, 0, NewMoney(600, BaseCurrency), Money{}},
+	&ShippingRate{"MAINLAND", StandardDelivery, 2000, NewMoney(500, BaseCurrency), NewMoney(7500, BaseCurrency)},
+	&ShippingRate{"MAINLAND", StandardDelivery, 0, NewMoney(900, BaseCurrency), Money{}},
+	&ShippingRate{"MAINLAND", ExpressDelivery, 2000, NewMoney(1000, BaseCurrency), Money{}},
+	&ShippingRate{"MAINLAND", ExpressDelivery, 0, NewMoney(1500, BaseCurrency), Money{}},
+	&ShippingRate{"HIGHLANDS", StandardDelivery, 0, NewMoney(1200, BaseCurrency), Money{}},
+}
+
+// deliveryLock guards DeliveryZoneMap and ShippingRateList
+var deliveryLock sync.RWMutex
+
+func prefixMatches(postcode, prefix string) bool {
+	if !strings.HasPrefix(postcode, prefix) {
+		return false
+	}
+	if prefix == "" || len(postcode) == len(prefix) || strings.IndexFunc(prefix, unicode.IsDigit) >= 0 {
+		return true
+	}
+	// an area prefix has to be followed by the district number
+	return unicode.IsDigit(rune(postcode[len(prefix)]))
+}
+
+// ZoneFor returns the delivery zone of the postcode. MUST be called with deliveryLock held
+func ZoneFor(postcode string) *DeliveryZone {
+	postcode = NormalisePostcode(postcode)
+	var zone *DeliveryZone
+	longest := -1
+	for _, z := range DeliveryZoneMap {
+		for _, prefix := range z.PostcodePrefixes {
+			p := NormalisePostcode(prefix)
+			if len(p) > longest && prefixMatches(postcode, p) {
+				zone = z
+				longest = len(p)
+			}
+		}
+	}
+	return zone
+}
+
+// DeliveryRequest asks for a delivery quote along with the price of a cart
+type DeliveryRequest struct {
+	Method  DeliveryMethod
+	Address *DeliveryAddress
+}
+
+// DeliveryQuote is the price of delivering a cart, Error is set when it can't be delivered as requested
+type DeliveryQuote struct {
+	Method DeliveryMethod
+	ZoneID string `json:",omitempty"`
+	Weight int
+	Price  Money
+	Error  string `json:",omitempty"`
+}
+
+// QuoteDelivery prices delivering a cart of the given weight and value after discounts, in BaseCurrency
+func QuoteDelivery(req *DeliveryRequest, weight int, value Money) (*DeliveryQuote, error) {
+	method := req.Method
+	if method == "" {
+		method = StandardDelivery
+	}
+	quote := &DeliveryQuote{method, "", weight, NewMoney(0, BaseCurrency), ""}
+	if !StringSliceContains(deliveryMethods, string(method)) {
+		return quote, errors.New("delivery method " + string(method) + " is not allowed, allowed methods: [" + strings.Join(deliveryMethods, ", ") + "]")
+	}
+	if method == ClickAndCollect {
+		return quote, nil
+	}
+	if req.Address == nil || req.Address.Postcode == "" {
+		return quote, errors.New("a delivery address with a postcode is needed for " + string(method) + " delivery")
+	}
+	deliveryLock.RLock()
+	defer deliveryLock.RUnlock()
+	zone := ZoneFor(req.Address.Postcode)
+	if zone == nil {
+		return quote, errors.New("we don't deliver to postcode " + req.Address.Postcode)
+	}
+	quote.ZoneID = zone.ID
+	var rate *ShippingRate
+	for _, r := range ShippingRateList {
+		if r.ZoneID != zone.ID || r.Method != method || (r.MaxWeight != 0 && weight > r.MaxWeight) {
+			continue
+		}
+		// pick the tightest weight band that fits
+		if rate == nil || rate.MaxWeight == 0 || (r.MaxWeight != 0 && r.MaxWeight < rate.MaxWeight) {
+			rate = r
+		}
+	}
+	if rate == nil {
+		return quote, errors.New(string(method) + " delivery is not available to " + zone.Name + " for this cart")
+	}
+	if rate.FreeOver.IsZero() || value.LessThan(rate.FreeOver) {
+		quote.Price = rate.Price
+	}
+	return quote, nil
+}
+
+// CartWeight returns the weight of the cart in grams
+func CartWeight(cart map[string]*ProductOrder, products map[string]*Product) int {
+	weight := 0
+	for _, p := range cart {
+		if prod, ok := products[p.ID]; ok {
+			weight += prod.Weight * p.Quantity
+		}
+	}
+	return weight
+}
+
+func getDeliveryZones(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deliveryLock.RLock()
+		defer deliveryLock.RUnlock()
+		c.JSON(http.StatusOK, gin.H{"Zones": DeliveryZoneMap, "Rates": ShippingRateList})
+	}
+}
+
+func setDeliveryZone(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var zone DeliveryZone
+		if err := c.BindJSON(&zone); err != nil {
+			return
+		}
+		zone.ID = c.Param("ID")
+		if len(zone.PostcodePrefixes) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "a zone needs at least one postcode prefix"})
+			return
+		}
+		deliveryLock.Lock()
+		defer deliveryLock.Unlock()
+		DeliveryZoneMap[zone.ID] = &zone
+		c.JSON(http.StatusOK, zone)
+	}
+}
+
+// setShippingRates replaces the whole rate table, so bands can't be left half updated
+func setShippingRates(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rates []*ShippingRate
+		if err := c.BindJSON(&rates); err != nil {
+			return
+		}
+		deliveryLock.Lock()
+		defer deliveryLock.Unlock()
+		for _, r := range rates {
+			if _, ok := DeliveryZoneMap[r.ZoneID]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "zone " + r.ZoneID + " not found"})
+				return
+			}
+			if !StringSliceContains(deliveryMethods, string(r.Method)) || r.MaxWeight < 0 || r.Price.Amount < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "rates need a valid method and no negative weights or prices"})
+				return
+			}
+		}
+		ShippingRateList = rates
+		c.JSON(http.StatusOK, ShippingRateList)
+	}
+}
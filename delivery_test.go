@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestZoneFor(t *testing.T) {
+	tests := []struct {
+		postcode string
+		want     string
+	}{
+		{"EH1 1YZ", "LOCAL"},
+		{"eh11yz", "LOCAL"},
+		{"G1 3SL", "MAINLAND"},
+		{"HS1 2AB", "HIGHLANDS"},
+		// district prefixes beat the area they're in
+		{"PH17 4QA", "HIGHLANDS"},
+		{"PH1 1AA", "MAINLAND"},
+		{"PA20 0AA", "HIGHLANDS"},
+		{"PA2 9AA", "MAINLAND"},
+	}
+	deliveryLock.RLock()
+	defer deliveryLock.RUnlock()
+	for _, tt := range tests {
+		if z := ZoneFor(tt.postcode); z == nil || z.ID != tt.want {
+			t.Errorf("ZoneFor(%q) = %+v, want %s", tt.postcode, z, tt.want)
+		}
+	}
+}
+
+func TestQuoteDelivery(t *testing.T) {
+	mainland := &DeliveryAddress{Postcode: "G1 3SL"}
+	tests := []struct {
+		name    string
+		method  DeliveryMethod
+		address *DeliveryAddress
+		weight  int
+		value   int64
+		want    int64
+		wantErr bool
+	}{
+		{"light band", StandardDelivery, mainland, 2000, 1000, 500, false},
+		{"heavy band", StandardDelivery, mainland, 2001, 1000, 900, false},
+		{"free over the light band's threshold", StandardDelivery, mainland, 1500, 7500, 0, false},
+		{"heavy band is never free", StandardDelivery, mainland, 2500, 10000, 900, false},
+		{"default method is standard", "", mainland, 100, 1000, 500, false},
+		{"express light band", ExpressDelivery, mainland, 1999, 1000, 1000, false},
+		{"express heavy band", ExpressDelivery, mainland, 5000, 1000, 1500, false},
+		{"local under the threshold", StandardDelivery, &DeliveryAddress{Postcode: "EH1 1YZ"}, 9000, 4999, 300, false},
+		{"no express to the highlands", ExpressDelivery, &DeliveryAddress{Postcode: "KW1 4AB"}, 100, 1000, 0, true},
+		{"click and collect is free", ClickAndCollect, nil, 9000, 1000, 0, false},
+		{"no address", StandardDelivery, nil, 100, 1000, 0, true},
+		{"unknown method", "drone", mainland, 100, 1000, 0, true},
+	}
+	for _, tt := range tests {
+		quote, err := QuoteDelivery(&DeliveryRequest{tt.method, tt.address}, tt.weight, gbp(tt.value))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if quote.Price != gbp(tt.want) {
+			t.Errorf("%s: price %v, want %v", tt.name, quote.Price, gbp(tt.want))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FulfilmentPolicy says what to do with an order when some of it can't be taken from stock
+type FulfilmentPolicy string
+
+const (
+	// AllOrNothing fails the order unless every line can be sent or backordered, it's the default
+	AllOrNothing FulfilmentPolicy = "all-or-nothing"
+	// ShipAvailable sends what's in stock and drops the rest
+	ShipAvailable FulfilmentPolicy = "ship-available"
+	// SplitShipments sends what's in stock now and the rest as a separate shipment once it arrives,
+	// lines that can't be backordered are dropped
+	SplitShipments FulfilmentPolicy = "split"
+)
+
+// FulfilmentLine records what happened to a line of the cart
+type FulfilmentLine struct {
+	Product   string
+	Ordered   int
+	Fulfilled int
+	// Deferred is waiting for stock and is sent later, it's charged for with the rest of the order
+	Deferred int
+	// Dropped isn't sent or charged for
+	Dropped int
+	Reason  string `json:",omitempty"`
+}
+
+// FulfilmentPlan splits a cart into what's taken from stock now, what waits for stock and what's dropped
+type FulfilmentPlan struct {
+	Policy     FulfilmentPolicy
+	Available  map[string]*ProductOrder
+	Backorders map[string]*BackorderLine
+	Lines      []*FulfilmentLine
+	Warnings   []string
+	Errors     []string
+}
+
+// Cart is what the order is charged for, the lines sent now and the ones deferred
+func (p *FulfilmentPlan) Cart() map[string]*ProductOrder {
+	cart := make(map[string]*ProductOrder)
+	for _, l := range p.Lines {
+		if q := l.Fulfilled + l.Deferred; q > 0 {
+			cart[l.Product] = &ProductOrder{l.Product, q}
+		}
+	}
+	return cart
+}
+
+// PlanFulfilment works out how each line of the cart is fulfilled from the stock of location.
+// Lines that can't be fulfilled are errors under AllOrNothing and dropped otherwise
+func PlanFulfilment(cart map[string]*ProductOrder, stock map[string]*InventoryStock, backorderPolicies map[string]*BackorderPolicy, policy FulfilmentPolicy, location *Location, now time.Time) *FulfilmentPlan {
+	if policy == "" {
+		policy = AllOrNothing
+	}
+	plan := &FulfilmentPlan{policy, make(map[string]*ProductOrder), make(map[string]*BackorderLine), make([]*FulfilmentLine, 0), make([]string, 0), make([]string, 0)}
+	ids := make([]string, 0, len(cart))
+	for id := range cart {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	// unavailable drops quantity from a line, or fails the order when everything has to be sent
+	unavailable := func(line *FulfilmentLine, qty int, reason string) {
+		if policy == AllOrNothing {
+			plan.Errors = append(plan.Errors, reason)
+			return
+		}
+		line.Dropped += qty
+		line.Reason = reason
+		plan.Warnings = append(plan.Warnings, strconv.Itoa(qty)+" of product with ID "+line.Product+" dropped: "+reason)
+	}
+	for _, id := range ids {
+		p := cart[id]
+		line := &FulfilmentLine{Product: p.ID, Ordered: p.Quantity}
+		plan.Lines = append(plan.Lines, line)
+		// backorders are only taken when the customer is willing to wait for them
+		bp := backorderPolicies[p.ID]
+		if policy == ShipAvailable {
+			bp = nil
+		}
+		s, ok := stock[p.ID]
+		if !ok && !bp.Accepts(p.Quantity) {
+			unavailable(line, p.Quantity, "product with ID: "+p.ID+" not found")
+			continue
+		}
+		if bp.PreOrdering(now) {
+			line.Deferred = p.Quantity
+			plan.Backorders[p.ID] = &BackorderLine{p.ID, PreOrdered, p.Quantity, 0}
+			plan.Warnings = append(plan.Warnings, "product with ID "+p.ID+" is pre-ordered and will be sent once it's released")
+			continue
+		}
+		// expired lots are still counted in Quantity but can't be sold
+		sellable := 0
+		if ok {
+			sellable = s.Sellable(now)
+		}
+		take := p.Quantity
+		if short := p.Quantity - sellable; short > 0 {
+			take = sellable
+			if bp.Accepts(short) {
+				line.Deferred = short
+				plan.Backorders[p.ID] = &BackorderLine{p.ID, Backordered, short, 0}
+				plan.Warnings = append(plan.Warnings, strconv.Itoa(short)+" of product with ID "+p.ID+" backordered until stock arrives")
+			} else {
+				unavailable(line, short, "insufficient stock at "+location.Name+" to fulfill order for product with ID: "+p.ID)
+			}
+		}
+		if take <= 0 {
+			continue
+		}
+		line.Fulfilled = take
+		plan.Available[p.ID] = &ProductOrder{p.ID, take}
+		if (s.Quantity - take) <= s.LowWarning {
+			plan.Warnings = append(plan.Warnings, "order will take stock for product with ID "+p.ID+" below the warning threshold")
+		}
+	}
+	if len(cart) > 0 && len(plan.Errors) == 0 && len(plan.Cart()) == 0 {
+		plan.Errors = append(plan.Errors, "nothing in the order can be fulfilled")
+	}
+	return plan
+}
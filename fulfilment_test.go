@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanFulfilment(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	stock := map[string]*InventoryStock{
+		"A": &InventoryStock{"A", 5, 1, "WH1", 0, nil},
+		"B": &InventoryStock{"B", 2, 0, "WH1", 0, nil},
+		// only 2 can be sold, the rest has expired
+		"D": &InventoryStock{"D", 10, 0, "WH1", 0, []*Lot{{"OLD", now.Add(-time.Hour), 8}}},
+		"P": &InventoryStock{"P", 0, 0, "WH1", 0, nil},
+	}
+	policies := map[string]*BackorderPolicy{
+		"B": &BackorderPolicy{"B", Backordered, 3, time.Time{}},
+		"C": &BackorderPolicy{"C", Backordered, 0, time.Time{}},
+		"P": &BackorderPolicy{"P", PreOrdered, 0, now.Add(24 * time.Hour)},
+	}
+	cart := map[string]*ProductOrder{
+		"A": &ProductOrder{"A", 3},
+		"B": &ProductOrder{"B", 4},
+		"C": &ProductOrder{"C", 1},
+		"D": &ProductOrder{"D", 3},
+		"P": &ProductOrder{"P", 2},
+	}
+	location := LocationMap["WH1"]
+
+	tests := []struct {
+		policy FulfilmentPolicy
+		cart   map[string]*ProductOrder
+		// lines are product:fulfilled/deferred/dropped
+		lines      string
+		backorders string
+		errors     int
+	}{
+		{"", cart, "A:3/0/0 B:2/2/0 C:0/1/0 D:2/0/0 P:0/2/0", "B:backorder:2 C:backorder:1 P:preorder:2", 1},
+		{AllOrNothing, map[string]*ProductOrder{"A": cart["A"], "B": cart["B"]}, "A:3/0/0 B:2/2/0", "B:backorder:2", 0},
+		{ShipAvailable, cart, "A:3/0/0 B:2/0/2 C:0/0/1 D:2/0/1 P:0/0/2", "", 0},
+		{SplitShipments, cart, "A:3/0/0 B:2/2/0 C:0/1/0 D:2/0/1 P:0/2/0", "B:backorder:2 C:backorder:1 P:preorder:2", 0},
+		// more than can be backordered on one line
+		{SplitShipments, map[string]*ProductOrder{"B": &ProductOrder{"B", 6}}, "B:2/0/4", "", 0},
+		{ShipAvailable, map[string]*ProductOrder{"C": cart["C"]}, "C:0/0/1", "", 1},
+	}
+	for _, tt := range tests {
+		plan := PlanFulfilment(tt.cart, stock, policies, tt.policy, location, now)
+		lines := make([]string, 0, len(plan.Lines))
+		for _, l := range plan.Lines {
+			lines = append(lines, fmt.Sprintf("%s:%d/%d/%d", l.Product, l.Fulfilled, l.Deferred, l.Dropped))
+		}
+		backorders := make([]string, 0, len(plan.Backorders))
+		for _, l := range plan.Lines {
+			if b, ok := plan.Backorders[l.Product]; ok {
+				backorders = append(backorders, fmt.Sprintf("%s:%s:%d", b.Product, b.Type, b.Quantity))
+			}
+		}
+		name := fmt.Sprintf("%q with %d lines", tt.policy, len(tt.cart))
+		if got := strings.Join(lines, " "); got != tt.lines {
+			t.Errorf("%s: lines %s, want %s", name, got, tt.lines)
+		}
+		if got := strings.Join(backorders, " "); got != tt.backorders {
+			t.Errorf("%s: backorders %s, want %s", name, got, tt.backorders)
+		}
+		if len(plan.Errors) != tt.errors {
+			t.Errorf("%s: errors %v, want %d", name, plan.Errors, tt.errors)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyWindow is how long a response is kept to be replayed to requests with the same Idempotency-Key
+var IdempotencyWindow = 24 * time.Hour
+
+type idempotentResponse struct {
+	hash        string
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	createdAt   time.Time
+}
+
+// IdempotencyStore keeps the responses to the requests sent to a route with an Idempotency-Key
+type IdempotencyStore struct {
+	sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{responses: make(map[string]*idempotentResponse)}
+}
+
+// purge drops the responses older than IdempotencyWindow. MUST be called with the store locked
+func (s *IdempotencyStore) purge(now time.Time) {
+	for id, r := range s.responses {
+		if now.Sub(r.createdAt) > IdempotencyWindow {
+			delete(s.responses, id)
+		}
+	}
+}
+
+// keepResponse is the context key handlers set to keep a server error, see KeepIdempotentResponse
+const keepResponse = "idempotency-keep-response"
+
+// KeepIdempotentResponse keeps the response to the request even if it's a server error. Handlers use it when they
+// failed part way and couldn't undo what they'd done, so a retry is sent the failure instead of doing it all again
+func KeepIdempotentResponse(c *gin.Context) {
+	c.Set(keepResponse, true)
+}
+
+// recordingWriter keeps a copy of the response body as it's written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.Write([]byte(s))
+}
+
+// IdempotencyMiddleware makes a route safe to retry. The first response to a request with an Idempotency-Key
+// header is kept and sent again to any retry with the same key and body, while reusing the key for a different
+// request is rejected. Keys belong to the user that sent them, so it has to come after HydrateUserMiddleware.
+// Server errors and panics aren't kept, so a request that failed can be tried again, unless the handler asks for
+// server errors to be
+func IdempotencyMiddleware(store *IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		body, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "unable to read request body"})
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.RequestURI()+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+		id := key
+		if u, ok := c.Get("user"); ok {
+			id = u.(*User).Username + "/" + key
+		}
+		now := time.Now()
+
+		store.Lock()
+		store.purge(now)
+		if r, ok := store.responses[id]; ok {
+			store.Unlock()
+			switch {
+			case r.hash != hash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"code": http.StatusUnprocessableEntity, "Message": "Idempotency-Key " + key + " was already used for a different request"})
+			case !r.done:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "a request with Idempotency-Key " + key + " is still being processed"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(r.status, r.contentType, r.body)
+				c.Abort()
+			}
+			return
+		}
+		store.responses[id] = &idempotentResponse{hash: hash, createdAt: now}
+		store.Unlock()
+		// nothing is kept if the handler panics, so the key can be used again once recovery has sent the error
+		kept := false
+		defer func() {
+			if !kept {
+				store.Lock()
+				delete(store.responses, id)
+				store.Unlock()
+			}
+		}()
+
+		w := &recordingWriter{c.Writer, &bytes.Buffer{}}
+		c.Writer = w
+		c.Next()
+
+		if w.Status() >= http.StatusInternalServerError && !c.GetBool(keepResponse) {
+			return
+		}
+		store.Lock()
+		defer store.Unlock()
+		kept = true
+		r := store.responses[id]
+		r.done = true
+		r.status = w.Status()
+		r.contentType = w.Header().Get("Content-Type")
+		r.body = w.body.Bytes()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotencyMiddlewareForgetsPanics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	calls := 0
+	router := gin.New()
+	router.Use(gin.RecoveryWithWriter(io.Discard))
+	router.POST("/", IdempotencyMiddleware(NewIdempotencyStore()), func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		c.JSON(http.StatusOK, gin.H{"Message": "done"})
+	})
+	send := func() (int, string) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "panics-once")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Header().Get("Idempotent-Replayed")
+	}
+
+	if code, _ := send(); code != http.StatusInternalServerError {
+		t.Fatalf("the panic got %d, want 500", code)
+	}
+	// the retry is handled again instead of waiting on the request that panicked
+	if code, replayed := send(); code != http.StatusOK || replayed != "" {
+		t.Errorf("the retry got %d replayed %q, want it handled", code, replayed)
+	}
+	if code, replayed := send(); code != http.StatusOK || replayed != "true" || calls != 2 {
+		t.Errorf("the next retry got %d replayed %q after %d calls, want the response kept", code, replayed, calls)
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -9,34 +14,449 @@ import (
 func InventoryRoutes(s *Server) {
 	private := s.router.Group("/")
 	private.Use(HydrateUserMiddleware(s))
+	private.Use(NotifyBackordersMiddleware(s))
 	private.GET("/", getInventory(s))
-	private.POST("/decrement", decrementStock(s))
+	private.POST("/decrement", IdempotencyMiddleware(NewIdempotencyStore()), decrementStock(s))
+	private.POST("/release", RequiresPermissionMiddleware(ServiceRole), releaseStock(s))
+	private.POST("/returns", RequiresPermissionMiddleware(ServiceRole), restockReturn(s))
+	private.GET("/movements", getMovements(s))
+	private.GET("/locations", getLocations(s))
+	private.GET("/transfers", getTransfers(s))
+	private.GET("/backorder-policies", getBackorderPolicies(s))
+	private.POST("/backorders", RequiresPermissionMiddleware(ServiceRole), placeBackorders(s))
+
+	manager := s.router.Group("/manager")
+	manager.Use(HydrateUserMiddleware(s))
+	manager.Use(NotifyBackordersMiddleware(s))
+	manager.Use(RequiresPermissionMiddleware(ManagerRole))
+	manager.POST("/adjust", adjustStock(s))
+	manager.POST("/receive", receiveStock(s))
+	manager.POST("/stock-take", stockTake(s))
+	manager.PUT("/low-warning/:ID", setLowWarning(s))
+	manager.GET("/ledger/check", checkLedger(s))
+	manager.PUT("/locations/:ID", setLocation(s))
+	manager.POST("/transfers", createTransfer(s))
+	manager.POST("/transfers/:ID/receive", receiveTransfer(s))
+	manager.GET("/low-stock", getLowStock(s))
+	manager.GET("/expiring", getExpiringLots(s))
+	manager.GET("/webhooks", getWebhooks(s))
+	manager.POST("/webhooks", createWebhook(s))
+	manager.DELETE("/webhooks/:ID", deleteWebhook(s))
+	manager.GET("/suppliers", getSuppliers(s))
+	manager.PUT("/suppliers/:ID", setSupplier(s))
+	manager.PUT("/reorder/:location/:product", setReorderSetting(s))
+	manager.GET("/purchase-orders", getPurchaseOrders(s))
+	manager.POST("/purchase-orders/generate", generatePurchaseOrders(s))
+	manager.POST("/purchase-orders/:ID/approve", movePurchaseOrder(s, POApproved))
+	manager.POST("/purchase-orders/:ID/send", movePurchaseOrder(s, POSent))
+	manager.POST("/purchase-orders/:ID/cancel", movePurchaseOrder(s, POCancelled))
+	manager.POST("/purchase-orders/:ID/receive", receivePurchaseOrder(s))
+	manager.GET("/backorders", getBackorders(s))
+	manager.PUT("/backorder-policies/:ID", setBackorderPolicy(s))
 }
 
-var InventoryMap = map[string]*InventoryStock{
-	"0001": &InventoryStock{"0001", 5, 2},
-	"0002": &InventoryStock{"0002", 50, 20},
-	"0003": &InventoryStock{"0003", 100, 20},
+// StockMap holds the stock of each location by product
+var StockMap = map[string]map[string]*InventoryStock{
+	"WH1": {
+		"0001": &InventoryStock{"0001", 5, 2, "WH1", 0, nil},
+		"0002": &InventoryStock{"0002", 50, 20, "WH1", 0, nil},
+		"0003": &InventoryStock{"0003", 100, 20, "WH1", 0, nil},
+	},
+	"EDI": {
+		"0001": &InventoryStock{"0001", 2, 1, "EDI", 0, nil},
+		"0002": &InventoryStock{"0002", 10, 4, "EDI", 0, nil},
+		"0003": &InventoryStock{"0003", 10, 4, "EDI", 0, nil},
+	},
+	"GLA": {
+		"0002": &InventoryStock{"0002", 10, 4, "GLA", 0, nil},
+		"0003": &InventoryStock{"0003", 10, 4, "GLA", 0, nil},
+	},
 }
 
+// inventoryLock guards StockMap, LocationMap, TransferMap, StockLedger and the backorders.
+// Every change to stock has to hold it and go through PostMovement
+var inventoryLock sync.Mutex
+
+// locationParam returns the location a request is for, or DefaultLocation if it doesn't say
+func locationParam(location string) string {
+	if location == "" {
+		return DefaultLocation
+	}
+	return location
+}
+
+// getInventory returns the stock of a single location if asked for one, or the stock of all locations added up
 func getInventory(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, InventoryMap)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		location := c.Query("location")
+		if location == "" {
+			c.JSON(http.StatusOK, AggregateStock())
+			return
+		}
+		stock, ok := StockMap[location]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "location " + location + " not found"})
+			return
+		}
+		c.JSON(http.StatusOK, stock)
 	}
 }
 
-// decrementStock is unsafe because stock should be checked before decrementing
+type DecrementResponse struct {
+	Stock map[string]*InventoryStock
+	// Lots maps product IDs to the lots the stock was taken from
+	Lots map[string][]*LotAllocation
+}
+
+// decrementStock is unsafe because stock should be checked before decrementing.
+// The order the stock is taken for and the location it's taken from are given in the order and location query parameters.
+// Stock is taken first expiry first out, and never from expired lots
 func decrementStock(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var decrements map[string]*ProductOrder
 		c.BindJSON(&decrements)
+		user := c.MustGet("user").(*User)
+		orderID := c.Query("order")
+		location := locationParam(c.Query("location"))
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		res := DecrementResponse{StockMap[location], make(map[string][]*LotAllocation)}
 		for _, d := range decrements {
-			inv, ok := InventoryMap[d.ID]
+			if _, ok := StockAt(location, d.ID); !ok {
+				continue
+			}
+			res.Lots[d.ID] = PostAllocated(&StockMovement{Location: location, Product: d.ID, Type: SaleMovement, Delta: -d.Quantity, OrderID: orderID, User: user.Username}, false)
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+type ReleaseRequest struct {
+	OrderID string
+	// Products maps product IDs to the quantity to release, everything held for the order is released if it's empty
+	Products map[string]int
+	// Reference identifies the release, a release that's already been made isn't made again
+	Reference string
+}
+
+type ReleaseResponse struct {
+	Released []*StockMovement
+	// BackordersCancelled is the quantity of each product that was still waiting for stock and won't be sent
+	BackordersCancelled map[string]int
+}
+
+// heldStock is what an order holds of a lot of a product at a location
+type heldStock struct {
+	location string
+	product  string
+	lot      string
+	expiry   time.Time
+	quantity int
+}
+
+// HeldForOrder works out the stock an order still holds from its sales and releases in the ledger, oldest first.
+// MUST be called with inventoryLock held
+func HeldForOrder(orderID string) []*heldStock {
+	held := make([]*heldStock, 0)
+	byKey := make(map[string]*heldStock)
+	for _, m := range StockLedger {
+		if m.OrderID != orderID || (m.Type != SaleMovement && m.Type != ReleaseMovement) {
+			continue
+		}
+		key := m.Location + "/" + m.Product + "/" + m.Lot
+		h, ok := byKey[key]
+		if !ok {
+			h = &heldStock{m.Location, m.Product, m.Lot, m.Expiry, 0}
+			byKey[key] = h
+			held = append(held, h)
+		}
+		h.quantity -= m.Delta
+	}
+	return held
+}
+
+// releaseStock puts back stock taken for an order. Quantities still waiting on a backorder are cancelled first,
+// as they were never taken, and what's left is put back into the lots it came from. Releasing more than the order
+// holds only releases what it holds, so asking twice is safe
+func releaseStock(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReleaseRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		res := ReleaseResponse{make([]*StockMovement, 0), make(map[string]int)}
+		if req.Reference != "" {
+			for _, m := range StockLedger {
+				if m.Type == ReleaseMovement && m.OrderID == req.OrderID && m.Reference == req.Reference {
+					c.JSON(http.StatusOK, res)
+					return
+				}
+			}
+		}
+		// remaining is how much is still to be released of each product, -1 for everything
+		remaining := func(product string) int {
+			if len(req.Products) == 0 {
+				return -1
+			}
+			return req.Products[product]
+		}
+		taken := make(map[string]int)
+		for _, b := range BackorderList {
+			if b.OrderID != req.OrderID || b.Outstanding() == 0 {
+				continue
+			}
+			cut := b.Outstanding()
+			if r := remaining(b.Product); r >= 0 && r-taken[b.Product] < cut {
+				cut = r - taken[b.Product]
+			}
+			b.Cancelled += cut
+			taken[b.Product] += cut
+			res.BackordersCancelled[b.Product] += cut
+		}
+		for _, h := range HeldForOrder(req.OrderID) {
+			qty := h.quantity
+			if r := remaining(h.product); r >= 0 && r-taken[h.product] < qty {
+				qty = r - taken[h.product]
+			}
+			if qty <= 0 {
+				continue
+			}
+			m := &StockMovement{Location: h.location, Product: h.product, Type: ReleaseMovement, Delta: qty, OrderID: req.OrderID, Reference: req.Reference, Lot: h.lot, Expiry: h.expiry, User: user.Username}
+			PostMovement(m)
+			taken[h.product] += qty
+			res.Released = append(res.Released, m)
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// AdjustmentReason explains a manual change to stock
+type AdjustmentReason string
+
+const (
+	DamageAdjustment AdjustmentReason = "damage"
+	TheftAdjustment  AdjustmentReason = "theft"
+	CountCorrection  AdjustmentReason = "count-correction"
+	ReturnToSupplier AdjustmentReason = "return-to-supplier"
+	// ExpiryWriteOff takes expired lots out of stock
+	ExpiryWriteOff AdjustmentReason = "expired"
+)
+
+var adjustmentReasons = []string{string(DamageAdjustment), string(TheftAdjustment), string(CountCorrection), string(ReturnToSupplier), string(ExpiryWriteOff)}
+
+type ReceiveStockRequest struct {
+	Location string
+	Product  string
+	Quantity int
+	// Reference is the delivery note or purchase order the goods came with
+	Reference string
+	// Lot and Expiry are set for stock tracked by lot
+	Lot    string
+	Expiry time.Time
+}
+
+// lotExpiryConflicts tells whether a lot of the product is already in stock at location with a different expiry.
+// MUST be called with inventoryLock held
+func lotExpiryConflicts(location, product, lot string, expiry time.Time) bool {
+	inv, ok := StockAt(location, product)
+	if !ok || lot == "" {
+		return false
+	}
+	for _, l := range inv.Lots {
+		if l.Number == lot && !l.Expiry.Equal(expiry) {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveStock books goods in, products that aren't stocked yet get a new entry
+func receiveStock(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReceiveStockRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Product == "" || req.Quantity <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "product and a quantity bigger than 0 are needed"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		location := locationParam(req.Location)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		if _, ok := StockMap[location]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "location " + location + " not found"})
+			return
+		}
+		if lotExpiryConflicts(location, req.Product, req.Lot, req.Expiry) {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "lot " + req.Lot + " is already in stock with a different expiry"})
+			return
+		}
+		inv := PostMovement(&StockMovement{Location: location, Product: req.Product, Type: ReceiptMovement, Delta: req.Quantity, Reference: req.Reference, Lot: req.Lot, Expiry: req.Expiry, User: user.Username})
+		c.JSON(http.StatusOK, inv)
+	}
+}
+
+type AdjustStockRequest struct {
+	Location string
+	Product  string
+	// Delta is signed, negative for stock that was lost
+	Delta  int
+	Reason AdjustmentReason
+	Note   string
+	// Lot is the lot being adjusted, stock taken out without one comes from the lots first expiry first out
+	Lot string
+}
+
+func adjustStock(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AdjustStockRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if !StringSliceContains(adjustmentReasons, string(req.Reason)) {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "reason must be one of [" + strings.Join(adjustmentReasons, ", ") + "]"})
+			return
+		}
+		if req.Delta == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "delta cannot be 0"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		location := locationParam(req.Location)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		inv, ok := StockAt(location, req.Product)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "product with ID " + req.Product + " not found at " + location})
+			return
+		}
+		if inv.Quantity+req.Delta < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "adjustment would take stock for product with ID " + req.Product + " below 0"})
+			return
+		}
+		if req.Lot != "" {
+			found := false
+			for _, l := range inv.Lots {
+				if l.Number == req.Lot {
+					found = l.Quantity+req.Delta >= 0
+				}
+			}
+			if !found && req.Delta < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "lot " + req.Lot + " doesn't hold enough stock for the adjustment"})
+				return
+			}
+		}
+		PostAllocated(&StockMovement{Location: location, Product: req.Product, Type: AdjustmentMovement, Delta: req.Delta, Reason: req.Reason, Reference: req.Note, Lot: req.Lot, User: user.Username}, true)
+		c.JSON(http.StatusOK, inv)
+	}
+}
+
+type StockTakeRequest struct {
+	// Location is where the count was done, a stock-take covers a single location
+	Location string
+	// Counts maps product IDs to the quantity counted
+	Counts map[string]int
+	// Apply sets the system quantities to the counted ones, otherwise only the report is produced
+	Apply bool
+}
+
+type StockVariance struct {
+	Product  string
+	System   int
+	Counted  int
+	Variance int
+}
+
+type StockTakeResponse struct {
+	Applied   bool
+	Variances []*StockVariance
+	// NotCounted lists stocked products missing from the count
+	NotCounted []string
+	Errors     []string `json:",omitempty"`
+}
+
+// stockTake compares counted quantities with the system ones and reports the differences
+func stockTake(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req StockTakeRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		res := StockTakeResponse{req.Apply, make([]*StockVariance, 0), make([]string, 0), make([]string, 0)}
+		location := locationParam(req.Location)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		stock, ok := StockMap[location]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "location " + location + " not found"})
+			return
+		}
+		for id, counted := range req.Counts {
+			inv, ok := stock[id]
 			if !ok {
+				res.Errors = append(res.Errors, "product with ID "+id+" not found")
+				continue
+			}
+			if counted < 0 {
+				res.Errors = append(res.Errors, "counted quantity for product with ID "+id+" cannot be negative")
 				continue
 			}
-			inv.Quantity -= d.Quantity
+			res.Variances = append(res.Variances, &StockVariance{id, inv.Quantity, counted, counted - inv.Quantity})
+		}
+		for id := range stock {
+			if _, ok := req.Counts[id]; !ok {
+				res.NotCounted = append(res.NotCounted, id)
+			}
+		}
+		sort.Slice(res.Variances, func(i, j int) bool { return res.Variances[i].Product < res.Variances[j].Product })
+		sort.Strings(res.NotCounted)
+		if len(res.Errors) > 0 {
+			res.Applied = false
+			c.JSON(http.StatusBadRequest, res)
+			return
+		}
+		if req.Apply {
+			user := c.MustGet("user").(*User)
+			for _, v := range res.Variances {
+				if v.Variance != 0 {
+					PostAllocated(&StockMovement{Location: location, Product: v.Product, Type: StockTakeMovement, Delta: v.Variance, Reason: CountCorrection, User: user.Username}, true)
+				}
+			}
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+func setLowWarning(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var lowStr string
+		id := c.Param("ID")
+		if lowStr = c.PostForm("low"); lowStr == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "low field missing"})
+			return
+		}
+		low, err := strconv.Atoi(lowStr)
+		if err != nil || low < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "low value must be a whole number and not negative"})
+			return
+		}
+		location := locationParam(c.PostForm("location"))
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		inv, ok := StockAt(location, id)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "product with ID " + id + " not found at " + location})
+			return
 		}
-		c.JSON(http.StatusOK, InventoryMap)
+		inv.LowWarning = low
+		CheckStockAlerts(inv)
+		c.JSON(http.StatusOK, inv)
 	}
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MovementType says what caused a stock movement
+type MovementType string
+
+const (
+	// OpeningMovement holds the stock there was when the ledger was started
+	OpeningMovement    MovementType = "opening"
+	SaleMovement       MovementType = "sale"
+	ReceiptMovement    MovementType = "receipt"
+	AdjustmentMovement MovementType = "adjustment"
+	StockTakeMovement  MovementType = "stock-take"
+	// TransferOutMovement and TransferInMovement are the two halves of a transfer between locations
+	TransferOutMovement MovementType = "transfer-out"
+	TransferInMovement  MovementType = "transfer-in"
+	// ReleaseMovement puts back stock that was taken for an order that's been cancelled
+	ReleaseMovement MovementType = "release"
+	// ReturnMovement brings back goods a customer returned, into sellable or damaged stock
+	ReturnMovement MovementType = "return"
+)
+
+// StockMovement is an immutable entry in the stock ledger, the quantity of a product at a location is the sum of its deltas
+type StockMovement struct {
+	ID        int
+	Location  string
+	Product   string
+	Type      MovementType
+	Delta     int
+	OrderID   string           `json:",omitempty"`
+	Reason    AdjustmentReason `json:",omitempty"`
+	Reference string           `json:",omitempty"`
+	Lot       string           `json:",omitempty"`
+	// Expiry is only set on movements that bring a lot in
+	Expiry    time.Time
+	User      string
+	Timestamp time.Time
+}
+
+// StockLedger is append only, entries are never changed or removed. It's guarded by inventoryLock
+var StockLedger = openingBalances(StockMap)
+
+func openingBalances(stockMap map[string]map[string]*InventoryStock) []*StockMovement {
+	keys := make([]string, 0)
+	for location, stock := range stockMap {
+		for id := range stock {
+			keys = append(keys, location+"/"+id)
+		}
+	}
+	sort.Strings(keys)
+	ledger := make([]*StockMovement, 0, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		location, id := splitStockKey(key)
+		ledger = append(ledger, &StockMovement{len(ledger) + 1, location, id, OpeningMovement, stockMap[location][id].Quantity, "", "", "", "", time.Time{}, "system", now})
+	}
+	return ledger
+}
+
+func splitStockKey(key string) (string, string) {
+	i := strings.Index(key, "/")
+	return key[:i], key[i+1:]
+}
+
+// PostMovement records the movement in the ledger and applies it to the product's stock, which is created if needed.
+// Any stock alerts the movement causes are sent, and stock it adds goes to backorders waiting for it.
+// MUST be called with inventoryLock held
+func PostMovement(m *StockMovement) *InventoryStock {
+	m.ID = len(StockLedger) + 1
+	m.Timestamp = time.Now()
+	StockLedger = append(StockLedger, m)
+	stock, ok := StockMap[m.Location]
+	if !ok {
+		stock = make(map[string]*InventoryStock)
+		StockMap[m.Location] = stock
+	}
+	inv, ok := stock[m.Product]
+	if !ok {
+		inv = &InventoryStock{m.Product, 0, 0, m.Location, 0, nil}
+		stock[m.Product] = inv
+	}
+	inv.Quantity += m.Delta
+	applyLotMovement(inv, m)
+	CheckStockAlerts(inv)
+	if m.Delta > 0 {
+		pendingAllocations = append(pendingAllocations, allocateBackorders(m.Location, m.Product)...)
+	}
+	return inv
+}
+
+// getMovements lists movements, optionally for a single product or location and between from and to
+func getMovements(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		product := c.Query("product")
+		location := c.Query("location")
+		var from, to time.Time
+		var err error
+		if f := c.Query("from"); f != "" {
+			if from, err = time.Parse(time.RFC3339, f); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "from value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		if t := c.Query("to"); t != "" {
+			if to, err = time.Parse(time.RFC3339, t); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "to value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		movements := make([]*StockMovement, 0)
+		for _, m := range StockLedger {
+			if (product != "" && m.Product != product) || (location != "" && m.Location != location) || (!from.IsZero() && m.Timestamp.Before(from)) || (!to.IsZero() && m.Timestamp.After(to)) {
+				continue
+			}
+			movements = append(movements, m)
+		}
+		c.JSON(http.StatusOK, movements)
+	}
+}
+
+type LedgerDrift struct {
+	Location string
+	Product  string
+	Ledger   int
+	Stock    int
+}
+
+// checkLedger replays the ledger and flags any product whose stock doesn't match it
+func checkLedger(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		replayed := make(map[string]int)
+		for _, m := range StockLedger {
+			replayed[m.Location+"/"+m.Product] += m.Delta
+		}
+		drift := make([]*LedgerDrift, 0)
+		for location, stock := range StockMap {
+			for id, inv := range stock {
+				if q := replayed[location+"/"+id]; q != inv.Quantity {
+					drift = append(drift, &LedgerDrift{location, id, q, inv.Quantity})
+				}
+			}
+		}
+		for key, q := range replayed {
+			location, id := splitStockKey(key)
+			if _, ok := StockAt(location, id); !ok {
+				drift = append(drift, &LedgerDrift{location, id, q, 0})
+			}
+		}
+		sort.Slice(drift, func(i, j int) bool {
+			if drift[i].Location != drift[j].Location {
+				return drift[i].Location < drift[j].Location
+			}
+			return drift[i].Product < drift[j].Product
+		})
+		c.JSON(http.StatusOK, gin.H{"Consistent": len(drift) == 0, "Movements": len(StockLedger), "Drift": drift})
+	}
+}
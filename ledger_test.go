@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckLedger(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ledger/check", checkLedger(nil))
+	inventoryLock.Lock()
+	stockMap, ledger := StockMap, StockLedger
+	inventoryLock.Unlock()
+	t.Cleanup(func() {
+		inventoryLock.Lock()
+		StockMap, StockLedger = stockMap, ledger
+		inventoryLock.Unlock()
+	})
+	movement := func(location, product string, delta int) *StockMovement {
+		return &StockMovement{Location: location, Product: product, Type: AdjustmentMovement, Delta: delta}
+	}
+
+	tests := []struct {
+		name   string
+		stock  map[string]map[string]*InventoryStock
+		ledger []*StockMovement
+		want   []*LedgerDrift
+	}{
+		{
+			"consistent",
+			map[string]map[string]*InventoryStock{"WH1": {"0001": &InventoryStock{"0001", 3, 0, "WH1", 0, nil}}},
+			[]*StockMovement{movement("WH1", "0001", 5), movement("WH1", "0001", -2)},
+			[]*LedgerDrift{},
+		},
+		{
+			"stock changed outside the ledger",
+			map[string]map[string]*InventoryStock{"WH1": {"0001": &InventoryStock{"0001", 4, 0, "WH1", 0, nil}}},
+			[]*StockMovement{movement("WH1", "0001", 5)},
+			[]*LedgerDrift{{"WH1", "0001", 5, 4}},
+		},
+		{
+			"stock and movements without the other",
+			map[string]map[string]*InventoryStock{"GLA": {"0003": &InventoryStock{"0003", 2, 0, "GLA", 0, nil}}, "WH1": {}},
+			[]*StockMovement{movement("WH1", "0002", 3), movement("EDI", "0001", 1)},
+			[]*LedgerDrift{{"EDI", "0001", 1, 0}, {"GLA", "0003", 0, 2}, {"WH1", "0002", 3, 0}},
+		},
+	}
+	for _, tt := range tests {
+		inventoryLock.Lock()
+		StockMap, StockLedger = tt.stock, tt.ledger
+		inventoryLock.Unlock()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/ledger/check", nil))
+		var res struct {
+			Consistent bool
+			Movements  int
+			Drift      []*LedgerDrift
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", tt.name, w.Code, w.Body)
+		}
+		if res.Consistent != (len(tt.want) == 0) || res.Movements != len(tt.ledger) || !reflect.DeepEqual(res.Drift, tt.want) {
+			t.Errorf("%s: got %+v, want drift %+v", tt.name, res, tt.want)
+		}
+	}
+}
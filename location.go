@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LocationType says whether a location sells to customers or only holds stock
+type LocationType string
+
+const (
+	StoreLocation     LocationType = "store"
+	WarehouseLocation LocationType = "warehouse"
+	// DamagedLocation holds returned goods that can't be sold, its stock isn't counted as available
+	DamagedLocation LocationType = "damaged"
+)
+
+// Location is a shop or warehouse that holds stock
+type Location struct {
+	ID       string
+	Name     string
+	Type     LocationType
+	Postcode string
+}
+
+// DefaultLocation is used by requests that don't say which location they're for, as sent before stock had locations
+const DefaultLocation = "WH1"
+
+// DamagedStockLocation is where returns that fail inspection are put
+const DamagedStockLocation = "DMG"
+
+var LocationMap = map[string]*Location{
+	"WH1": &Location{"WH1", "Central Warehouse", WarehouseLocation, "G52 4XZ"},
+	"EDI": &Location{"EDI", "Edinburgh Shop", StoreLocation, "EH1 1YZ"},
+	"GLA": &Location{"GLA", "Glasgow Shop", StoreLocation, "G1 3SL"},
+	"DMG": &Location{"DMG", "Damaged Returns", DamagedLocation, "G52 4XZ"},
+}
+
+// StockAt returns the stock of the product at the location, ok is false if the location doesn't stock it.
+// MUST be called with inventoryLock held
+func StockAt(location, product string) (*InventoryStock, bool) {
+	stock, ok := StockMap[location]
+	if !ok {
+		return nil, false
+	}
+	inv, ok := stock[product]
+	return inv, ok
+}
+
+// AggregateStock sums the stock of every location by product, including what's in transit between them.
+// Damaged stock is left out as it can't be sold. MUST be called with inventoryLock held
+func AggregateStock() map[string]*InventoryStock {
+	agg := make(map[string]*InventoryStock)
+	for location, stock := range StockMap {
+		if l, ok := LocationMap[location]; ok && l.Type == DamagedLocation {
+			continue
+		}
+		for id, inv := range stock {
+			a, ok := agg[id]
+			if !ok {
+				a = &InventoryStock{Product: id}
+				agg[id] = a
+			}
+			a.Quantity += inv.Quantity
+			a.LowWarning += inv.LowWarning
+			for _, l := range inv.Lots {
+				a.Lots = append(a.Lots, &Lot{l.Number, l.Expiry, l.Quantity})
+			}
+		}
+	}
+	for _, t := range TransferMap {
+		if t.Status != TransferInTransit {
+			continue
+		}
+		if a, ok := agg[t.Product]; ok {
+			a.InTransit += t.Quantity
+		}
+	}
+	return agg
+}
+
+// NearestStore picks the store whose postcode shares the longest start with postcode, there's no map data
+// so this stands in for distance: same district beats same area beats anywhere
+func NearestStore(locations map[string]*Location, postcode string) *Location {
+	postcode = NormalisePostcode(postcode)
+	ids := make([]string, 0, len(locations))
+	for id := range locations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var nearest *Location
+	best := -1
+	for _, id := range ids {
+		l := locations[id]
+		if l.Type != StoreLocation {
+			continue
+		}
+		lp := NormalisePostcode(l.Postcode)
+		common := 0
+		for common < len(lp) && common < len(postcode) && lp[common] == postcode[common] {
+			common++
+		}
+		if common > best {
+			nearest = l
+			best = common
+		}
+	}
+	return nearest
+}
+
+// ChooseFulfilmentLocation decides where an order is fulfilled from: the chosen or nearest store for
+// click-and-collect, the warehouse for delivery and the shop the order was taken in otherwise
+func ChooseFulfilmentLocation(locations map[string]*Location, req *BuyOrderRequest) (*Location, error) {
+	switch {
+	case req.DeliveryMethod == ClickAndCollect && req.CollectFrom != "":
+		l, ok := locations[req.CollectFrom]
+		if !ok || l.Type != StoreLocation {
+			return nil, errors.New("store " + req.CollectFrom + " not found")
+		}
+		return l, nil
+	case req.DeliveryMethod == ClickAndCollect:
+		postcode := ""
+		if req.DeliveryAddress != nil {
+			postcode = req.DeliveryAddress.Postcode
+		}
+		if l := NearestStore(locations, postcode); l != nil {
+			return l, nil
+		}
+		return nil, errors.New("no store available for click-and-collect")
+	case req.DeliveryAddress != nil || req.DeliveryMethod != "":
+		l, ok := locations[DefaultLocation]
+		if !ok {
+			return nil, errors.New("warehouse " + DefaultLocation + " not found")
+		}
+		return l, nil
+	case req.Location != "":
+		l, ok := locations[req.Location]
+		if !ok || l.Type == DamagedLocation {
+			return nil, errors.New("location " + req.Location + " not found")
+		}
+		return l, nil
+	}
+	l, ok := locations[DefaultLocation]
+	if !ok {
+		return nil, errors.New("location " + DefaultLocation + " not found")
+	}
+	return l, nil
+}
+
+func getLocations(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		c.JSON(http.StatusOK, LocationMap)
+	}
+}
+
+// locationHoldsStock tells whether there's stock at the location or on its way there.
+// MUST be called with inventoryLock held
+func locationHoldsStock(id string) bool {
+	for _, inv := range StockMap[id] {
+		if inv.Quantity != 0 {
+			return true
+		}
+	}
+	for _, t := range TransferMap {
+		if t.Status == TransferInTransit && t.To == id {
+			return true
+		}
+	}
+	return false
+}
+
+func setLocation(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var l Location
+		if err := c.BindJSON(&l); err != nil {
+			return
+		}
+		l.ID = c.Param("ID")
+		if l.Type != StoreLocation && l.Type != WarehouseLocation && l.Type != DamagedLocation {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "type must be one of [store, warehouse, damaged]"})
+			return
+		}
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		// the type decides whether stock counts as available, so it can't change under stock that's there
+		if old, ok := LocationMap[l.ID]; ok && old.Type != l.Type && locationHoldsStock(l.ID) {
+			c.JSON(http.StatusConflict, gin.H{"Message": "location " + l.ID + " holds stock, its type can't be changed until it's moved out"})
+			return
+		}
+		LocationMap[l.ID] = &l
+		if _, ok := StockMap[l.ID]; !ok {
+			StockMap[l.ID] = make(map[string]*InventoryStock)
+		}
+		c.JSON(http.StatusOK, l)
+	}
+}
+
+// TransferStatus is where a transfer between locations is at
+type TransferStatus string
+
+const (
+	TransferInTransit TransferStatus = "in-transit"
+	TransferReceived  TransferStatus = "received"
+)
+
+// Transfer moves stock between locations, it leaves From when created and arrives at To when received
+type Transfer struct {
+	ID         int
+	Product    string
+	Quantity   int
+	From       string
+	To         string
+	Status     TransferStatus
+	CreatedBy  string
+	ShippedAt  time.Time
+	ReceivedAt time.Time
+	// Lots are the lots that left From, they arrive at To as they are
+	Lots []*LotAllocation
+}
+
+// TransferMap is guarded by inventoryLock
+var TransferMap = make(map[int]*Transfer)
+
+// transferSeq hands out transfer IDs
+var transferSeq = 0
+
+func getTransfers(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		transfers := make([]*Transfer, 0, len(TransferMap))
+		for _, t := range TransferMap {
+			if status := c.Query("status"); status != "" && string(t.Status) != status {
+				continue
+			}
+			transfers = append(transfers, t)
+		}
+		sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+		c.JSON(http.StatusOK, transfers)
+	}
+}
+
+type CreateTransferRequest struct {
+	Product  string
+	Quantity int
+	From     string
+	To       string
+}
+
+func createTransfer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateTransferRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Quantity <= 0 || req.From == req.To {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "a quantity bigger than 0 and two different locations are needed"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		if _, ok := LocationMap[req.To]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "location " + req.To + " not found"})
+			return
+		}
+		inv, ok := StockAt(req.From, req.Product)
+		if !ok || inv.Sellable(time.Now()) < req.Quantity {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "insufficient stock at " + req.From + " for product with ID " + req.Product})
+			return
+		}
+		transferSeq++
+		t := &Transfer{transferSeq, req.Product, req.Quantity, req.From, req.To, TransferInTransit, user.Username, time.Now(), time.Time{}, nil}
+		TransferMap[t.ID] = t
+		t.Lots = PostAllocated(&StockMovement{Location: req.From, Product: req.Product, Type: TransferOutMovement, Delta: -req.Quantity, Reference: "transfer " + strconv.Itoa(t.ID), User: user.Username}, false)
+		c.JSON(http.StatusOK, t)
+	}
+}
+
+func receiveTransfer(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("ID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "transfer ID must be a number"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		t, ok := TransferMap[id]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "transfer " + c.Param("ID") + " not found"})
+			return
+		}
+		if t.Status != TransferInTransit {
+			c.JSON(http.StatusConflict, gin.H{"Message": "transfer " + c.Param("ID") + " is already " + string(t.Status)})
+			return
+		}
+		t.Status = TransferReceived
+		t.ReceivedAt = time.Now()
+		for _, l := range t.Lots {
+			PostMovement(&StockMovement{Location: t.To, Product: t.Product, Type: TransferInMovement, Delta: l.Quantity, Reference: "transfer " + strconv.Itoa(t.ID), Lot: l.Lot, Expiry: l.Expiry, User: user.Username})
+		}
+		c.JSON(http.StatusOK, t)
+	}
+}
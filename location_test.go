@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetLocationKeepsTheTypeOfStockedLocations(t *testing.T) {
+	cl := newCluster(t)
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	t.Cleanup(func() {
+		inventoryLock.Lock()
+		delete(LocationMap, "TST")
+		delete(StockMap, "TST")
+		inventoryLock.Unlock()
+	})
+	tests := []struct {
+		name, body string
+		stock      int
+		want       int
+	}{
+		{"new location", `{"Name":"Test Shop","Type":"store"}`, 0, http.StatusOK},
+		{"retyped while empty", `{"Name":"Test Warehouse","Type":"warehouse"}`, 0, http.StatusOK},
+		{"renamed while stocked", `{"Name":"Test Depot","Type":"warehouse"}`, 3, http.StatusOK},
+		{"retyped while stocked", `{"Name":"Test Depot","Type":"damaged"}`, 3, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if tt.stock > 0 {
+			inventoryLock.Lock()
+			StockMap["TST"]["0001"] = &InventoryStock{"0001", tt.stock, 0, "TST", 0, nil}
+			inventoryLock.Unlock()
+		}
+		if code := cl.send(t, "inventory", "PUT", "/manager/locations/TST", manager.Token, tt.body); code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+	if l := LocationMap["TST"]; l.Type != WarehouseLocation || l.Name != "Test Depot" {
+		t.Errorf("location is %+v, want the renamed warehouse", l)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lot is a batch of a product received together, perishable lots have an Expiry
+type Lot struct {
+	Number string
+	// Expiry is the last moment the lot can be sold, the zero value means it doesn't expire
+	Expiry   time.Time
+	Quantity int
+}
+
+func (l *Lot) Expired(now time.Time) bool {
+	return !l.Expiry.IsZero() && now.After(l.Expiry)
+}
+
+// LotAllocation is the quantity taken from a single lot, an empty Lot is stock that isn't tracked by lot
+type LotAllocation struct {
+	Lot      string
+	Expiry   time.Time
+	Quantity int
+}
+
+// Sellable returns the quantity that can be sold, which leaves out expired lots
+func (inv *InventoryStock) Sellable(now time.Time) int {
+	q := inv.Quantity
+	for _, l := range inv.Lots {
+		if l.Expired(now) {
+			q -= l.Quantity
+		}
+	}
+	return q
+}
+
+// unlotted returns the quantity that isn't in any lot
+func (inv *InventoryStock) unlotted() int {
+	q := inv.Quantity
+	for _, l := range inv.Lots {
+		q -= l.Quantity
+	}
+	return q
+}
+
+// applyLotMovement keeps the lots of the stock in line with a movement that's been posted against a lot
+func applyLotMovement(inv *InventoryStock, m *StockMovement) {
+	if m.Lot == "" {
+		return
+	}
+	for i, l := range inv.Lots {
+		if l.Number == m.Lot {
+			l.Quantity += m.Delta
+			if l.Quantity == 0 {
+				inv.Lots = append(inv.Lots[:i], inv.Lots[i+1:]...)
+			}
+			return
+		}
+	}
+	inv.Lots = append(inv.Lots, &Lot{m.Lot, m.Expiry, m.Delta})
+}
+
+// AllocateLots picks which lots qty units come from, first expiry first out. Lots without an expiry come after the
+// ones with, and stock that isn't in a lot comes last. Expired lots are skipped unless allowExpired is set, as
+// they can't be sold but can still be written off. The result may fall short of qty if there isn't enough stock
+func AllocateLots(inv *InventoryStock, qty int, allowExpired bool, now time.Time) []*LotAllocation {
+	lots := make([]*Lot, 0, len(inv.Lots))
+	for _, l := range inv.Lots {
+		if l.Quantity > 0 && (allowExpired || !l.Expired(now)) {
+			lots = append(lots, l)
+		}
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		if lots[i].Expiry.IsZero() != lots[j].Expiry.IsZero() {
+			return !lots[i].Expiry.IsZero()
+		}
+		return lots[i].Expiry.Before(lots[j].Expiry)
+	})
+	allocations := make([]*LotAllocation, 0)
+	for _, l := range lots {
+		if qty == 0 {
+			break
+		}
+		take := l.Quantity
+		if take > qty {
+			take = qty
+		}
+		allocations = append(allocations, &LotAllocation{l.Number, l.Expiry, take})
+		qty -= take
+	}
+	if free := inv.unlotted(); qty > 0 && free > 0 {
+		take := free
+		if take > qty {
+			take = qty
+		}
+		allocations = append(allocations, &LotAllocation{"", time.Time{}, take})
+		qty -= take
+	}
+	return allocations
+}
+
+// PostAllocated posts a movement that takes stock out, split by lot first expiry first out, and returns where it came from.
+// Whatever can't be allocated is still taken out without a lot, as decrementing is unchecked.
+// Movements that add stock or name a lot are posted as they are. MUST be called with inventoryLock held
+func PostAllocated(m *StockMovement, allowExpired bool) []*LotAllocation {
+	inv, ok := StockAt(m.Location, m.Product)
+	if m.Delta >= 0 || m.Lot != "" || !ok {
+		PostMovement(m)
+		return []*LotAllocation{&LotAllocation{m.Lot, m.Expiry, -m.Delta}}
+	}
+	allocations := AllocateLots(inv, -m.Delta, allowExpired, time.Now())
+	allocated := 0
+	for _, a := range allocations {
+		allocated += a.Quantity
+	}
+	if short := -m.Delta - allocated; short > 0 {
+		allocations = append(allocations, &LotAllocation{"", time.Time{}, short})
+	}
+	for _, a := range allocations {
+		part := *m
+		part.Lot = a.Lot
+		part.Expiry = a.Expiry
+		part.Delta = -a.Quantity
+		PostMovement(&part)
+	}
+	return allocations
+}
+
+type ExpiringLot struct {
+	Location string
+	Product  string
+	Lot      string
+	Expiry   time.Time
+	Quantity int
+	Expired  bool
+}
+
+// getExpiringLots reports lots expiring within the next days (7 by default), including ones that already have
+func getExpiringLots(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		days := 7
+		if d := c.Query("days"); d != "" {
+			var err error
+			if days, err = strconv.Atoi(d); err != nil || days < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "days must be a whole number and not negative"})
+				return
+			}
+		}
+		now := time.Now()
+		until := now.AddDate(0, 0, days)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		expiring := make([]*ExpiringLot, 0)
+		for location, stock := range StockMap {
+			for _, inv := range stock {
+				for _, l := range inv.Lots {
+					if l.Expiry.IsZero() || l.Expiry.After(until) {
+						continue
+					}
+					expiring = append(expiring, &ExpiringLot{location, inv.Product, l.Number, l.Expiry, l.Quantity, l.Expired(now)})
+				}
+			}
+		}
+		sort.Slice(expiring, func(i, j int) bool { return expiring[i].Expiry.Before(expiring[j].Expiry) })
+		c.JSON(http.StatusOK, expiring)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllocateLots(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	// stock returns 20 units of which 5 aren't in a lot
+	stock := func() *InventoryStock {
+		return &InventoryStock{"0003", 20, 0, "1", 0, []*Lot{
+			&Lot{"L-LATE", now.Add(10 * day), 4},
+			&Lot{"L-NONE", time.Time{}, 3},
+			&Lot{"L-SOON", now.Add(2 * day), 2},
+			&Lot{"L-GONE", now.Add(-day), 6},
+		}}
+	}
+	tests := []struct {
+		name         string
+		qty          int
+		allowExpired bool
+		want         []*LotAllocation
+	}{
+		{"first expiry first out", 3, false, []*LotAllocation{{"L-SOON", now.Add(2 * day), 2}, {"L-LATE", now.Add(10 * day), 1}}},
+		{"lots without expiry after dated ones", 7, false, []*LotAllocation{{"L-SOON", now.Add(2 * day), 2}, {"L-LATE", now.Add(10 * day), 4}, {"L-NONE", time.Time{}, 1}}},
+		{"unlotted stock last", 11, false, []*LotAllocation{{"L-SOON", now.Add(2 * day), 2}, {"L-LATE", now.Add(10 * day), 4}, {"L-NONE", time.Time{}, 3}, {"", time.Time{}, 2}}},
+		{"short of stock", 30, false, []*LotAllocation{{"L-SOON", now.Add(2 * day), 2}, {"L-LATE", now.Add(10 * day), 4}, {"L-NONE", time.Time{}, 3}, {"", time.Time{}, 5}}},
+		{"expired lots for write offs", 7, true, []*LotAllocation{{"L-GONE", now.Add(-day), 6}, {"L-SOON", now.Add(2 * day), 1}}},
+		{"nothing", 0, false, []*LotAllocation{}},
+	}
+	for _, tt := range tests {
+		got := AllocateLots(stock(), tt.qty, tt.allowExpired, now)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, allocationsString(got), allocationsString(tt.want))
+		}
+	}
+}
+
+func TestSellable(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	inv := &InventoryStock{"0003", 10, 0, "1", 0, []*Lot{&Lot{"A", now.Add(-time.Hour), 3}, &Lot{"B", now.Add(time.Hour), 4}}}
+	if got := inv.Sellable(now); got != 7 {
+		t.Errorf("sellable %d, want 7", got)
+	}
+	if got := inv.Sellable(now.Add(2 * time.Hour)); got != 3 {
+		t.Errorf("sellable once both lots expired %d, want 3", got)
+	}
+}
+
+func TestApplyLotMovement(t *testing.T) {
+	expiry := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	inv := &InventoryStock{"0003", 0, 0, "1", 0, nil}
+	steps := []struct {
+		lot   string
+		delta int
+		want  []*Lot
+	}{
+		{"A", 5, []*Lot{{"A", expiry, 5}}},
+		{"B", 2, []*Lot{{"A", expiry, 5}, {"B", expiry, 2}}},
+		{"", 9, []*Lot{{"A", expiry, 5}, {"B", expiry, 2}}},
+		{"A", -5, []*Lot{{"B", expiry, 2}}},
+		{"B", -1, []*Lot{{"B", expiry, 1}}},
+	}
+	for i, s := range steps {
+		applyLotMovement(inv, &StockMovement{Lot: s.lot, Expiry: expiry, Delta: s.delta})
+		if !reflect.DeepEqual(inv.Lots, s.want) {
+			t.Fatalf("step %d: lots %+v, want %+v", i, inv.Lots, s.want)
+		}
+	}
+}
+
+func allocationsString(allocations []*LotAllocation) string {
+	s := ""
+	for _, a := range allocations {
+		s += " " + a.Lot + "x" + strconv.Itoa(a.Quantity)
+	}
+	return "[" + s + " ]"
+}
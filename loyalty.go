@@ -1,8 +1,10 @@
 package main
 
 import (
-	"math"
+	"math/big"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,16 +12,29 @@ import (
 func LoyaltyRoutes(s *Server) {
 	private := s.router.Group("/")
 	private.Use(HydrateUserMiddleware(s))
-	private.POST("/update-points", updatePoints(s))
+	private.POST("/update-points", IdempotencyMiddleware(NewIdempotencyStore()), updatePoints(s))
 	private.GET("/points/:cID", pointsForCustomer(s))
+	private.GET("/points/:cID/transactions", RequiresPermissionMiddleware(ManagerRole), getPointsTransactions(s))
+	private.POST("/reverse-points", RequiresPermissionMiddleware(ServiceRole), reversePoints(s))
+	private.POST("/customers", enrollCustomer(s))
+
+	manager := s.router.Group("/manager")
+	manager.Use(HydrateUserMiddleware(s))
+	manager.Use(RequiresPermissionMiddleware(ManagerRole))
+	manager.GET("/customers", findCustomer(s))
+	manager.PUT("/customers/:cID", updateCustomer(s))
+	manager.POST("/customers/:cID/deactivate", deactivateCustomer(s))
+	manager.POST("/customers/:cID/merge", mergeCustomers(s))
+	manager.POST("/points/:cID/adjust", IdempotencyMiddleware(NewIdempotencyStore()), adjustPoints(s))
+	manager.DELETE("/customers/:cID", deleteCustomer(s))
 }
 
 const buyPointsPerPound = 1
 const discountPointsPerPound = 100
 
 var CustomerMap = map[string]*Customer{
-	"000001": &Customer{"000001", 0},
-	"000002": &Customer{"000002", 1000},
+	"000001": &Customer{"000001", "Alice Smith", "alice@example.com", "", false, 0, true, "", time.Time{}, false},
+	"000002": &Customer{"000002", "Bob Jones", "", "07700900123", true, 1000, true, "", time.Time{}, false},
 }
 
 var ProductPointsMultiplier = map[string]float64{
@@ -28,46 +43,62 @@ var ProductPointsMultiplier = map[string]float64{
 }
 
 type GetPointsResponse struct {
-	Customer       *Customer
+	Customer       *CustomerPoints
 	PointsPerPound int
 }
 
+// CustomerPoints is what anyone can see of a customer from their card number, card numbers are easy to guess so
+// it leaves out their details
+type CustomerPoints struct {
+	ID     string
+	Points int
+}
+
 func pointsForCustomer(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		cID := c.Param("ID")
+		cID := c.Param("cID")
 		if cID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"Message": "missing customer field"})
 			return
 		}
-		customer, ok := CustomerMap[cID]
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := resolveCustomer(cID)
 		if !ok {
 			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + cID + " not found"})
 			return
 		}
-		c.JSON(http.StatusOK, GetPointsResponse{customer, discountPointsPerPound})
+		c.JSON(http.StatusOK, GetPointsResponse{&CustomerPoints{customer.ID, customer.Points}, discountPointsPerPound})
 	}
 }
 
 type UpdatePointsRequest struct {
-	CustomerID          string
+	CustomerID string
+	// OrderID is the order the points are for, an order's points are only saved once
+	OrderID             string
 	Cart                map[string]*ProductOrder
 	ApplyDiscountPoints int
+	// DryRun works the points out without saving them, for quotes
+	DryRun bool
 }
 
 type UpdatePointsResponse struct {
 	CustomerID        string
 	PointsBeforeOrder int
 	PointsAfterOrder  int
-	Discount          float64
+	// PointsEarned is what the order earned, before any points used on it were taken off
+	PointsEarned int
+	// EarnedBy splits PointsEarned by product
+	EarnedBy map[string]int
+	Discount Money
 }
 
 func updatePoints(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req UpdatePointsRequest
 		c.BindJSON(&req)
-		customer, ok := CustomerMap[req.CustomerID]
-		if !ok {
-			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + req.CustomerID + " not found"})
+		if !req.DryRun && req.OrderID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "order ID is required to save points"})
 			return
 		}
 		user := c.MustGet("user").(*User)
@@ -76,7 +107,18 @@ func updatePoints(s *Server) gin.HandlerFunc {
 			c.JSON(http.StatusServiceUnavailable, gin.H{"Message": "unable to reach price server"})
 			return
 		}
-		resp := UpdatePointsResponse{req.CustomerID, customer.Points, customer.Points, 0}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := resolveCustomer(req.CustomerID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + req.CustomerID + " not found"})
+			return
+		}
+		if !customer.Active {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "customer " + customer.ID + " is deactivated and can't earn or spend points"})
+			return
+		}
+		resp := UpdatePointsResponse{req.CustomerID, customer.Points, customer.Points, 0, make(map[string]int), NewMoney(0, BaseCurrency)}
 		for _, p := range req.Cart {
 			prod, ok := prices[p.ID]
 			if !ok {
@@ -89,20 +131,78 @@ func updatePoints(s *Server) gin.HandlerFunc {
 			}
 			// We only count full points, so half points get dropped.
 			// Formula is: QTY x Multiplier x PointsPerPoundWhenBuying x ItemPrice
-			floatingPoints := float64(p.Quantity) * mult * float64(buyPointsPerPound) * prod.Price
-			// math.Trunc() will do that to a float, int() converts to int type
-			resp.PointsAfterOrder += int(math.Trunc(floatingPoints))
+			points := prod.Price.Mul(p.Quantity).Rat()
+			points.Mul(points, DecimalRat(mult))
+			points.Mul(points, big.NewRat(buyPointsPerPound, 1))
+			// Quo on the numerator and denominator truncates towards zero
+			earned := int(new(big.Int).Quo(points.Num(), points.Denom()).Int64())
+			resp.EarnedBy[p.ID] += earned
+			resp.PointsEarned += earned
 		}
+		resp.PointsAfterOrder += resp.PointsEarned
 		if req.ApplyDiscountPoints > 0 {
-			if req.ApplyDiscountPoints > customer.Points {
+			// points earned on the order can be spent on it, they're saved before the points used
+			if req.ApplyDiscountPoints > resp.PointsAfterOrder {
 				c.JSON(http.StatusBadRequest, gin.H{"Message": "customer does not have enough points to fulfill request"})
 				return
 			}
-			resp.Discount = float64(req.ApplyDiscountPoints) / discountPointsPerPound
+			resp.Discount = MoneyFromRat(big.NewRat(int64(req.ApplyDiscountPoints), discountPointsPerPound), BaseCurrency, MoneyRounding)
 			resp.PointsAfterOrder -= req.ApplyDiscountPoints
 		}
-		// save state to customer points
-		customer.Points = resp.PointsAfterOrder
+		if !req.DryRun && !postOrderPoints(customer, req.OrderID, resp.PointsEarned, req.ApplyDiscountPoints, user.Username) {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "points for order " + req.OrderID + " have already been saved"})
+			return
+		}
 		c.JSON(http.StatusOK, resp)
 	}
 }
+
+type ReversePointsRequest struct {
+	CustomerID string
+	OrderID    string
+	// Earned is taken back off the customer and Used is given back to them
+	Earned int
+	Used   int
+	// All reverses everything the order has left to reverse instead of Earned and Used, for orders that failed
+	All bool
+}
+
+// reversePoints undoes the points of an order, or part of one. The balance can go below zero
+// when the points earned have already been spent, but no more can be reversed than the ledger has for the order
+func reversePoints(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReversePointsRequest
+		c.BindJSON(&req)
+		if req.Earned < 0 || req.Used < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "points to reverse can't be negative"})
+			return
+		}
+		if req.OrderID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "order ID is required to reverse points"})
+			return
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := resolveCustomer(req.CustomerID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + req.CustomerID + " not found"})
+			return
+		}
+		earned, used := orderPointsLeft(customer, req.OrderID)
+		if req.All {
+			req.Earned, req.Used = earned, used
+		}
+		if req.Earned > earned || req.Used > used {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "order " + req.OrderID + " only has " + strconv.Itoa(earned) + " points earned and " + strconv.Itoa(used) + " points used left to reverse"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		if req.Earned > 0 {
+			postPoints(customer, &PointsTransaction{0, "", ReversalTransaction, -req.Earned, 0, req.OrderID, "", "points earned by refunded goods taken back", user.Username, time.Time{}})
+		}
+		if req.Used > 0 {
+			postPoints(customer, &PointsTransaction{0, "", ReversalTransaction, req.Used, 0, req.OrderID, "", "points used on refunded goods given back", user.Username, time.Time{}})
+		}
+		c.JSON(http.StatusOK, customer)
+	}
+}
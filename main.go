@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-var service = flag.String("s", "order", "The type of service to run, can be one of [order, inventory, price, loyalty, auth]")
+var service = flag.String("s", "order", "The type of service to run, can be one of [order, inventory, price, loyalty, auth, payment]")
+var rounding = flag.String("rounding", "half-up", "How fractions of a penny are rounded, can be one of [half-up, half-even]")
+var taxMode = flag.String("tax-mode", "inclusive", "Whether product prices include tax, can be one of [inclusive, exclusive]")
+var serviceToken = flag.String("service-token", os.Getenv("SERVICE_TOKEN"), "Secret the services share to call each other's internal endpoints, defaults to $SERVICE_TOKEN")
+var reorderInterval = flag.Duration("reorder-interval", time.Hour, "How often the inventory service drafts purchase orders for stock below its reorder point, 0 turns it off")
+var idempotencyWindow = flag.Duration("idempotency-window", 24*time.Hour, "How long responses are kept to replay requests sent again with the same Idempotency-Key")
 
 func main() {
 	flag.Parse()
 
+	mode, err := ParseRoundingMode(*rounding)
+	if err != nil {
+		panic(err)
+	}
+	MoneyRounding = mode
+	PricingTaxMode, err = ParseTaxMode(*taxMode)
+	if err != nil {
+		panic(err)
+	}
+	IdempotencyWindow = *idempotencyWindow
+
 	s := &Server{
 		router:  gin.Default(),
 		service: *service,
@@ -20,10 +39,17 @@ func main() {
 			inventoryEndpoint: "http://inventory-service",
 			loyaltyEndpoint:   "http://loyalty-service",
 			orderEndpoint:     "http://order-service",
+			paymentEndpoint:   "http://payment-service",
 			priceEndpoint:     "http://price-service",
+			serviceToken:      *serviceToken,
 		},
 	}
 	s.routes()
+	if s.service == "inventory" && *reorderInterval > 0 {
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		StartReorderJob(ctx, *reorderInterval)
+	}
 	s.router.Run() // listen and serve on 0.0.0.0:8080
 }
 
@@ -39,8 +65,10 @@ func (s *Server) routes() {
 		LoyaltyRoutes(s)
 	case "auth":
 		AuthRoutes(s)
+	case "payment":
+		PaymentRoutes(s)
 	default:
-		panic("type " + s.service + " is not allowed, allowed types: [order, inventory, price, loyalty, auth]")
+		panic("type " + s.service + " is not allowed, allowed types: [order, inventory, price, loyalty, auth, payment]")
 	}
 }
 
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,7 +20,10 @@ type Config struct {
 	inventoryEndpoint string
 	loyaltyEndpoint   string
 	orderEndpoint     string
+	paymentEndpoint   string
 	priceEndpoint     string
+	// serviceToken is the secret the services share to call each other's internal endpoints
+	serviceToken string
 }
 
 // PermissionRole represents the permission level of a user
@@ -32,6 +34,8 @@ const (
 	UserRole PermissionRole = iota
 	// ManagerRole > UserRole
 	ManagerRole
+	// ServiceRole is for the services calling each other with the service token, it can do anything a manager can
+	ServiceRole
 )
 
 func (s PermissionRole) String() string {
@@ -41,11 +45,13 @@ func (s PermissionRole) String() string {
 var roleToString = map[PermissionRole]string{
 	UserRole:    "UserRole",
 	ManagerRole: "ManagerRole",
+	ServiceRole: "ServiceRole",
 }
 
 var roleToID = map[string]PermissionRole{
 	"UserRole":    UserRole,
 	"ManagerRole": ManagerRole,
+	"ServiceRole": ServiceRole,
 }
 
 // MarshalJSON marshals the enum as a quoted json string
@@ -76,33 +82,96 @@ type User struct {
 	Role     PermissionRole
 }
 
+// Customer is a member of the loyalty scheme, their ID is their card number
 type Customer struct {
-	ID     string
+	ID               string
+	Name             string
+	Email            string `json:",omitempty"`
+	Phone            string `json:",omitempty"`
+	MarketingConsent bool
+	// Points are worked out from the points ledger
 	Points int
+	// Active customers can earn and spend points
+	Active bool
+	// MergedInto is the customer a duplicate account was merged into, its card number finds them
+	MergedInto string `json:",omitempty"`
+	EnrolledAt time.Time
+	// Deleted customers have had their details removed, their card number is kept so their orders can be refunded
+	Deleted bool `json:",omitempty"`
 }
 
 type Order struct {
-	ID              string
-	UserID          string
-	CustomerID      string
-	DeliveryAddress string
-	OrderStatus     string
-	Timestamp       time.Time
-	Cart            map[string]*ProductOrder
-	Total           float64
-	Discount        float64
+	ID         string
+	UserID     string
+	CustomerID string
+	// QuoteID is the quote the order's prices came from, if any
+	QuoteID         string `json:",omitempty"`
+	DeliveryAddress *DeliveryAddress
+	Delivery        *DeliveryQuote
+	// Location is where the order was fulfilled from
+	Location string
+	// Lots records which lots each product was taken from, so orders can be found when a lot is recalled
+	Lots map[string][]*LotAllocation
+	// Backorders are the lines, or parts of lines, that were accepted without stock and are allocated when it arrives
+	Backorders map[string]*BackorderLine `json:",omitempty"`
+	// StockStatus says whether the order has all its stock or is waiting for backorders
+	StockStatus      string
+	FulfilmentPolicy FulfilmentPolicy
+	// Fulfilment records which lines were sent, deferred or dropped
+	Fulfilment  []*FulfilmentLine
+	OrderStatus OrderStatus
+	History     []*OrderStatusChange
+	Timestamp   time.Time
+	// Cart is what the order was charged for, lines that were dropped aren't in it
+	Cart map[string]*ProductOrder
+	// Currency is the currency the order was charged in, Total and Discount are in it
+	Currency        string
+	Total           Money
+	Discount        Money
 	DiscountReasons []string
+	Coupons         []string
+	// BaseTotal and BaseDiscount are the BaseCurrency equivalents, used for reporting
+	BaseTotal    Money
+	BaseDiscount Money
+	ExchangeRate float64
+	// Tax is worked out on the cart after discounts, loyalty points are a way of paying so they don't reduce it
+	Tax *TaxBreakdown
+	// PricedAt is the time prices were taken from, pricing the cart again at it gives the same totals
+	PricedAt time.Time
+	// Lines explains how each line of the cart was priced
+	Lines []*PricedLine
+	// Payable is what the customer was charged, after discounts, tax and loyalty points
+	Payable Money
+	// Payments are the payments that paid Payable, refunds are given back to them
+	Payments []*Payment `json:",omitempty"`
+	// PointsEarned and PointsUsed are kept so they can be reversed if the order is cancelled or returned
+	PointsEarned int
+	PointsUsed   int
+	// PointsEarnedBy splits PointsEarned by product, so cancelling a line takes back what it earned
+	PointsEarnedBy map[string]int `json:",omitempty"`
+	Refunds        []*Refund
+	Returns        []*Return
 }
 
 type InventoryStock struct {
 	Product    string
 	Quantity   int
 	LowWarning int
+	// Location is empty in the aggregated view, which also counts stock in transit between locations
+	Location  string `json:",omitempty"`
+	InTransit int    `json:",omitempty"`
+	// Lots holds the stock tracked by lot, Quantity minus the lots is stock that isn't
+	Lots []*Lot `json:",omitempty"`
 }
 type Product struct {
 	ID    string
 	Name  string
-	Price float64
+	Price Money
+	// Prices holds per-currency overrides of Price, currencies without one are converted with the exchange rate
+	Prices   map[string]Money `json:",omitempty"`
+	TaxClass TaxClass
+	// Weight in grams, used to price delivery
+	Weight int
 }
 
 type ProductOrder struct {
@@ -112,7 +181,13 @@ type ProductOrder struct {
 
 type Discount interface {
 	// Discount applies discount to cart and returns the value to discount and the reason, if any
-	Discount(map[string]*ProductOrder, map[string]*Product) (float64, string)
+	Discount(map[string]*ProductOrder, map[string]*Product) (Money, string)
+}
+
+// Promotion is a Discount applied to every cart it matches, the ID lets it be traced from receipts
+type Promotion struct {
+	ID       string
+	Discount Discount
 }
 
 type PercentDiscount struct {
@@ -120,14 +195,15 @@ type PercentDiscount struct {
 	Percentage float64
 }
 
-func (d *PercentDiscount) Discount(cart map[string]*ProductOrder, products map[string]*Product) (float64, string) {
+func (d *PercentDiscount) Discount(cart map[string]*ProductOrder, products map[string]*Product) (Money, string) {
 	order, ook := cart[d.ProductID]
 	prod, pok := products[d.ProductID]
 	if ook && pok {
 		reason := fmt.Sprintf("%d x %.2f Off for %s", order.Quantity, d.Percentage, prod.Name)
-		return float64(order.Quantity) * (prod.Price * (d.Percentage / 100.0)), reason
+		// round once on the line total, rounding each unit would drift with quantity
+		return prod.Price.Mul(order.Quantity).Percent(d.Percentage, MoneyRounding), reason
 	}
-	return 0, ""
+	return Money{}, ""
 }
 
 type AnyXForY struct {
@@ -136,7 +212,7 @@ type AnyXForY struct {
 	Y          int
 }
 
-func (d *AnyXForY) Discount(cart map[string]*ProductOrder, products map[string]*Product) (float64, string) {
+func (d *AnyXForY) Discount(cart map[string]*ProductOrder, products map[string]*Product) (Money, string) {
 	acc := 0
 	for _, p := range cart {
 		if StringSliceContains(d.ProductIDs, p.ID) {
@@ -147,20 +223,18 @@ func (d *AnyXForY) Discount(cart map[string]*ProductOrder, products map[string]*
 	num := acc / d.X
 	// if num is 0 (< 1) it's because there are no enough matches to apply discount
 	if num < 1 {
-		return 0, ""
+		return Money{}, ""
 	}
 	prod := GetCheapestOf(products, d.ProductIDs)
 	diff := d.X - d.Y
 	reason := fmt.Sprintf("%d x %d for %d", num, d.X, d.Y)
-	return float64(num) * float64(diff) * prod.Price, reason
+	return prod.Price.Mul(num * diff), reason
 }
 
 func GetCheapestOf(pMap map[string]*Product, ids []string) *Product {
 	var prod *Product = nil
-	price := math.MaxFloat64
 	for _, id := range ids {
-		if p, ok := pMap[id]; ok && p.Price < price {
-			price = p.Price
+		if p, ok := pMap[id]; ok && (prod == nil || p.Price.LessThan(prod.Price)) {
 			prod = p
 		}
 	}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// BaseCurrency is the currency products are priced in unless stated otherwise
+const BaseCurrency = "GBP"
+
+// InvalidCurrency is the ISO 4217 code for no currency. Arithmetic gives an amount in it, instead of panicking,
+// when currencies are mixed or the result doesn't fit, see Money.Valid
+const InvalidCurrency = "XXX"
+
+// ErrAmountTooLarge is returned for amounts that don't fit in an int64 of minor units
+var ErrAmountTooLarge = errors.New("amount is too large")
+
+// ErrInvalidAmount is returned for amounts that mixed currencies or overflowed
+var ErrInvalidAmount = errors.New("amount mixes currencies or is too large")
+
+// currencyExponent holds the number of minor unit digits for currencies that don't use 2
+var currencyExponent = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// CurrencyExponent returns the number of digits after the decimal point for the currency
+func CurrencyExponent(currency string) int {
+	if e, ok := currencyExponent[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// RoundingMode decides what happens to fractions of a minor unit
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero, it's the 0 value so it's the default
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the nearest even number (banker's rounding)
+	RoundHalfEven
+)
+
+var roundingToString = map[RoundingMode]string{
+	RoundHalfUp:   "half-up",
+	RoundHalfEven: "half-even",
+}
+
+var roundingToID = map[string]RoundingMode{
+	"half-up":   RoundHalfUp,
+	"half-even": RoundHalfEven,
+	"bankers":   RoundHalfEven,
+}
+
+func (r RoundingMode) String() string {
+	return roundingToString[r]
+}
+
+// ParseRoundingMode returns the RoundingMode with the given name
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	r, ok := roundingToID[name]
+	if !ok {
+		return RoundHalfUp, errors.New("rounding mode " + name + " is not allowed, allowed modes: [half-up, half-even]")
+	}
+	return r, nil
+}
+
+// MoneyRounding is the rounding mode used whenever an amount has to be rounded to a minor unit
+var MoneyRounding = RoundHalfUp
+
+// Money is an exact amount of a currency, held in minor units (e.g. pence)
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney returns amount minor units of currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{amount, currency}
+}
+
+// ParseMoney parses a decimal string such as "5.45" exactly, it fails if there are more decimals than the currency allows
+func ParseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	r, err := parseDecimal(s)
+	if err != nil {
+		return Money{}, err
+	}
+	minor := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(CurrencyExponent(currency))))
+	if !minor.IsInt() {
+		return Money{}, fmt.Errorf("amount %s has more than %d decimal places", s, CurrencyExponent(currency))
+	}
+	if !minor.Num().IsInt64() {
+		return Money{}, ErrAmountTooLarge
+	}
+	return Money{minor.Num().Int64(), currency}, nil
+}
+
+// parseDecimal parses a plain decimal number with an optional sign and point, big.Rat also takes fractions and
+// exponents, which aren't amounts and can be too large to work with
+func parseDecimal(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.ContainsAny(s, "eE/") {
+		return nil, errors.New("amount " + s + " is not a decimal number")
+	}
+	return r, nil
+}
+
+// MoneyFromRat converts a rational number of major units (e.g. pounds) to Money using the given rounding,
+// an amount too large for Money is invalid
+func MoneyFromRat(r *big.Rat, currency string, mode RoundingMode) Money {
+	minor := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(CurrencyExponent(currency))))
+	return MinorUnits(minor, currency, mode)
+}
+
+// MinorUnits rounds a rational number of minor units (e.g. pence) to Money, an amount too large for Money is invalid
+func MinorUnits(r *big.Rat, currency string, mode RoundingMode) Money {
+	amount, err := RoundRat(r, mode)
+	if err != nil {
+		return invalidMoney
+	}
+	return Money{amount, currency}
+}
+
+// RoundRat rounds a rational number to an integer using the given rounding mode, it fails if that doesn't fit an int64
+func RoundRat(r *big.Rat, mode RoundingMode) (int64, error) {
+	num, den := r.Num(), r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		if !quo.IsInt64() {
+			return 0, ErrAmountTooLarge
+		}
+		return quo.Int64(), nil
+	}
+	// compare 2*|rem| with den to find out if we're below, at or above half
+	cmp := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den)
+	away := cmp > 0 || (cmp == 0 && (mode == RoundHalfUp || quo.Bit(0) == 1))
+	if away {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	if !quo.IsInt64() {
+		return 0, ErrAmountTooLarge
+	}
+	return quo.Int64(), nil
+}
+
+// DecimalRat returns the exact decimal value of f as printed, so 33.33 becomes 3333/100 and not its binary approximation
+func DecimalRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	return r
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Rat returns the amount in major units as an exact rational number
+func (m Money) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(CurrencyExponent(m.currency())))
+}
+
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return BaseCurrency
+	}
+	return m.Currency
+}
+
+var invalidMoney = Money{0, InvalidCurrency}
+
+// Valid tells whether the amount is usable, it isn't if it came from mixing currencies or overflowing
+func (m Money) Valid() bool {
+	return m.Currency != InvalidCurrency
+}
+
+// CheckMoney returns ErrInvalidAmount if any of the amounts isn't valid. Arithmetic doesn't fail, so amounts
+// are checked with it before they're sent anywhere
+func CheckMoney(amounts ...Money) error {
+	for _, m := range amounts {
+		if !m.Valid() {
+			return ErrInvalidAmount
+		}
+	}
+	return nil
+}
+
+// sameCurrency returns the currency shared by both amounts, a zero value Money takes the currency of the other.
+// Amounts in different currencies share InvalidCurrency
+func (m Money) sameCurrency(o Money) string {
+	switch {
+	case !m.Valid() || !o.Valid():
+		return InvalidCurrency
+	case m.Currency == "":
+		return o.Currency
+	case o.Currency == "" || o.Currency == m.Currency:
+		return m.Currency
+	}
+	return InvalidCurrency
+}
+
+// Add returns the sum, which is invalid if the currencies differ or it overflows
+func (m Money) Add(o Money) Money {
+	sum := m.Amount + o.Amount
+	currency := m.sameCurrency(o)
+	if currency == InvalidCurrency || (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return invalidMoney
+	}
+	return Money{sum, currency}
+}
+
+// Sub returns the difference, which is invalid if the currencies differ or it overflows
+func (m Money) Sub(o Money) Money {
+	diff := m.Amount - o.Amount
+	currency := m.sameCurrency(o)
+	if currency == InvalidCurrency || (o.Amount > 0 && diff > m.Amount) || (o.Amount < 0 && diff < m.Amount) {
+		return invalidMoney
+	}
+	return Money{diff, currency}
+}
+
+// Mul multiplies the amount by an integer quantity, this never needs rounding. The result is invalid if it overflows
+func (m Money) Mul(qty int) Money {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(int64(qty)))
+	if !m.Valid() || !product.IsInt64() {
+		return invalidMoney
+	}
+	return Money{product.Int64(), m.Currency}
+}
+
+// Percent returns percentage % of the amount, rounded to a minor unit with mode
+func (m Money) Percent(percentage float64, mode RoundingMode) Money {
+	if !m.Valid() {
+		return invalidMoney
+	}
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), DecimalRat(percentage))
+	r.Quo(r, big.NewRat(100, 1))
+	return MinorUnits(r, m.Currency, mode)
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// LessThan compares amounts of the same currency, amounts that can't be compared are never less than each other
+func (m Money) LessThan(o Money) bool {
+	return m.sameCurrency(o) != InvalidCurrency && m.Amount < o.Amount
+}
+
+// String formats the amount in major units without the currency, e.g. "5.45"
+func (m Money) String() string {
+	exp := CurrencyExponent(m.currency())
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	div := pow10(exp).Int64()
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/div, exp, amount%div)
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage
+	Currency string
+}
+
+// MarshalJSON encodes the amount as an exact decimal string alongside its currency
+func (m Money) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`{"Amount":"`)
+	buffer.WriteString(m.String())
+	buffer.WriteString(`","Currency":"`)
+	buffer.WriteString(m.currency())
+	buffer.WriteString(`"}`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON accepts the object written by MarshalJSON, with the amount as a string or a number,
+// as well as a bare number or string in the base currency as used before amounts were exact
+func (m *Money) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	currency := BaseCurrency
+	raw := b
+	if len(b) > 0 && b[0] == '{' {
+		var j moneyJSON
+		if err := json.Unmarshal(b, &j); err != nil {
+			return err
+		}
+		if j.Currency != "" {
+			currency = strings.ToUpper(j.Currency)
+		}
+		if currency == InvalidCurrency {
+			return errors.New("currency " + InvalidCurrency + " is not allowed")
+		}
+		raw = j.Amount
+	}
+	var s string
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(raw)
+	}
+	// older clients sent floats, which may carry binary noise past the minor unit, so round those instead of failing
+	r, err := parseDecimal(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	money := MoneyFromRat(r, currency, MoneyRounding)
+	if !money.Valid() {
+		return ErrAmountTooLarge
+	}
+	*m = money
+	return nil
+}
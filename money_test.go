@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestRoundRat(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		mode     RoundingMode
+		want     int64
+	}{
+		{5, 2, RoundHalfUp, 3},
+		{5, 2, RoundHalfEven, 2},
+		{7, 2, RoundHalfEven, 4},
+		{-5, 2, RoundHalfUp, -3},
+		{-5, 2, RoundHalfEven, -2},
+		{-7, 2, RoundHalfEven, -4},
+		{4, 3, RoundHalfUp, 1},
+		{5, 3, RoundHalfEven, 2},
+		{-4, 3, RoundHalfUp, -1},
+		{6, 3, RoundHalfEven, 2},
+	}
+	for _, tt := range tests {
+		got, err := RoundRat(big.NewRat(tt.num, tt.den), tt.mode)
+		if err != nil || got != tt.want {
+			t.Errorf("RoundRat(%d/%d, %s) = %d, %v, want %d", tt.num, tt.den, tt.mode, got, err, tt.want)
+		}
+	}
+	huge := new(big.Rat).SetFrac(new(big.Int).Lsh(big.NewInt(1), 70), big.NewInt(3))
+	if _, err := RoundRat(huge, RoundHalfUp); err != ErrAmountTooLarge {
+		t.Errorf("RoundRat(2^70/3) error = %v, want ErrAmountTooLarge", err)
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s, currency string
+		want        int64
+		wantErr     bool
+	}{
+		{"5.45", "GBP", 545, false},
+		{" 0.1 ", "GBP", 10, false},
+		{"-3", "EUR", -300, false},
+		{"1500", "JPY", 1500, false},
+		{"5.455", "GBP", 0, true},
+		{"1.5", "JPY", 0, true},
+		{"1e3", "GBP", 0, true},
+		{"1/3", "GBP", 0, true},
+		{"abc", "GBP", 0, true},
+		{"92233720368547758.08", "GBP", 0, true},
+		{"100000000000000000000", "GBP", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.s, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got.Amount != tt.want || got.Currency != tt.currency) {
+			t.Errorf("ParseMoney(%q) = %+v, want %d %s", tt.s, got, tt.want, tt.currency)
+		}
+	}
+}
+
+func TestMoneyJSONRoundTrip(t *testing.T) {
+	for _, m := range []Money{NewMoney(545, "GBP"), NewMoney(-1, "EUR"), NewMoney(1500, "JPY"), NewMoney(0, "USD"), NewMoney(math.MaxInt64, "GBP")} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Money
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", b, err)
+		}
+		if got != m {
+			t.Errorf("round trip of %+v gave %+v through %s", m, got, b)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Money
+		wantErr bool
+	}{
+		{`{"Amount":"5.45","Currency":"GBP"}`, NewMoney(545, "GBP"), false},
+		{`{"Amount":5.45,"Currency":"eur"}`, NewMoney(545, "EUR"), false},
+		{`{"Amount":"5.45"}`, NewMoney(545, BaseCurrency), false},
+		// amounts sent before they were exact
+		{`5.45`, NewMoney(545, BaseCurrency), false},
+		{`"5.45"`, NewMoney(545, BaseCurrency), false},
+		{`5.449999999999999`, NewMoney(545, BaseCurrency), false},
+		{`0.30000000000000004`, NewMoney(30, BaseCurrency), false},
+		{`null`, Money{}, false},
+		{`"five"`, Money{}, true},
+		{`{"Amount":"1","Currency":"XXX"}`, Money{}, true},
+		{`100000000000000000000`, Money{}, true},
+		{`"1/3"`, Money{}, true},
+		{`{"Amount":"1/3","Currency":"GBP"}`, Money{}, true},
+		{`1e999999`, Money{}, true},
+		{`"1e999999"`, Money{}, true},
+	}
+	for _, tt := range tests {
+		var got Money
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, wantErr %v", tt.json, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmeticIsInvalidInsteadOfPanicking(t *testing.T) {
+	gbp, eur := NewMoney(100, "GBP"), NewMoney(100, "EUR")
+	tests := []struct {
+		name string
+		got  Money
+	}{
+		{"add mixed currencies", gbp.Add(eur)},
+		{"sub mixed currencies", gbp.Sub(eur)},
+		{"add overflow", NewMoney(math.MaxInt64, "GBP").Add(NewMoney(1, "GBP"))},
+		{"sub overflow", NewMoney(math.MinInt64, "GBP").Sub(NewMoney(1, "GBP"))},
+		{"mul overflow", NewMoney(math.MaxInt64/2+1, "GBP").Mul(2)},
+		{"invalid spreads", gbp.Add(eur).Add(gbp)},
+		{"convert invalid", gbp.Add(eur).Convert(big.NewRat(1, 1), "EUR")},
+		{"percent invalid", gbp.Add(eur).Percent(10, RoundHalfUp)},
+	}
+	for _, tt := range tests {
+		if tt.got.Valid() {
+			t.Errorf("%s = %+v, want invalid", tt.name, tt.got)
+		}
+	}
+	if gbp.LessThan(eur) || eur.LessThan(gbp) {
+		t.Error("amounts in different currencies compared as less than each other")
+	}
+	if err := CheckMoney(gbp, gbp.Add(eur)); err != ErrInvalidAmount {
+		t.Errorf("CheckMoney error = %v, want ErrInvalidAmount", err)
+	}
+	if err := CheckMoney(gbp, Money{}.Add(eur)); err != nil {
+		t.Errorf("CheckMoney of a zero value sum = %v, want nil", err)
+	}
+}
+
+// TestApportionDiscountReconciles checks, for random carts, that the parts of a discount always add up to the
+// penny and that no line gets more than its share rounded up
+func TestApportionDiscountReconciles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		lines := make(map[string]Money)
+		total := int64(0)
+		for j := 0; j < 1+r.Intn(8); j++ {
+			v := r.Int63n(1_000_000)
+			if i%10 == 0 {
+				// big enough for the products of amounts to overflow an int64
+				v = r.Int63n(math.MaxInt64 / 16)
+			}
+			lines[strconv.Itoa(j)] = NewMoney(v, "GBP")
+			total += v
+		}
+		if total <= 0 {
+			continue
+		}
+		amount := NewMoney(r.Int63n(total+1), "GBP")
+		parts := ApportionDiscount(amount, lines, nil)
+		sum := int64(0)
+		for id, p := range parts {
+			share := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(amount.Amount), big.NewInt(lines[id].Amount)), big.NewInt(total))
+			floor := new(big.Int).Quo(share.Num(), share.Denom()).Int64()
+			if p.Amount < floor || p.Amount > floor+1 {
+				t.Fatalf("line %s of %v got %d of %d, want %d or %d", id, lines, p.Amount, amount.Amount, floor, floor+1)
+			}
+			if p.Amount > lines[id].Amount {
+				t.Fatalf("line %s got %d off a line worth %d", id, p.Amount, lines[id].Amount)
+			}
+			sum += p.Amount
+		}
+		if sum != amount.Amount {
+			t.Fatalf("parts of %d over %v add up to %d", amount.Amount, lines, sum)
+		}
+	}
+}
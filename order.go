@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,14 +16,189 @@ func OrderRoutes(s *Server) {
 	private := s.router.Group("/")
 	private.Use(HydrateUserMiddleware(s))
 	private.GET("/", getOrders(s))
-	private.POST("/new", buyOrder(s))
+	private.GET("/:ID", getOrder(s))
+	private.POST("/new", IdempotencyMiddleware(NewIdempotencyStore()), buyOrder(s))
+	private.POST("/quote", quoteOrder(s))
+	private.POST("/backorders/allocated", RequiresPermissionMiddleware(ServiceRole), backordersAllocated(s))
+	private.POST("/:ID/pay", moveOrder(s, OrderPaid))
+	private.POST("/:ID/pick", moveOrder(s, OrderPicking))
+	private.POST("/:ID/pack", moveOrder(s, OrderPacked))
+	private.POST("/:ID/ship", moveOrder(s, OrderShipped))
+	private.POST("/:ID/deliver", moveOrder(s, OrderDelivered))
+	private.POST("/:ID/cancel", moveOrder(s, OrderCancelled))
+	private.POST("/:ID/cancel-lines", cancelLines(s))
+	private.POST("/:ID/returns", requestReturn(s))
+
+	manager := s.router.Group("/manager")
+	manager.Use(HydrateUserMiddleware(s))
+	manager.Use(RequiresPermissionMiddleware(ManagerRole))
+	manager.GET("/recall/:lot", getOrdersByLot(s))
+	manager.GET("/returns", getReturnsReport(s))
+	manager.POST("/returns/:rma/approve", moveReturn(s, ReturnApproved))
+	manager.POST("/returns/:rma/reject", moveReturn(s, ReturnRejected))
+	manager.POST("/returns/:rma/receive", receiveReturn(s))
 }
 
 var OrdersMap = make(map[string]*Order)
 
+// orderLock guards OrdersMap, backorder allocations can change orders at any time
+var orderLock sync.Mutex
+
+// visibleTo tells whether user can see the order, users only see the orders they placed and managers see everything
+func (o *Order) visibleTo(user *User) bool {
+	return user.Role >= ManagerRole || o.UserID == user.Username
+}
+
+func getOrder(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		o, ok := OrdersMap[c.Param("ID")]
+		// other users' orders are reported as not found so their IDs can't be probed
+		if !ok || !o.visibleTo(user) {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "order " + c.Param("ID") + " not found"})
+			return
+		}
+		c.JSON(http.StatusOK, o)
+	}
+}
+
+const (
+	defaultOrdersPageSize = 20
+	maxOrdersPageSize     = 100
+)
+
+type OrdersPage struct {
+	Orders []*Order
+	// NextCursor is passed as the cursor to get the next page, it's empty on the last one
+	NextCursor string `json:",omitempty"`
+}
+
+// orderSorts compare orders by the fields they can be sorted on, the ID breaks ties so pages are stable
+var orderSorts = map[string]func(a, b *Order) bool{
+	"timestamp": func(a, b *Order) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return a.ID < b.ID
+	},
+	"total": func(a, b *Order) bool {
+		if a.BaseTotal.Amount != b.BaseTotal.Amount {
+			return a.BaseTotal.Amount < b.BaseTotal.Amount
+		}
+		return a.ID < b.ID
+	},
+}
+
+// getOrders lists the orders the user can see, filtered by the status, customer, user, from, to, min and max query
+// parameters. min and max are in BaseCurrency and compared with BaseTotal. Orders are sorted by sort (timestamp or
+// total) in order (asc or desc, newest first by default) and paged with limit and cursor
 func getOrders(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, OrdersMap)
+		user := c.MustGet("user").(*User)
+		var from, to time.Time
+		var err error
+		if f := c.Query("from"); f != "" {
+			if from, err = time.Parse(time.RFC3339, f); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "from value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		if t := c.Query("to"); t != "" {
+			if to, err = time.Parse(time.RFC3339, t); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "to value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		var minTotal, maxTotal *Money
+		for field, bound := range map[string]**Money{"min": &minTotal, "max": &maxTotal} {
+			if v := c.Query(field); v != "" {
+				m, err := ParseMoney(v, BaseCurrency)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"Message": field + " value must be an amount of " + BaseCurrency})
+					return
+				}
+				*bound = &m
+			}
+		}
+		sortBy := c.DefaultQuery("sort", "timestamp")
+		less, ok := orderSorts[sortBy]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "sort must be one of timestamp or total"})
+			return
+		}
+		desc := c.DefaultQuery("order", "desc") == "desc"
+		limit := defaultOrdersPageSize
+		if l := c.Query("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxOrdersPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "limit must be a number between 1 and " + strconv.Itoa(maxOrdersPageSize)})
+				return
+			}
+		}
+		before := less
+		if desc {
+			before = func(a, b *Order) bool { return less(b, a) }
+		}
+		status := OrderStatus(c.Query("status"))
+		customer := c.Query("customer")
+		placedBy := c.Query("user")
+
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		var cursor *Order
+		if cur := c.Query("cursor"); cur != "" {
+			// the cursor is the last order of the previous page, orders are never deleted so it's always there
+			if cursor, ok = OrdersMap[cur]; !ok || !cursor.visibleTo(user) {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "cursor is not valid"})
+				return
+			}
+		}
+		orders := make([]*Order, 0)
+		for _, o := range OrdersMap {
+			switch {
+			case !o.visibleTo(user),
+				status != "" && o.OrderStatus != status,
+				customer != "" && o.CustomerID != customer,
+				placedBy != "" && o.UserID != placedBy,
+				!from.IsZero() && o.Timestamp.Before(from),
+				!to.IsZero() && o.Timestamp.After(to),
+				minTotal != nil && o.BaseTotal.Amount < minTotal.Amount,
+				maxTotal != nil && o.BaseTotal.Amount > maxTotal.Amount,
+				cursor != nil && !before(cursor, o):
+				continue
+			}
+			orders = append(orders, o)
+		}
+		sort.Slice(orders, func(i, j int) bool { return before(orders[i], orders[j]) })
+		page := OrdersPage{orders, ""}
+		if len(orders) > limit {
+			page.Orders = orders[:limit]
+			page.NextCursor = orders[limit-1].ID
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
+
+// getOrdersByLot finds the orders that took stock from a lot, so customers can be contacted when it's recalled
+func getOrdersByLot(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lot := c.Param("lot")
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		orders := make([]*Order, 0)
+		for _, o := range OrdersMap {
+			found := false
+			for _, allocations := range o.Lots {
+				for _, a := range allocations {
+					found = found || a.Lot == lot
+				}
+			}
+			if found {
+				orders = append(orders, o)
+			}
+		}
+		c.JSON(http.StatusOK, orders)
 	}
 }
 
@@ -35,75 +213,282 @@ type BuyOrderRequest struct {
 	Cart            map[string]*ProductOrder
 	CustomerID      string
 	UsePoints       int
-	DeliveryAddress string
+	DeliveryAddress *DeliveryAddress
+	// DeliveryMethod defaults to standard when there's an address, orders without either are taken in the shop
+	DeliveryMethod DeliveryMethod
+	CouponCodes    []string
+	// Currency to charge the order in, defaults to BaseCurrency
+	Currency string
+	// CollectFrom is the store a click-and-collect order is picked up from, the nearest one is used if empty
+	CollectFrom string
+	// Location is the shop an order without delivery is taken in
+	Location string
+	// Fulfilment says what to do when some of the cart isn't in stock, defaults to all-or-nothing
+	Fulfilment FulfilmentPolicy
+	// QuoteID keeps the prices of a quote from POST /quote, the order has to be the same as the one quoted
+	QuoteID string
+	// PaymentToken is a card from the payment provider that pays for the order when there are no Tenders
+	PaymentToken string
+	// Tenders split what's left to pay after points between cards, gift cards and store credit
+	Tenders []*Tender
+}
+
+// orderDraft is an order that's been checked against stock and priced but not placed
+type orderDraft struct {
+	location *Location
+	plan     *FulfilmentPlan
+	// cart is what's charged for, and pricing what it costs before loyalty points
+	cart    map[string]*ProductOrder
+	pricing *CartValueResponse
+	// key identifies what was priced, so a quote can only be used for the same order
+	key string
 }
 
+// draftOrder checks an order against stock and prices it without changing anything, using the prices of its quote
+// if it has one. The status code is 0 if the order can go ahead, otherwise it and the errors say why it can't
+func draftOrder(s *Server, user *User, orderReq *BuyOrderRequest) (*orderDraft, int, []string, []string) {
+	errors := make([]string, 0)
+	warnings := make([]string, 0)
+	switch orderReq.Fulfilment {
+	case "", AllOrNothing, ShipAvailable, SplitShipments:
+	default:
+		return nil, http.StatusBadRequest, warnings, append(errors, "fulfilment must be one of all-or-nothing, ship-available or split")
+	}
+	locations := FetchLocations(s.config.inventoryEndpoint, user.Token)
+	if locations == nil {
+		return nil, http.StatusServiceUnavailable, warnings, append(errors, "unable to reach inventory server")
+	}
+	location, locErr := ChooseFulfilmentLocation(locations, orderReq)
+	if locErr != nil {
+		return nil, http.StatusBadRequest, warnings, append(errors, locErr.Error())
+	}
+	stock := FetchInventory(s.config.inventoryEndpoint, user.Token, location.ID)
+	if stock == nil {
+		return nil, http.StatusServiceUnavailable, warnings, append(errors, "unable to reach inventory server")
+	}
+	policies := FetchBackorderPolicies(s.config.inventoryEndpoint, user.Token)
+	if policies == nil {
+		return nil, http.StatusServiceUnavailable, warnings, append(errors, "unable to reach inventory server")
+	}
+	plan := PlanFulfilment(orderReq.Cart, stock, policies, orderReq.Fulfilment, location, time.Now())
+	warnings = append(warnings, plan.Warnings...)
+	errors = append(errors, plan.Errors...)
+	if len(errors) > 0 {
+		return nil, http.StatusBadRequest, warnings, errors
+	}
+	// dropped lines aren't charged for, and don't earn points or count towards coupons
+	draft := &orderDraft{location, plan, plan.Cart(), nil, ""}
+	draft.key = quoteKey(orderReq, draft.cart)
+	if orderReq.QuoteID != "" {
+		pricing, err := QuotedPricing(orderReq.QuoteID, user, draft.key)
+		if err != nil {
+			return nil, http.StatusConflict, warnings, append(errors, err.Error())
+		}
+		draft.pricing = pricing
+		return draft, 0, warnings, errors
+	}
+	var delivery *DeliveryRequest
+	if orderReq.DeliveryAddress != nil || orderReq.DeliveryMethod != "" {
+		delivery = &DeliveryRequest{orderReq.DeliveryMethod, orderReq.DeliveryAddress}
+	}
+
+	// price the cart before touching stock, so rejected coupons don't leave inventory decremented
+	cartResp, cartErr := SendCalculateCartRequest(s.config.priceEndpoint, user.Token, &CalculateCartRequest{draft.cart, orderReq.CustomerID, orderReq.CouponCodes, orderReq.Currency, time.Time{}, true, delivery})
+	if cartErr != nil {
+		return nil, http.StatusServiceUnavailable, warnings, append(errors, cartErr.Error())
+	}
+	for code, reason := range cartResp.RejectedCoupons {
+		errors = append(errors, "coupon "+code+" rejected: "+reason)
+	}
+	if cartResp.Delivery != nil && cartResp.Delivery.Error != "" {
+		errors = append(errors, cartResp.Delivery.Error)
+	}
+	if len(errors) > 0 {
+		return nil, http.StatusBadRequest, warnings, errors
+	}
+	draft.pricing = cartResp
+	return draft, 0, warnings, errors
+}
+
+// applyPoints takes the loyalty points discount off the pricing, points are worth BaseCurrency
+// so they're converted to what the order is charged in
+func applyPoints(pricing *CartValueResponse, loyaltyResp *UpdatePointsResponse, usePoints int) error {
+	if loyaltyResp.Discount.Amount <= 0 {
+		return nil
+	}
+	discount := loyaltyResp.Discount.Convert(DecimalRat(pricing.ExchangeRate), pricing.Currency)
+	pricing.Discount = pricing.Discount.Add(discount)
+	pricing.BaseDiscount = pricing.BaseDiscount.Add(loyaltyResp.Discount)
+	pricing.Payable = pricing.Payable.Sub(discount)
+	pricing.DiscountReasons = append(pricing.DiscountReasons, fmt.Sprintf("%s %s off for using %d loyalty points", discount, pricing.Currency, usePoints))
+	return CheckMoney(pricing.Discount, pricing.BaseDiscount, pricing.Payable)
+}
+
+// newOrder builds an order from a draft, the stock and points it took are filled in once they've been taken
+func newOrder(id string, user *User, orderReq *BuyOrderRequest, d *orderDraft) *Order {
+	p := d.pricing
+	return &Order{id, user.Username, orderReq.CustomerID, orderReq.QuoteID, orderReq.DeliveryAddress, p.Delivery, d.location.ID, nil, nil, "", d.plan.Policy, d.plan.Lines, OrderPending, nil, time.Now(), d.cart, p.Currency, p.Total, p.Discount, p.DiscountReasons, p.Coupons, p.BaseTotal, p.BaseDiscount, p.ExchangeRate, p.Tax, p.PricedAt, p.Lines, p.Payable, nil, 0, 0, nil, nil, nil}
+}
+
+// undoOrder gives back what an order that failed took: its payments are voided, or refunded if they were captured,
+// and its coupons, stock, backorders and points are released when coupons, stock or points says they were asked for.
+// Requests that failed are undone too, as they may have gone through. It returns what couldn't be given back
+func undoOrder(s *Server, user *User, orderID, customerID string, payments []*Payment, coupons, stock, points bool) []string {
+	failed := make([]string, 0)
+	for _, p := range payments {
+		var err error
+		if p.Status == PaymentCaptured {
+			_, err = SendRefundPaymentRequest(s.config.paymentEndpoint, s.config.serviceToken, p.ID, p.Captured, "order-failed-"+p.ID)
+		} else {
+			_, err = SendVoidPaymentRequest(s.config.paymentEndpoint, s.config.serviceToken, p.ID)
+		}
+		if err != nil {
+			failed = append(failed, "unable to give back payment "+p.ID+": "+err.Error())
+		}
+	}
+	if coupons {
+		if err := SendReleaseCouponsRequest(s.config.priceEndpoint, s.config.serviceToken, &ReleaseCouponsRequest{orderID}); err != nil {
+			failed = append(failed, "unable to release coupons: "+err.Error())
+		}
+	}
+	if stock {
+		if _, err := SendReleaseRequest(s.config.inventoryEndpoint, s.config.serviceToken, &ReleaseRequest{orderID, nil, "order failed"}); err != nil {
+			failed = append(failed, "unable to release stock: "+err.Error())
+		}
+	}
+	if points && customerID != "" {
+		if err := SendReversePointsRequest(s.config.loyaltyEndpoint, s.config.serviceToken, &ReversePointsRequest{customerID, orderID, 0, 0, true}); err != nil {
+			failed = append(failed, "unable to reverse points: "+err.Error())
+		}
+	}
+	return failed
+}
+
+// buyOrder places an order. Coupons are redeemed first, so an order that lost a coupon to another takes nothing,
+// then the payment is authorized and only captured once the stock and points have been taken. If anything fails, everything the order took is given back
 func buyOrder(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		user := c.MustGet("user").(*User)
-		errors := make([]string, 0)
-		warnings := make([]string, 0)
-		stock := FetchInventory(s.config.inventoryEndpoint, user.Token)
-		if stock == nil {
-			errors := append(errors, "unable to reach inventory server")
-			c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
-			return
-		}
 		var orderReq BuyOrderRequest
 		c.BindJSON(&orderReq)
-		for _, p := range orderReq.Cart {
-			s, ok := stock[p.ID]
-			if !ok {
-				errors = append(errors, "product with ID: "+p.ID+" not found")
-				continue
+		draft, code, warnings, errors := draftOrder(s, user, &orderReq)
+		if code != 0 {
+			c.JSON(code, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
+			return
+		}
+		location, plan, cart, cartResp := draft.location, draft.plan, draft.cart, draft.pricing
+		id := uuid.Must(uuid.NewRandom())
+
+		// points pay for part of the order, so what's left to pay is worked out before taking them
+		pointsUsed := 0
+		if orderReq.CustomerID != "" {
+			loyaltyResp, loyaltyErr := SendUpdatePointsRequest(s.config.loyaltyEndpoint, user.Token, &UpdatePointsRequest{orderReq.CustomerID, id.String(), cart, orderReq.UsePoints, true})
+			if loyaltyErr != nil {
+				errors := append(errors, loyaltyErr.Error())
+				c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
+				return
 			}
-			if p.Quantity > s.Quantity {
-				errors = append(errors, "insufficient stock to fulfill order for product with ID: "+p.ID)
-				continue
+			if orderReq.UsePoints > 0 {
+				pointsUsed = orderReq.UsePoints
 			}
-			if (s.Quantity - p.Quantity) <= s.LowWarning {
-				warnings = append(warnings, "order will take stock for product with ID "+p.ID+" below the warning threshold")
-				continue
+			if err := applyPoints(cartResp, loyaltyResp, orderReq.UsePoints); err != nil {
+				errors := append(errors, err.Error())
+				c.JSON(http.StatusBadRequest, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
+				return
 			}
 		}
-		if len(errors) > 0 {
+		tenders, err := splitTenders(cartResp.Payable, &orderReq)
+		if err != nil {
+			errors := append(errors, err.Error())
 			c.JSON(http.StatusBadRequest, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
 			return
 		}
-		err := SendDecrementRequest(s.config.inventoryEndpoint, user.Token, orderReq.Cart)
-		if err != nil {
+		payments := make([]*Payment, 0, len(tenders))
+		// couponsTaken, stockTaken and pointsTaken are set once they've been asked for, so fail knows to give them back
+		couponsTaken, stockTaken, pointsTaken := false, false, false
+		// fail gives back everything the order took, the customer is only charged for orders that go through.
+		// The client's Idempotency-Key is only freed for a retry once everything has been given back, a retry gets
+		// a new order ID so the keys sent to the other services wouldn't stop it taking stock and points again
+		fail := func(code int, err error) {
 			errors := append(errors, err.Error())
-			c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
-			return
+			if undoErrors := undoOrder(s, user, id.String(), orderReq.CustomerID, payments, couponsTaken, stockTaken, pointsTaken); len(undoErrors) > 0 {
+				errors = append(errors, undoErrors...)
+				KeepIdempotentResponse(c)
+			}
+			c.JSON(code, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
 		}
-
-		if orderReq.DeliveryAddress != "" {
-			orderReq.Cart["9999"] = &ProductOrder{"9999", 1}
+		if len(cartResp.Coupons) > 0 {
+			couponsTaken = true
+			redeemErr := SendRedeemCouponsRequest(s.config.priceEndpoint, s.config.serviceToken, &RedeemCouponsRequest{cartResp.Coupons, orderReq.CustomerID, id.String(), cart, cartResp.Currency})
+			if redeemErr != nil {
+				fail(http.StatusConflict, redeemErr)
+				return
+			}
+		}
+		for i, t := range tenders {
+			payment, err := SendAuthorizePaymentRequest(s.config.paymentEndpoint, user.Token, &AuthorizePaymentRequest{id.String(), t.Type, t.Token, t.Amount, orderReq.CustomerID}, "authorize-"+id.String()+"-"+strconv.Itoa(i))
+			if err != nil {
+				fail(paymentError(err), err)
+				return
+			}
+			payments = append(payments, payment)
 		}
 
-		cartResp, cartErr := SendCalculateCartRequest(s.config.priceEndpoint, user.Token, orderReq.Cart)
-		if cartErr != nil {
-			errors := append(errors, cartErr.Error())
-			c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
+		stockTaken = true
+		decResp, err := SendDecrementRequest(s.config.inventoryEndpoint, user.Token, id.String(), location.ID, plan.Available)
+		if err != nil {
+			fail(http.StatusServiceUnavailable, err)
 			return
 		}
+		var allocated []*BackorderAllocation
+		backorders := plan.Backorders
+		if len(backorders) > 0 {
+			allocated, err = SendBackorderRequest(s.config.inventoryEndpoint, s.config.serviceToken, &BackorderRequest{id.String(), location.ID, plan.Policy, backorders})
+			if err != nil {
+				fail(http.StatusServiceUnavailable, err)
+				return
+			}
+		} else {
+			backorders = nil
+		}
 
+		pointsEarned := 0
+		var pointsEarnedBy map[string]int
 		if orderReq.CustomerID != "" {
-			loyaltyResp, loyaltyErr := SendUpdatePointsRequest(s.config.loyaltyEndpoint, user.Token, orderReq.CustomerID, orderReq.Cart, orderReq.UsePoints)
+			pointsTaken = true
+			loyaltyResp, loyaltyErr := SendUpdatePointsRequest(s.config.loyaltyEndpoint, user.Token, &UpdatePointsRequest{orderReq.CustomerID, id.String(), cart, orderReq.UsePoints, false})
 			if loyaltyErr != nil {
-				errors := append(errors, loyaltyErr.Error())
-				c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to fulfill order", warnings, errors})
+				fail(http.StatusServiceUnavailable, loyaltyErr)
 				return
 			}
-
-			if loyaltyResp.Discount > 0 {
-				cartResp.Discount += loyaltyResp.Discount
-				cartResp.DiscountReasons = append(cartResp.DiscountReasons, fmt.Sprintf("%.2f off for using %d loyalty points", loyaltyResp.Discount, orderReq.UsePoints))
+			pointsEarned, pointsEarnedBy = loyaltyResp.PointsEarned, loyaltyResp.EarnedBy
+		}
+		order := newOrder(id.String(), user, &orderReq, draft)
+		for i, p := range payments {
+			captured, err := SendCapturePaymentRequest(s.config.paymentEndpoint, s.config.serviceToken, p.ID)
+			if err != nil {
+				fail(paymentError(err), err)
+				return
 			}
+			// the payments captured so far are refunded rather than voided if a later one fails
+			payments[i] = captured
+			order.Payments = append(order.Payments, captured)
 		}
-		id := uuid.Must(uuid.NewRandom())
-		order := &Order{id.String(), user.Username, orderReq.CustomerID, orderReq.DeliveryAddress, "processed", time.Now(), orderReq.Cart, cartResp.Total, cartResp.Discount, cartResp.DiscountReasons}
+		order.Lots = decResp.Lots
+		order.Backorders = backorders
+		order.PointsEarned, order.PointsUsed, order.PointsEarnedBy = pointsEarned, pointsUsed, pointsEarnedBy
+		for _, a := range allocated {
+			order.Allocate(a)
+		}
+		order.StockStatus = order.BackorderStatus()
+		order.SetStatus(OrderPending, user.Username, "order placed")
+		order.SetStatus(OrderPaid, user.Username, "")
+		orderLock.Lock()
 		OrdersMap[id.String()] = order
+		orderLock.Unlock()
+		if orderReq.QuoteID != "" {
+			UseQuote(orderReq.QuoteID)
+		}
 
 		c.JSON(http.StatusOK, BuyOrderResponse{order, "order processed successfully", warnings, errors})
 	}
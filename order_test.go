@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cluster runs every service in process, talking to each other over http like they do when deployed
+type cluster struct {
+	servers map[string]*httptest.Server
+	// wrap lets a test put a handler in front of a service, to make it fail
+	wrap  map[string]func(http.Handler) http.Handler
+	token string
+}
+
+func newCluster(t *testing.T) *cluster {
+	gin.SetMode(gin.TestMode)
+	config := &Config{serviceToken: "test-service-token"}
+	cl := &cluster{make(map[string]*httptest.Server), make(map[string]func(http.Handler) http.Handler), ""}
+	for _, name := range []string{"auth", "inventory", "price", "loyalty", "order", "payment"} {
+		s := &Server{gin.New(), name, config}
+		s.routes()
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var h http.Handler = s.router
+			if wrap, ok := cl.wrap[name]; ok {
+				h = wrap(h)
+			}
+			h.ServeHTTP(w, r)
+		}))
+		t.Cleanup(ts.Close)
+		cl.servers[name] = ts
+	}
+	config.authEndpoint = cl.servers["auth"].URL
+	config.inventoryEndpoint = cl.servers["inventory"].URL
+	config.priceEndpoint = cl.servers["price"].URL
+	config.loyaltyEndpoint = cl.servers["loyalty"].URL
+	config.orderEndpoint = cl.servers["order"].URL
+	config.paymentEndpoint = cl.servers["payment"].URL
+	user, _ := UserLogin("alex", "supersafepassword")
+	LoggedInUsers[user.Token] = user
+	cl.token = user.Token
+	return cl
+}
+
+// service returns the token the services of the cluster use between each other
+func (cl *cluster) service() string {
+	return "test-service-token"
+}
+
+// buy sends the order to POST /new, with an Idempotency-Key if key isn't empty. replayed tells whether the
+// response was a replay of an earlier one
+func (cl *cluster) buy(t *testing.T, key string, orderReq *BuyOrderRequest) (code int, res *BuyOrderResponse, replayed bool) {
+	body, _ := json.Marshal(orderReq)
+	req, _ := http.NewRequest("POST", cl.servers["order"].URL+"/new", bytes.NewBuffer(body))
+	req.Header.Add("Authorization", "Bearer "+cl.token)
+	req.Header.Add("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Add("Idempotency-Key", key)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	res = &BuyOrderResponse{}
+	json.NewDecoder(response.Body).Decode(res)
+	return response.StatusCode, res, response.Header.Get("Idempotent-Replayed") == "true"
+}
+
+// snapshot is the state an order changes in the other services
+type snapshot struct {
+	stock0001, stock0002 int
+	outstanding          int
+	giftCard             Money
+	points               int
+	orders               int
+}
+
+func takeSnapshot(giftCard, customer string) snapshot {
+	var s snapshot
+	inventoryLock.Lock()
+	s.stock0001 = StockMap["WH1"]["0001"].Quantity
+	s.stock0002 = StockMap["WH1"]["0002"].Quantity
+	for _, b := range BackorderList {
+		s.outstanding += b.Outstanding()
+	}
+	inventoryLock.Unlock()
+	tenderLock.Lock()
+	s.giftCard = GiftCardMap[giftCard].Balance
+	tenderLock.Unlock()
+	customerLock.Lock()
+	s.points = CustomerMap[customer].Points
+	customerLock.Unlock()
+	orderLock.Lock()
+	s.orders = len(OrdersMap)
+	orderLock.Unlock()
+	return s
+}
+
+// addGiftCard puts an active gift card worth value pence on file
+func addGiftCard(code string, value int64) {
+	now := time.Now()
+	tenderLock.Lock()
+	GiftCardMap[code] = &GiftCard{code, GiftCardActive, gbp(value), gbp(value), "antero", now, now.Add(time.Hour)}
+	tenderLock.Unlock()
+}
+
+func TestBuyOrderSplitTenders(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("SPLITTENDERS0001", 1000)
+	before := takeSnapshot("SPLITTENDERS0001", "000002")
+
+	// 2 x 5.45 less 1.00 of points is 9.90, 5.00 on the gift card and the rest on the card
+	code, res, _ := cl.buy(t, "", &BuyOrderRequest{
+		Cart:       map[string]*ProductOrder{"0002": &ProductOrder{"0002", 2}},
+		CustomerID: "000002",
+		UsePoints:  100,
+		Tenders:    []*Tender{{GiftCardTender, "SPLITTENDERS0001", gbp(500)}, {CardTender, "tok_visa", Money{}}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	o := res.Order
+	if o.Payable != gbp(990) || len(o.Payments) != 2 {
+		t.Fatalf("payable %s with %d payments", o.Payable, len(o.Payments))
+	}
+	for i, want := range []Money{gbp(500), gbp(490)} {
+		if p := o.Payments[i]; p.Status != PaymentCaptured || p.Captured != want {
+			t.Errorf("payment %d is %s for %s, want captured %s", i, p.Status, p.Captured, want)
+		}
+	}
+	after := takeSnapshot("SPLITTENDERS0001", "000002")
+	if after.giftCard != before.giftCard.Sub(gbp(500)) {
+		t.Errorf("gift card went from %s to %s", before.giftCard, after.giftCard)
+	}
+	if after.stock0002 != before.stock0002-2 {
+		t.Errorf("stock went from %d to %d", before.stock0002, after.stock0002)
+	}
+	// 10.90 earns 10 points
+	if after.points != before.points+10-100 || o.PointsEarned != 10 || o.PointsUsed != 100 {
+		t.Errorf("points went from %d to %d, order earned %d and used %d", before.points, after.points, o.PointsEarned, o.PointsUsed)
+	}
+	if after.orders != before.orders+1 {
+		t.Errorf("%d orders saved", after.orders-before.orders)
+	}
+}
+
+func TestBuyOrderCaptureFailureIsUndone(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("CAPTUREFAILS0001", 1000)
+	before := takeSnapshot("CAPTUREFAILS0001", "000002")
+
+	// one more 0001 than is in stock is backordered, the gift card is captured before the card fails
+	code, res, _ := cl.buy(t, "", &BuyOrderRequest{
+		Cart:       map[string]*ProductOrder{"0001": &ProductOrder{"0001", before.stock0001 + 1}, "0002": &ProductOrder{"0002", 1}},
+		CustomerID: "000002",
+		UsePoints:  100,
+		Tenders:    []*Tender{{GiftCardTender, "CAPTUREFAILS0001", gbp(500)}, {CardTender, "fake-capture-timeout", Money{}}},
+	})
+	if code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	if len(res.Errors) != 1 {
+		t.Errorf("errors %v, want only the capture failure", res.Errors)
+	}
+	if after := takeSnapshot("CAPTUREFAILS0001", "000002"); after != before {
+		t.Errorf("failed order left %+v, was %+v", after, before)
+	}
+	paymentLock.Lock()
+	defer paymentLock.Unlock()
+	var status PaymentStatus
+	for _, p := range PaymentMap {
+		if strings.HasPrefix(p.ProviderRef, "gift-card/CAPTUREFAILS0001#") {
+			status = p.Status
+		}
+	}
+	if status != PaymentRefunded {
+		t.Errorf("captured gift card payment is %q, want refunded", status)
+	}
+}
+
+func TestBuyOrderReportsWhatCouldNotBeUndone(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("UNDOFAILS0000001", 1000)
+	// the inventory service takes the stock but can't release it
+	cl.wrap["inventory"] = func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/release" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	code, res, _ := cl.buy(t, "", &BuyOrderRequest{
+		Cart:    map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}},
+		Tenders: []*Tender{{GiftCardTender, "UNDOFAILS0000001", gbp(100)}, {CardTender, "fake-capture-timeout", Money{}}},
+	})
+	if code != http.StatusGatewayTimeout || len(res.Errors) != 2 {
+		t.Errorf("status %d errors %v, want the capture failure and the stock that wasn't released", code, res.Errors)
+	}
+}
+
+func TestBuyOrderRetryAfterFailure(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("RETRYAFTERFAIL01", 1000)
+	before := takeSnapshot("RETRYAFTERFAIL01", "000002")
+	orderReq := &BuyOrderRequest{
+		Cart:       map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}},
+		CustomerID: "000002",
+		Tenders:    []*Tender{{GiftCardTender, "RETRYAFTERFAIL01", gbp(100)}, {CardTender, "fake-capture-timeout", Money{}}},
+	}
+	// everything was given back, so the key is free and each retry is a new attempt
+	for i := 0; i < 3; i++ {
+		if code, _, replayed := cl.buy(t, "retry-after-failure", orderReq); code != http.StatusGatewayTimeout || replayed {
+			t.Fatalf("attempt %d: status %d replayed %v", i, code, replayed)
+		}
+	}
+	if after := takeSnapshot("RETRYAFTERFAIL01", "000002"); after != before {
+		t.Errorf("retries left %+v, was %+v", after, before)
+	}
+
+	// stock can't be given back, so retries are sent the failure instead of taking stock again
+	cl.wrap["inventory"] = func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/release" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	code, _, _ := cl.buy(t, "retry-after-undo-failed", orderReq)
+	for i := 0; i < 2; i++ {
+		if retry, _, replayed := cl.buy(t, "retry-after-undo-failed", orderReq); retry != code || !replayed {
+			t.Fatalf("retry %d: status %d replayed %v, want the first failure replayed", i, retry, replayed)
+		}
+	}
+	if after := takeSnapshot("RETRYAFTERFAIL01", "000002"); after.stock0002 != before.stock0002-1 {
+		t.Errorf("stock went from %d to %d, want it taken once", before.stock0002, after.stock0002)
+	}
+}
+
+func TestBuyOrderGivesBackCoupons(t *testing.T) {
+	cl := newCluster(t)
+	couponLock.Lock()
+	CouponMap["ONCEEACH"] = &Coupon{"ONCEEACH", DiscountSpec{Type: "percent", ProductID: "0001", Percentage: 10}, 0, 1, time.Time{}, Money{}, 0, map[string]int{}}
+	couponLock.Unlock()
+	t.Cleanup(func() {
+		couponLock.Lock()
+		delete(CouponMap, "ONCEEACH")
+		couponLock.Unlock()
+	})
+	orderReq := &BuyOrderRequest{
+		Cart:        map[string]*ProductOrder{"0001": &ProductOrder{"0001", 1}},
+		CustomerID:  "000002",
+		CouponCodes: []string{"onceeach"},
+		Tenders:     []*Tender{{CardTender, "fake-capture-timeout", Money{}}},
+	}
+	if code, res, _ := cl.buy(t, "", orderReq); code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	couponLock.Lock()
+	if cp := CouponMap["ONCEEACH"]; cp.Redemptions != 0 || cp.CustomerRedemptions["000002"] != 0 {
+		t.Errorf("failed order left %d redemptions", cp.Redemptions)
+	}
+	couponLock.Unlock()
+
+	orderReq.Tenders = []*Tender{{CardTender, "tok_visa", Money{}}}
+	code, res, _ := cl.buy(t, "", orderReq)
+	if code != http.StatusOK || len(res.Order.Coupons) != 1 {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	couponLock.Lock()
+	defer couponLock.Unlock()
+	if cp := CouponMap["ONCEEACH"]; cp.Redemptions != 1 || cp.CustomerRedemptions["000002"] != 1 {
+		t.Errorf("order left %d redemptions", cp.Redemptions)
+	}
+}
+
+func TestBuyOrderStoreCredit(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("STORECREDIT00001", 1000)
+	tenderLock.Lock()
+	StoreCreditMap["000001"] = &StoreCreditAccount{"000001", "0123456789ABCDEF", gbp(300)}
+	tenderLock.Unlock()
+	t.Cleanup(func() {
+		tenderLock.Lock()
+		delete(StoreCreditMap, "000001")
+		tenderLock.Unlock()
+	})
+	orderReq := func(customerID, token string) *BuyOrderRequest {
+		return &BuyOrderRequest{
+			Cart:       map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}},
+			CustomerID: customerID,
+			Tenders:    []*Tender{{StoreCreditTender, token, gbp(300)}, {GiftCardTender, "STORECREDIT00001", Money{}}},
+		}
+	}
+	before := takeSnapshot("STORECREDIT00001", "000002")
+	for _, tt := range []struct{ customer, token string }{{"000002", "0123456789ABCDEF"}, {"000002", "000001"}, {"", "0123456789ABCDEF"}} {
+		if code, res, _ := cl.buy(t, "", orderReq(tt.customer, tt.token)); code != http.StatusPaymentRequired && code != http.StatusBadRequest {
+			t.Errorf("%q paying with %q: status %d %+v", tt.customer, tt.token, code, res)
+		}
+	}
+	if after := takeSnapshot("STORECREDIT00001", "000002"); after != before {
+		t.Errorf("declined orders left %+v, was %+v", after, before)
+	}
+
+	if code, res, _ := cl.buy(t, "", orderReq("000001", "0123456789abcdef")); code != http.StatusOK {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	if b := StoreCreditMap["000001"].Balance; !b.IsZero() {
+		t.Errorf("store credit left %s", b)
+	}
+}
+
+func TestGetOrders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t0 := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	order := func(id, user, customer string, status OrderStatus, at time.Duration, total int64) *Order {
+		return &Order{ID: id, UserID: user, CustomerID: customer, OrderStatus: status, Timestamp: t0.Add(at), BaseTotal: gbp(total)}
+	}
+	orderLock.Lock()
+	saved := OrdersMap
+	// the first three were placed at the same moment, so only their IDs order them
+	OrdersMap = map[string]*Order{
+		"O1": order("O1", "alex", "000001", OrderPaid, 0, 1000),
+		"O2": order("O2", "alex", "000002", OrderCancelled, 0, 2000),
+		"O3": order("O3", "alex", "000001", OrderPaid, 0, 3000),
+		"O4": order("O4", "antero", "", OrderPaid, time.Hour, 500),
+		"O5": order("O5", "alex", "000002", OrderPaid, 2*time.Hour, 1500),
+	}
+	orderLock.Unlock()
+	t.Cleanup(func() {
+		orderLock.Lock()
+		OrdersMap = saved
+		orderLock.Unlock()
+	})
+	users := map[string]*User{"alex": UserMap["alex"], "antero": UserMap["antero"]}
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) { c.Set("user", users[c.GetHeader("X-User")]) }, getOrders(nil))
+	list := func(user, query string) (int, string, string) {
+		req := httptest.NewRequest("GET", "/?"+query, nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page OrdersPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		ids := make([]string, 0, len(page.Orders))
+		for _, o := range page.Orders {
+			ids = append(ids, o.ID)
+		}
+		return w.Code, strings.Join(ids, " "), page.NextCursor
+	}
+
+	tests := []struct {
+		name, user, query string
+		want, next        string
+	}{
+		{"own orders newest first", "alex", "", "O5 O3 O2 O1", ""},
+		{"managers see every order", "antero", "", "O5 O4 O3 O2 O1", ""},
+		{"first page", "alex", "limit=2", "O5 O3", "O3"},
+		{"page after equal timestamps", "alex", "limit=2&cursor=O3", "O2 O1", ""},
+		{"ascending pages", "alex", "order=asc&limit=1&cursor=O1", "O2", "O2"},
+		{"status and customer", "alex", "status=paid&customer=000001", "O3 O1", ""},
+		{"total between min and max", "antero", "min=15&max=30.00", "O5 O3 O2", ""},
+		{"placed by", "antero", "user=antero", "O4", ""},
+		{"placed by someone else", "alex", "user=antero", "", ""},
+		{"from", "alex", "from=" + t0.Add(30*time.Minute).Format(time.RFC3339), "O5", ""},
+		{"to", "antero", "to=" + t0.Add(time.Hour).Format(time.RFC3339), "O4 O3 O2 O1", ""},
+		{"by total", "alex", "sort=total&order=asc", "O1 O5 O2 O3", ""},
+	}
+	for _, tt := range tests {
+		code, got, next := list(tt.user, tt.query)
+		if code != http.StatusOK || got != tt.want || next != tt.next {
+			t.Errorf("%s: got %d [%s] next %q, want [%s] next %q", tt.name, code, got, next, tt.want, tt.next)
+		}
+	}
+
+	// walking the pages sees every order once
+	var walked []string
+	for cursor, pages := "", 0; pages < 10; pages++ {
+		_, got, next := list("alex", "order=asc&limit=1&cursor="+cursor)
+		walked = append(walked, got)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if got := strings.Join(walked, " "); got != "O1 O2 O3 O5" {
+		t.Errorf("walking the pages got %s", got)
+	}
+	for _, query := range []string{"cursor=O4", "sort=customer", "limit=0", "min=lots"} {
+		if code, _, _ := list("alex", query); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, code)
+		}
+	}
+}
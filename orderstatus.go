@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OrderStatus is where an order is in its lifecycle
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "pending"
+	OrderPaid      OrderStatus = "paid"
+	OrderPicking   OrderStatus = "picking"
+	OrderPacked    OrderStatus = "packed"
+	OrderShipped   OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderReturned  OrderStatus = "returned"
+)
+
+type OrderStatusChange struct {
+	Status    OrderStatus
+	User      string
+	Timestamp time.Time
+	Note      string `json:",omitempty"`
+}
+
+// orderTransitions lists the statuses each status can move to and the role needed to do it.
+// UserRole transitions can also be made by the user that placed the order, everything else needs a manager
+var orderTransitions = map[OrderStatus]map[OrderStatus]PermissionRole{
+	OrderPending: {OrderPaid: ManagerRole, OrderCancelled: UserRole},
+	OrderPaid:    {OrderPicking: ManagerRole, OrderCancelled: UserRole},
+	OrderPicking: {OrderPacked: ManagerRole, OrderCancelled: ManagerRole},
+	OrderPacked:  {OrderShipped: ManagerRole, OrderCancelled: ManagerRole},
+	OrderShipped: {OrderDelivered: ManagerRole},
+	// orders are returned by the returns workflow once everything on them has been refunded
+	OrderDelivered: {OrderReturned: ManagerRole},
+}
+
+// SetStatus moves the order to status and records it in the history
+func (o *Order) SetStatus(status OrderStatus, user, note string) {
+	o.OrderStatus = status
+	o.History = append(o.History, &OrderStatusChange{status, user, time.Now(), note})
+}
+
+// busyOrders are the IDs of orders being changed by changeOrder, it's guarded by orderLock
+var busyOrders = make(map[string]bool)
+
+// changeOrder makes a change to an order that needs other services, without holding orderLock while they're called
+// so that one slow service doesn't hold up every other order. find and prepare are run with orderLock held: find
+// looks the order up and prepare checks the change and returns send, which is run without orderLock and mustn't
+// touch the order. commit is run with orderLock held again, gets the error from send and writes the response.
+// The order is busy from prepare to commit, other changes to it get a 409 until it's done
+func changeOrder(c *gin.Context, find func() (*Order, string), prepare func(o *Order) (func() error, int, string), commit func(o *Order, err error)) {
+	orderLock.Lock()
+	o, notFound := find()
+	if o == nil {
+		orderLock.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"Message": notFound})
+		return
+	}
+	if busyOrders[o.ID] {
+		orderLock.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "order " + o.ID + " is being changed, try again"})
+		return
+	}
+	send, code, reason := prepare(o)
+	if code != 0 {
+		orderLock.Unlock()
+		c.JSON(code, gin.H{"code": code, "Message": reason})
+		return
+	}
+	busyOrders[o.ID] = true
+	orderLock.Unlock()
+	// the order mustn't stay busy if send panics
+	committed := false
+	defer func() {
+		if !committed {
+			orderLock.Lock()
+			delete(busyOrders, o.ID)
+			orderLock.Unlock()
+		}
+	}()
+
+	var err error
+	if send != nil {
+		err = send()
+	}
+
+	orderLock.Lock()
+	defer orderLock.Unlock()
+	committed = true
+	delete(busyOrders, o.ID)
+	commit(o, err)
+}
+
+// visibleOrder looks up an order for changeOrder, it's only found if the user can see it
+func visibleOrder(id string, user *User) func() (*Order, string) {
+	return func() (*Order, string) {
+		if o, ok := OrdersMap[id]; ok && o.visibleTo(user) {
+			return o, ""
+		}
+		return nil, "order " + id + " not found"
+	}
+}
+
+// orderSideEffects are run before an order moves to a status, with orderLock held. They return what to send to other
+// services, which is sent without orderLock, and what to record on the order once it's sent. The order doesn't move
+// if either fails
+var orderSideEffects = map[OrderStatus]func(s *Server, o *Order, user *User) (func() error, func(o *Order), error){
+	OrderCancelled: cancelOrder,
+}
+
+// cancelOrder puts back the stock taken for the order, cancels its backorders and refunds what's left of it
+func cancelOrder(s *Server, o *Order, user *User) (func() error, func(o *Order), error) {
+	refund, err := o.RefundFor(o.Remaining(), "order cancelled", user.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	to := o.refundTo()
+	var payments []*Payment
+	send := func() error {
+		if _, err := SendReleaseRequest(s.config.inventoryEndpoint, s.config.serviceToken, &ReleaseRequest{to.OrderID, nil, "refund " + strconv.Itoa(refund.ID)}); err != nil {
+			return err
+		}
+		payments, err = applyRefund(s, to, user, refund)
+		return err
+	}
+	return send, func(o *Order) { o.recordRefund(refund, payments) }, nil
+}
+
+// moveOrder moves an order to status if the transition is allowed and the user has the role for it.
+// An optional note form field is kept in the history
+func moveOrder(s *Server, status OrderStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		note := c.PostForm("note")
+		var record func(o *Order)
+		changeOrder(c, visibleOrder(c.Param("ID"), user), func(o *Order) (func() error, int, string) {
+			if code, reason := checkTransition(o, status, user); code != 0 {
+				return nil, code, reason
+			}
+			// split orders can be picked while they wait for the rest, everything else is sent in one go
+			if status == OrderPicking && o.StockStatus != StockAllocated && o.FulfilmentPolicy != SplitShipments {
+				return nil, http.StatusConflict, "order " + o.ID + " is " + o.StockStatus + " and cannot be picked yet"
+			}
+			effect, ok := orderSideEffects[status]
+			if !ok {
+				return nil, 0, ""
+			}
+			send, commit, err := effect(s, o, user)
+			if err != nil {
+				return nil, http.StatusConflict, err.Error()
+			}
+			record = commit
+			return send, 0, ""
+		}, func(o *Order, err error) {
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"Message": err.Error()})
+				return
+			}
+			if record != nil {
+				record(o)
+			}
+			o.SetStatus(status, user.Username, note)
+			c.JSON(http.StatusOK, o)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckTransition(t *testing.T) {
+	customer := &User{Username: "alex", Role: UserRole}
+	manager := &User{Username: "antero", Role: ManagerRole}
+	now := time.Now()
+	old := now.Add(-2 * customerCancelWindow)
+	tests := []struct {
+		from     OrderStatus
+		to       OrderStatus
+		user     *User
+		placedAt time.Time
+		want     int
+	}{
+		{OrderPending, OrderPaid, manager, now, 0},
+		{OrderPending, OrderPaid, customer, now, http.StatusForbidden},
+		{OrderPending, OrderCancelled, customer, now, 0},
+		{OrderPaid, OrderCancelled, customer, now, 0},
+		{OrderPaid, OrderCancelled, customer, old, http.StatusForbidden},
+		{OrderPaid, OrderCancelled, manager, old, 0},
+		{OrderPaid, OrderPicking, manager, now, 0},
+		{OrderPaid, OrderShipped, manager, now, http.StatusConflict},
+		{OrderPicking, OrderCancelled, customer, now, http.StatusForbidden},
+		{OrderPicking, OrderPacked, manager, now, 0},
+		{OrderPacked, OrderShipped, manager, now, 0},
+		{OrderPacked, OrderCancelled, manager, now, 0},
+		{OrderShipped, OrderCancelled, manager, now, http.StatusConflict},
+		{OrderShipped, OrderDelivered, manager, now, 0},
+		{OrderDelivered, OrderReturned, manager, now, 0},
+		{OrderDelivered, OrderCancelled, manager, now, http.StatusConflict},
+		{OrderCancelled, OrderPaid, manager, now, http.StatusConflict},
+		{OrderReturned, OrderDelivered, manager, now, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		o := &Order{ID: "1", UserID: "alex", OrderStatus: tt.from, Timestamp: tt.placedAt}
+		if got, reason := checkTransition(o, tt.to, tt.user); got != tt.want {
+			t.Errorf("%s -> %s by %s: got %d %q, want %d", tt.from, tt.to, tt.user.Username, got, reason, tt.want)
+		}
+	}
+}
+
+func TestSetStatusKeepsHistory(t *testing.T) {
+	o := &Order{ID: "1", OrderStatus: OrderPending}
+	o.SetStatus(OrderPaid, "antero", "")
+	o.SetStatus(OrderCancelled, "alex", "changed my mind")
+	if o.OrderStatus != OrderCancelled || len(o.History) != 2 {
+		t.Fatalf("status %s with %d changes", o.OrderStatus, len(o.History))
+	}
+	if h := o.History[1]; h.Status != OrderCancelled || h.User != "alex" || h.Note != "changed my mind" {
+		t.Errorf("last change %+v", h)
+	}
+}
+
+func TestMoveOrderDoesNotHoldUpOtherOrders(t *testing.T) {
+	cl := newCluster(t)
+	code, res, _ := cl.buy(t, "", &BuyOrderRequest{
+		Cart:    map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}},
+		Tenders: []*Tender{{CardTender, "tok_visa", Money{}}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("buying the order got %d", code)
+	}
+	// the inventory service is slow to put the stock back
+	releasing, release := make(chan bool, 1), make(chan bool)
+	cl.wrap["inventory"] = func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/release" {
+				releasing <- true
+				<-release
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	cancelled := make(chan int)
+	go func() {
+		cancelled <- cl.send(t, "order", "POST", "/"+res.Order.ID+"/cancel", cl.token, "")
+	}()
+	<-releasing
+
+	done := make(chan int)
+	go func() {
+		done <- cl.send(t, "order", "GET", "/"+res.Order.ID, cl.token, "")
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("reading the order while it's cancelled got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading the order waited for the order being cancelled")
+	}
+	if code := cl.send(t, "order", "POST", "/"+res.Order.ID+"/cancel-lines", cl.token, `{"Lines":{"0002":1}}`); code != http.StatusConflict {
+		t.Errorf("changing the order while it's cancelled got %d, want 409", code)
+	}
+
+	close(release)
+	if code := <-cancelled; code != http.StatusOK {
+		t.Fatalf("cancelling got %d", code)
+	}
+	orderLock.Lock()
+	defer orderLock.Unlock()
+	if o := OrdersMap[res.Order.ID]; o.OrderStatus != OrderCancelled || len(o.Refunds) != 1 || busyOrders[o.ID] {
+		t.Errorf("order is %s with %d refunds, busy %v, want it cancelled once", o.OrderStatus, len(o.Refunds), busyOrders[o.ID])
+	}
+}
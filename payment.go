@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func PaymentRoutes(s *Server) {
+	private := s.router.Group("/")
+	private.Use(HydrateUserMiddleware(s))
+	private.GET("/:ID", getPayment(s))
+	private.POST("/authorize", IdempotencyMiddleware(NewIdempotencyStore()), authorizePayment(s))
+	private.POST("/:ID/capture", RequiresPermissionMiddleware(ServiceRole), capturePayment(s))
+	private.POST("/:ID/void", RequiresPermissionMiddleware(ServiceRole), voidPayment(s))
+	private.POST("/:ID/refund", RequiresPermissionMiddleware(ServiceRole), IdempotencyMiddleware(NewIdempotencyStore()), refundPayment(s))
+	private.GET("/gift-cards/:code", getGiftCard(s))
+	private.GET("/store-credit/:token", getStoreCredit(s))
+
+	manager := s.router.Group("/manager")
+	manager.Use(HydrateUserMiddleware(s))
+	manager.Use(RequiresPermissionMiddleware(ManagerRole))
+	manager.GET("/ledger", getBalanceLedger(s))
+	manager.POST("/gift-cards", issueGiftCard(s))
+	manager.POST("/gift-cards/:code/activate", activateGiftCard(s))
+	manager.POST("/gift-cards/:code/reload", IdempotencyMiddleware(NewIdempotencyStore()), reloadGiftCard(s))
+	manager.GET("/store-credit/:cID", getCustomerStoreCredit(s))
+	manager.POST("/store-credit/:cID", IdempotencyMiddleware(NewIdempotencyStore()), creditStore(s))
+}
+
+var ErrPaymentDeclined = errors.New("payment was declined")
+var ErrPaymentTimeout = errors.New("payment provider timed out")
+
+// PaymentProvider takes payments from a payment method. Money is authorized first, which holds it without taking
+// it, then either captured or voided. Refunds can only be made against money that was captured
+type PaymentProvider interface {
+	// Authorize holds amount on the payment method that token stands for and returns the provider's reference
+	Authorize(token string, amount Money, reference string) (string, error)
+	Capture(ref string, amount Money) error
+	Void(ref string) error
+	Refund(ref string, amount Money) error
+}
+
+// FakeOutcome is what the fake provider does with a payment
+type FakeOutcome string
+
+const (
+	FakeApprove FakeOutcome = "approve"
+	FakeDecline FakeOutcome = "decline"
+	FakeTimeout FakeOutcome = "timeout"
+	// FakeCaptureTimeout approves the authorization but times out capturing it
+	FakeCaptureTimeout FakeOutcome = "capture-timeout"
+)
+
+// FakeProvider is a PaymentProvider that works offline. The outcome of a payment is scripted by its token:
+// tokens starting with "fake-decline" are declined, "fake-timeout" time out, "fake-capture-timeout" are authorized
+// but time out when they're captured and anything else is approved. Voids and refunds always go through
+type FakeProvider struct {
+	sync.Mutex
+	// authorized maps the references given out to the outcome of the token they were authorized with
+	authorized map[string]FakeOutcome
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{authorized: make(map[string]FakeOutcome)}
+}
+
+func fakeOutcome(token string) FakeOutcome {
+	switch {
+	case strings.HasPrefix(token, "fake-decline"):
+		return FakeDecline
+	case strings.HasPrefix(token, "fake-timeout"):
+		return FakeTimeout
+	case strings.HasPrefix(token, "fake-capture-timeout"):
+		return FakeCaptureTimeout
+	}
+	return FakeApprove
+}
+
+func (p *FakeProvider) Authorize(token string, amount Money, reference string) (string, error) {
+	outcome := fakeOutcome(token)
+	switch outcome {
+	case FakeDecline:
+		return "", ErrPaymentDeclined
+	case FakeTimeout:
+		return "", ErrPaymentTimeout
+	}
+	ref := "fake_" + uuid.Must(uuid.NewRandom()).String()
+	p.Lock()
+	p.authorized[ref] = outcome
+	p.Unlock()
+	return ref, nil
+}
+
+func (p *FakeProvider) Capture(ref string, amount Money) error {
+	if err := p.known(ref); err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.authorized[ref] == FakeCaptureTimeout {
+		return ErrPaymentTimeout
+	}
+	return nil
+}
+
+func (p *FakeProvider) Void(ref string) error {
+	return p.known(ref)
+}
+
+func (p *FakeProvider) Refund(ref string, amount Money) error {
+	return p.known(ref)
+}
+
+func (p *FakeProvider) known(ref string) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.authorized[ref]; !ok {
+		return errors.New("unknown payment reference " + ref)
+	}
+	return nil
+}
+
+// PaymentStatus is where a payment is in its lifecycle
+type PaymentStatus string
+
+const (
+	PaymentAuthorized PaymentStatus = "authorized"
+	PaymentCaptured   PaymentStatus = "captured"
+	PaymentVoided     PaymentStatus = "voided"
+	PaymentRefunded   PaymentStatus = "refunded"
+)
+
+type Payment struct {
+	ID      string
+	OrderID string
+	UserID  string
+	Tender  TenderType
+	// ProviderRef is the provider's reference for the payment
+	ProviderRef string
+	Status      PaymentStatus
+	// Amount is what was authorized, Captured and Refunded what has been taken and given back of it
+	Amount    Money
+	Captured  Money
+	Refunded  Money
+	Timestamp time.Time
+}
+
+// Payments is the provider card payments are taken with
+var Payments PaymentProvider = NewFakeProvider()
+
+// paymentLock guards PaymentMap
+var paymentLock sync.Mutex
+var PaymentMap = make(map[string]*Payment)
+
+// visibleTo tells whether user can see the payment, users only see the payments they made and managers see everything
+func (p *Payment) visibleTo(user *User) bool {
+	return user.Role >= ManagerRole || p.UserID == user.Username
+}
+
+type AuthorizePaymentRequest struct {
+	OrderID string
+	// Tender defaults to card
+	Tender TenderType
+	// Token stands for the payment method, see Tender
+	Token  string
+	Amount Money
+	// CustomerID is the loyalty customer the order is for, store credit can only pay for their own orders
+	CustomerID string
+}
+
+type PaymentAmountRequest struct {
+	// Amount defaults to everything that's left, what was authorized for captures and what was captured for refunds
+	Amount Money
+}
+
+// paymentError is the status code sent back for errors from the provider
+func paymentError(err error) int {
+	switch {
+	case errors.Is(err, ErrPaymentDeclined):
+		return http.StatusPaymentRequired
+	case errors.Is(err, ErrPaymentTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func getPayment(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		paymentLock.Lock()
+		defer paymentLock.Unlock()
+		p, ok := PaymentMap[c.Param("ID")]
+		if !ok || !p.visibleTo(user) {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "payment " + c.Param("ID") + " not found"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+func authorizePayment(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AuthorizePaymentRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Amount.Amount <= 0 || req.Amount.Currency == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "amount must be positive and have a currency"})
+			return
+		}
+		if req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "payment token is required"})
+			return
+		}
+		switch req.Tender {
+		case "":
+			req.Tender = CardTender
+		case CardTender, GiftCardTender, StoreCreditTender:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "tender must be one of card, gift-card or store-credit"})
+			return
+		}
+		if req.Tender == StoreCreditTender && !ownsStoreCredit(req.CustomerID, req.Token) {
+			c.JSON(http.StatusPaymentRequired, gin.H{"code": http.StatusPaymentRequired, "Message": ErrPaymentDeclined.Error() + ", store credit belongs to another customer"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		id := uuid.Must(uuid.NewRandom()).String()
+		ref, err := providerFor(req.Tender).Authorize(req.Token, req.Amount, id)
+		if err != nil {
+			code := paymentError(err)
+			c.JSON(code, gin.H{"code": code, "Message": err.Error()})
+			return
+		}
+		zero := NewMoney(0, req.Amount.Currency)
+		p := &Payment{id, req.OrderID, user.Username, req.Tender, ref, PaymentAuthorized, req.Amount, zero, zero, time.Now()}
+		paymentLock.Lock()
+		PaymentMap[id] = p
+		paymentLock.Unlock()
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// changePayment runs change on a payment the user can see, with paymentLock held
+func changePayment(c *gin.Context, change func(p *Payment, amount Money) (int, error)) {
+	var req PaymentAmountRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	user := c.MustGet("user").(*User)
+	paymentLock.Lock()
+	defer paymentLock.Unlock()
+	p, ok := PaymentMap[c.Param("ID")]
+	if !ok || !p.visibleTo(user) {
+		c.JSON(http.StatusNotFound, gin.H{"Message": "payment " + c.Param("ID") + " not found"})
+		return
+	}
+	if req.Amount.Amount < 0 || (req.Amount.Amount > 0 && req.Amount.Currency != p.Amount.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"Message": "amount must be positive and in " + p.Amount.Currency})
+		return
+	}
+	if code, err := change(p, req.Amount); err != nil {
+		c.JSON(code, gin.H{"code": code, "Message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func capturePayment(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changePayment(c, func(p *Payment, amount Money) (int, error) {
+			if p.Status != PaymentAuthorized {
+				return http.StatusConflict, errors.New("payment " + p.ID + " is " + string(p.Status) + " and cannot be captured")
+			}
+			if amount.Amount == 0 {
+				amount = p.Amount
+			}
+			if amount.Amount > p.Amount.Amount {
+				return http.StatusBadRequest, errors.New("can't capture more than the " + p.Amount.String() + " authorized")
+			}
+			if err := providerFor(p.Tender).Capture(p.ProviderRef, amount); err != nil {
+				return paymentError(err), err
+			}
+			p.Captured = amount
+			p.Status = PaymentCaptured
+			return 0, nil
+		})
+	}
+}
+
+func voidPayment(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changePayment(c, func(p *Payment, amount Money) (int, error) {
+			if p.Status == PaymentVoided {
+				return 0, nil
+			}
+			if p.Status != PaymentAuthorized {
+				return http.StatusConflict, errors.New("payment " + p.ID + " is " + string(p.Status) + " and cannot be voided, refund it instead")
+			}
+			if err := providerFor(p.Tender).Void(p.ProviderRef); err != nil {
+				return paymentError(err), err
+			}
+			p.Status = PaymentVoided
+			return 0, nil
+		})
+	}
+}
+
+// refundPayment gives back some or all of what was captured, it's made safe to retry with an Idempotency-Key
+func refundPayment(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changePayment(c, func(p *Payment, amount Money) (int, error) {
+			if p.Status != PaymentCaptured {
+				return http.StatusConflict, errors.New("payment " + p.ID + " is " + string(p.Status) + " and cannot be refunded")
+			}
+			left := p.Captured.Sub(p.Refunded)
+			if amount.Amount == 0 {
+				amount = left
+			}
+			if amount.Amount > left.Amount {
+				return http.StatusBadRequest, errors.New("can't refund more than the " + left.String() + " left on the payment")
+			}
+			if err := providerFor(p.Tender).Refund(p.ProviderRef, amount); err != nil {
+				return paymentError(err), err
+			}
+			p.Refunded = p.Refunded.Add(amount)
+			if p.Refunded.Amount == p.Captured.Amount {
+				p.Status = PaymentRefunded
+			}
+			return 0, nil
+		})
+	}
+}
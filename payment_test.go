@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOnlyServicesMovePaymentMoney(t *testing.T) {
+	cl := newCluster(t)
+	code, res, _ := cl.buy(t, "", &BuyOrderRequest{
+		Cart:         map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}},
+		PaymentToken: "tok_visa",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %+v", code, res)
+	}
+	p := res.Order.Payments[0]
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	for _, token := range []string{cl.token, manager.Token} {
+		for _, action := range []string{"capture", "void", "refund"} {
+			if code := cl.send(t, "payment", "POST", "/"+p.ID+"/"+action, token, ""); code != http.StatusForbidden {
+				t.Errorf("%s of a payment by %s: status %d", action, LoggedInUsers[token].Username, code)
+			}
+		}
+	}
+	paymentLock.Lock()
+	if p := PaymentMap[p.ID]; p.Status != PaymentCaptured || !p.Refunded.IsZero() {
+		t.Errorf("payment is %s with %s refunded", p.Status, p.Refunded)
+	}
+	paymentLock.Unlock()
+
+	refunded, err := SendRefundPaymentRequest(cl.servers["payment"].URL, "test-service-token", p.ID, p.Captured, "test-refund-"+p.ID)
+	if err != nil || refunded.Status != PaymentRefunded {
+		t.Errorf("service refund: %+v %v", refunded, err)
+	}
+}
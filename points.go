@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PointsTransactionType says what changed a customer's points
+type PointsTransactionType string
+
+const (
+	// OpeningTransaction holds the points customers had when the ledger was started
+	OpeningTransaction PointsTransactionType = "opening"
+	EarnTransaction    PointsTransactionType = "earn"
+	RedeemTransaction  PointsTransactionType = "redeem"
+	// ReversalTransaction takes back points earned by goods that were refunded, or gives back points used on them
+	ReversalTransaction   PointsTransactionType = "reversal"
+	AdjustmentTransaction PointsTransactionType = "adjustment"
+	// MergeTransaction moves the points of a duplicate account to the customer it's merged into
+	MergeTransaction PointsTransactionType = "merge"
+)
+
+// PointsAdjustmentReason explains a manual change to a customer's points
+type PointsAdjustmentReason string
+
+const (
+	GoodwillAdjustment PointsAdjustmentReason = "goodwill"
+	ServiceRecovery    PointsAdjustmentReason = "service-recovery"
+	// MissingPoints are points a customer should have earned but didn't, like an order placed without their card
+	MissingPoints    PointsAdjustmentReason = "missing-points"
+	PointsCorrection PointsAdjustmentReason = "correction"
+)
+
+var pointsAdjustmentReasons = []string{string(GoodwillAdjustment), string(ServiceRecovery), string(MissingPoints), string(PointsCorrection)}
+
+// PointsTransaction is an immutable entry in the points ledger, a customer's points are the sum of their deltas
+type PointsTransaction struct {
+	ID         int
+	CustomerID string
+	Type       PointsTransactionType
+	Delta      int
+	// Balance is the customer's points after the transaction
+	Balance   int
+	OrderID   string                 `json:",omitempty"`
+	Reason    PointsAdjustmentReason `json:",omitempty"`
+	Note      string                 `json:",omitempty"`
+	User      string
+	Timestamp time.Time
+}
+
+// PointsLedger is append only, entries are never changed or removed. It's guarded by customerLock
+var PointsLedger = openingPoints(CustomerMap)
+
+func openingPoints(customers map[string]*Customer) []*PointsTransaction {
+	ids := make([]string, 0, len(customers))
+	for id := range customers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ledger := make([]*PointsTransaction, 0, len(ids))
+	now := time.Now()
+	for _, id := range ids {
+		points := customers[id].Points
+		ledger = append(ledger, &PointsTransaction{len(ledger) + 1, id, OpeningTransaction, points, points, "", "", "", "system", now})
+	}
+	return ledger
+}
+
+// pointsBalance adds up the ledger for a customer. MUST be called with customerLock held
+func pointsBalance(customerID string) int {
+	balance := 0
+	for _, t := range PointsLedger {
+		if t.CustomerID == customerID {
+			balance += t.Delta
+		}
+	}
+	return balance
+}
+
+// postPoints records the transaction in the ledger and updates the customer's points from it.
+// MUST be called with customerLock held
+func postPoints(customer *Customer, t *PointsTransaction) {
+	t.ID = len(PointsLedger) + 1
+	t.CustomerID = customer.ID
+	t.Timestamp = time.Now()
+	PointsLedger = append(PointsLedger, t)
+	customer.Points = pointsBalance(customer.ID)
+	t.Balance = customer.Points
+}
+
+// orderPointsPosted tells whether the customer, or an account merged into them, has earned or used points on the
+// order. MUST be called with customerLock held
+func orderPointsPosted(customer *Customer, orderID string) bool {
+	for _, t := range PointsLedger {
+		if t.OrderID != orderID || (t.Type != EarnTransaction && t.Type != RedeemTransaction) {
+			continue
+		}
+		if owner, _ := resolveCustomer(t.CustomerID); owner == customer {
+			return true
+		}
+	}
+	return false
+}
+
+// postOrderPoints records the points a customer earned and used on an order together, earned first so they can be
+// spent on it. It posts nothing and returns false if the order's points were already posted, so they're never
+// counted twice. MUST be called with customerLock held
+func postOrderPoints(customer *Customer, orderID string, earned, used int, user string) bool {
+	if orderPointsPosted(customer, orderID) {
+		return false
+	}
+	if earned > 0 {
+		postPoints(customer, &PointsTransaction{0, "", EarnTransaction, earned, 0, orderID, "", "", user, time.Time{}})
+	}
+	if used > 0 {
+		postPoints(customer, &PointsTransaction{0, "", RedeemTransaction, -used, 0, orderID, "", "", user, time.Time{}})
+	}
+	return true
+}
+
+// orderPointsLeft returns the points the ledger has the customer earning and using on an order, less what's already
+// been reversed of them. Transactions on accounts merged into the customer count. MUST be called with customerLock held
+func orderPointsLeft(customer *Customer, orderID string) (earned, used int) {
+	for _, t := range PointsLedger {
+		if t.OrderID != orderID {
+			continue
+		}
+		if owner, _ := resolveCustomer(t.CustomerID); owner != customer {
+			continue
+		}
+		switch {
+		case t.Type == EarnTransaction:
+			earned += t.Delta
+		case t.Type == RedeemTransaction:
+			used -= t.Delta
+		// taking back earned points is a negative reversal, giving back used points a positive one
+		case t.Type == ReversalTransaction && t.Delta < 0:
+			earned += t.Delta
+		case t.Type == ReversalTransaction:
+			used -= t.Delta
+		}
+	}
+	return earned, used
+}
+
+// PointsStatement lists a customer's transactions between two times and their balance either side of them
+type PointsStatement struct {
+	CustomerID     string
+	OpeningBalance int
+	ClosingBalance int
+	Transactions   []*PointsTransaction
+}
+
+// getPointsTransactions returns a statement of a customer's points, optionally only between from and to
+func getPointsTransactions(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var from, to time.Time
+		var err error
+		if f := c.Query("from"); f != "" {
+			if from, err = time.Parse(time.RFC3339, f); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "from value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		if t := c.Query("to"); t != "" {
+			if to, err = time.Parse(time.RFC3339, t); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "to value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := resolveCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		statement := &PointsStatement{customer.ID, 0, 0, make([]*PointsTransaction, 0)}
+		for _, t := range PointsLedger {
+			if t.CustomerID != customer.ID {
+				continue
+			}
+			if !from.IsZero() && t.Timestamp.Before(from) {
+				statement.OpeningBalance = t.Balance
+				statement.ClosingBalance = t.Balance
+				continue
+			}
+			if !to.IsZero() && t.Timestamp.After(to) {
+				break
+			}
+			statement.Transactions = append(statement.Transactions, t)
+			statement.ClosingBalance = t.Balance
+		}
+		c.JSON(http.StatusOK, statement)
+	}
+}
+
+type AdjustPointsRequest struct {
+	// Delta is signed, negative to take points off
+	Delta  int
+	Reason PointsAdjustmentReason
+	Note   string
+	// OrderID is the order the adjustment is about, if any
+	OrderID string
+}
+
+// adjustPoints lets a manager give or take points, it can't take a customer's points below 0
+func adjustPoints(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AdjustPointsRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if !StringSliceContains(pointsAdjustmentReasons, string(req.Reason)) {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "reason must be one of [" + strings.Join(pointsAdjustmentReasons, ", ") + "]"})
+			return
+		}
+		if req.Delta == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "delta cannot be 0"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		customerLock.Lock()
+		defer customerLock.Unlock()
+		customer, ok := resolveCustomer(c.Param("cID"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer with id: " + c.Param("cID") + " not found"})
+			return
+		}
+		if customer.Points+req.Delta < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "adjustment would take customer " + customer.ID + " below 0 points"})
+			return
+		}
+		t := &PointsTransaction{0, "", AdjustmentTransaction, req.Delta, 0, req.OrderID, req.Reason, req.Note, user.Username, time.Time{}}
+		postPoints(customer, t)
+		c.JSON(http.StatusOK, t)
+	}
+}
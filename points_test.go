@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useLedger swaps in customers and an empty points ledger for the length of a test
+func useLedger(t *testing.T, customers ...*Customer) {
+	oldCustomers, oldLedger := CustomerMap, PointsLedger
+	CustomerMap = make(map[string]*Customer)
+	for _, c := range customers {
+		CustomerMap[c.ID] = c
+	}
+	PointsLedger = openingPoints(CustomerMap)
+	t.Cleanup(func() {
+		CustomerMap, PointsLedger = oldCustomers, oldLedger
+	})
+}
+
+func TestOrderPointsLeft(t *testing.T) {
+	alice := &Customer{"000001", "Alice Smith", "alice@example.com", "", false, 500, true, "", time.Time{}, false}
+	dup := &Customer{"000002", "Alice S", "", "07700900123", false, 0, false, "000001", time.Time{}, false}
+	useLedger(t, alice, dup)
+	post := func(c *Customer, typ PointsTransactionType, delta int, orderID string) {
+		postPoints(c, &PointsTransaction{0, "", typ, delta, 0, orderID, "", "", "test", time.Time{}})
+	}
+	post(alice, EarnTransaction, 120, "A")
+	post(alice, RedeemTransaction, -300, "A")
+	// earned on the duplicate card before it was merged
+	post(dup, EarnTransaction, 40, "B")
+	post(alice, EarnTransaction, 10, "C")
+	post(alice, ReversalTransaction, -50, "A")
+	post(alice, ReversalTransaction, 100, "A")
+	post(alice, AdjustmentTransaction, 25, "A")
+
+	tests := []struct {
+		order        string
+		earned, used int
+	}{
+		{"A", 70, 200},
+		{"B", 40, 0},
+		{"C", 10, 0},
+		{"unknown", 0, 0},
+	}
+	for _, tt := range tests {
+		if earned, used := orderPointsLeft(alice, tt.order); earned != tt.earned || used != tt.used {
+			t.Errorf("order %s: %d earned and %d used left, want %d and %d", tt.order, earned, used, tt.earned, tt.used)
+		}
+	}
+	if alice.Points != 500+120-300+10-50+100+25 || alice.Points != pointsBalance(alice.ID) {
+		t.Errorf("alice has %d points, ledger says %d", alice.Points, pointsBalance(alice.ID))
+	}
+}
+
+func TestPostOrderPoints(t *testing.T) {
+	alice := &Customer{"000001", "Alice Smith", "alice@example.com", "", false, 50, true, "", time.Time{}, false}
+	dup := &Customer{"000002", "Alice S", "", "07700900123", false, 0, false, "000001", time.Time{}, false}
+	useLedger(t, alice, dup)
+	// earned on the duplicate card before it was merged
+	postPoints(dup, &PointsTransaction{0, "", EarnTransaction, 5, 0, "E", "", "", "test", time.Time{}})
+	tests := []struct {
+		order        string
+		earned, used int
+		posted       bool
+		points       int
+	}{
+		// earned points are posted first, so they can pay for the same order
+		{"A", 30, 80, true, 5},
+		{"A", 30, 80, false, 5},
+		{"B", 0, 0, true, 5},
+		{"C", 25, 0, true, 30},
+		{"E", 5, 0, false, 30},
+	}
+	for i, tt := range tests {
+		if posted := postOrderPoints(alice, tt.order, tt.earned, tt.used, "test"); posted != tt.posted {
+			t.Errorf("%d: order %s posted %v, want %v", i, tt.order, posted, tt.posted)
+		}
+		if points := alice.Points + dup.Points; points != tt.points {
+			t.Errorf("%d: %d points after order %s, want %d", i, points, tt.order, tt.points)
+		}
+	}
+	if earned, used := orderPointsLeft(alice, "A"); earned != 30 || used != 80 {
+		t.Errorf("order A earned %d and used %d", earned, used)
+	}
+	for _, tr := range PointsLedger {
+		if tr.Balance < 0 {
+			t.Errorf("transaction %d left %s with %d points", tr.ID, tr.CustomerID, tr.Balance)
+		}
+	}
+}
+
+func TestUpdatePointsSpendsPointsEarnedOnTheOrder(t *testing.T) {
+	cl := newCluster(t)
+	useLedger(t, &Customer{"000001", "Alice Smith", "alice@example.com", "", false, 10, true, "", time.Time{}, false})
+	// 45.50 of 0001 earns 91 points at double points
+	cart := `"Cart": {"0001": {"ID": "0001", "Quantity": 1}}`
+	tests := []struct {
+		order string
+		use   int
+		want  int
+	}{
+		{"A", 102, http.StatusBadRequest},
+		{"A", 101, http.StatusOK},
+		// the order's points are only saved once, even without the Idempotency-Key
+		{"A", 0, http.StatusConflict},
+		{"", 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := `{"CustomerID": "000001", "OrderID": "` + tt.order + `", "ApplyDiscountPoints": ` + strconv.Itoa(tt.use) + `, ` + cart + `}`
+		if code := cl.send(t, "loyalty", "POST", "/update-points", cl.token, body); code != tt.want {
+			t.Errorf("order %q using %d: status %d, want %d", tt.order, tt.use, code, tt.want)
+		}
+	}
+	customerLock.Lock()
+	defer customerLock.Unlock()
+	if points := CustomerMap["000001"].Points; points != 0 {
+		t.Errorf("%d points left, want 0", points)
+	}
+}
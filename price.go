@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,28 +16,59 @@ func PriceRoutes(s *Server) {
 	private.Use(HydrateUserMiddleware(s))
 	private.GET("/", getProducts(s))
 	private.POST("/calculate", calculateCart(s))
+	private.POST("/coupons/redeem", RequiresPermissionMiddleware(ServiceRole), redeemCoupons(s))
+	private.POST("/coupons/release", RequiresPermissionMiddleware(ServiceRole), releaseCoupons(s))
+	private.GET("/rates", getRates(s))
+	private.GET("/tax-rates", getTaxRates(s))
+	private.GET("/:ID/history", getPriceHistory(s))
+	private.GET("/delivery", getDeliveryZones(s))
 
 	manager := s.router.Group("/manager")
 	manager.Use(HydrateUserMiddleware(s))
 	manager.Use(RequiresPermissionMiddleware(ManagerRole))
 	manager.PUT("/set-price/:ID", setPrice(s))
+	manager.DELETE("/set-price/:ID/:version", cancelPriceChange(s))
+	manager.GET("/coupons", getCoupons(s))
+	manager.POST("/coupons", createCoupon(s))
+	manager.DELETE("/coupons/:code", deleteCoupon(s))
+	manager.PUT("/rates/:currency", setRate(s))
+	manager.DELETE("/rates/:currency", deleteRate(s))
+	manager.POST("/tax-rates", addTaxRate(s))
+	manager.PUT("/set-tax-class/:ID", setTaxClass(s))
+	manager.PUT("/delivery/zones/:ID", setDeliveryZone(s))
+	manager.PUT("/delivery/rates", setShippingRates(s))
 }
 
 var ProductMap = map[string]*Product{
-	"0001": &Product{"0001", "Gadget", 45.50},
-	"0002": &Product{"0002", "Widget 1.0", 5.45},
-	"0003": &Product{"0003", "Widget 2.0", 7.45},
-	"9999": &Product{"9999", "Delivery", 5.0},
+	"0001": &Product{"0001", "Gadget", NewMoney(4550, BaseCurrency), map[string]Money{"EUR": NewMoney(4999, "EUR")}, StandardTax, 1200},
+	"0002": &Product{"0002", "Widget 1.0", NewMoney(545, BaseCurrency), nil, StandardTax, 250},
+	"0003": &Product{"0003", "Widget 2.0", NewMoney(745, BaseCurrency), nil, ReducedTax, 300},
 }
 
-var DiscountList = []Discount{
-	&PercentDiscount{"0001", 20.0},
-	&AnyXForY{[]string{"0002", "0003"}, 3, 2},
+var DiscountList = []*Promotion{
+	&Promotion{"PROMO-0001", &PercentDiscount{"0001", 20.0}},
+	&Promotion{"PROMO-0002", &AnyXForY{[]string{"0002", "0003"}, 3, 2}},
 }
 
 func getProducts(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, ProductMap)
+		// without a currency the prices in BaseCurrency are returned, with their overrides
+		currency := NormaliseCurrency(c.Query("currency"))
+		// at allows looking up the prices that were charged at some point in time
+		at := time.Now()
+		if atStr := c.Query("at"); atStr != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, atStr); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "at value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		products, err := ProductsAt(ProductMap, currency, at)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, products)
 	}
 }
 
@@ -41,60 +76,282 @@ func setPrice(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var err error
 		var priceStr string
-		var price float64
+		var price Money
 		id := c.Param("ID")
 		if priceStr = c.PostForm("price"); priceStr == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "price field missing"})
 			return
 		}
-		price, err = strconv.ParseFloat(priceStr, 64)
-		if err != nil || price < 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "price value must be a decimal number and bigger than 0"})
-			return
-		}
 		product, ok := ProductMap[id]
 		if !ok {
 			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "product with ID " + id + " not found"})
 			return
 		}
-		product.Price = price
+		// a currency other than the product's own sets an override for that currency
+		currency := product.Price.Currency
+		if cStr := c.PostForm("currency"); cStr != "" {
+			currency = NormaliseCurrency(cStr)
+		}
+		price, err = ParseMoney(priceStr, currency)
+		if err != nil || price.Amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "price value must be a decimal number with at most 2 decimal places and bigger than 0"})
+			return
+		}
+		// from schedules the change for later, until makes it a temporary sale price
+		now := time.Now()
+		from, ok := parseTimeField(c, "from", now)
+		if !ok {
+			return
+		}
+		until, ok := parseTimeField(c, "until", time.Time{})
+		if !ok {
+			return
+		}
+		if from.Before(now.Add(-time.Minute)) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "price changes cannot be backdated"})
+			return
+		}
+		if !until.IsZero() && !until.After(from) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "until must be after from"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		priceLock.Lock()
+		defer priceLock.Unlock()
+		// the old price is whatever would have been charged just before the change takes effect
+		old, _ := listPriceAt(product, currency, from.Add(-time.Nanosecond))
+		change := &PriceChange{len(PriceHistory[id]) + 1, id, currency, old, price, user.Username, now, from, until, false}
+		PriceHistory[id] = append(PriceHistory[id], change)
 
-		c.JSON(http.StatusOK, product)
+		c.JSON(http.StatusOK, change)
 	}
 }
 
+type CalculateCartRequest struct {
+	Cart        map[string]*ProductOrder
+	CustomerID  string
+	CouponCodes []string
+	// Currency to price the cart in, defaults to BaseCurrency
+	Currency string
+	// At is the time to take prices from, so a quote can be reproduced. Defaults to now
+	At time.Time
+	// Detailed asks for Lines to be filled in the response
+	Detailed bool
+	// Delivery asks for delivery to be quoted, it's left out for orders taken in the shop
+	Delivery *DeliveryRequest
+}
+
+// calculateCartFields are the fields of CalculateCartRequest in lower case, json matches them in any case
+var calculateCartFields = []string{"cart", "customerid", "couponcodes", "currency", "at", "detailed", "delivery"}
+
+// UnmarshalJSON also takes the bare cart that used to be the whole request, it's an object without any of the
+// request's fields
+func (r *CalculateCartRequest) UnmarshalJSON(b []byte) error {
+	type request CalculateCartRequest
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for name := range fields {
+		if StringSliceContains(calculateCartFields, strings.ToLower(name)) {
+			return json.Unmarshal(b, (*request)(r))
+		}
+	}
+	var cart map[string]*ProductOrder
+	if err := json.Unmarshal(b, &cart); err != nil {
+		return err
+	}
+	*r = CalculateCartRequest{Cart: cart}
+	return nil
+}
+
+// LineDiscountAmount is the part of a promotion taken off a single line
+type LineDiscountAmount struct {
+	PromotionID string
+	Reason      string
+	Amount      Money
+}
+
+// PricedLine explains how a single line of the cart was priced
+type PricedLine struct {
+	ProductID string
+	Name      string
+	UnitPrice Money
+	Quantity  int
+	LineTotal Money
+	Discounts []*LineDiscountAmount
+	// Payable is LineTotal minus Discounts, tax is on top of it when prices exclude tax
+	Payable Money
+	// TaxRate is the rate the line was taxed at, refunds give tax back at it
+	TaxRate float64
+}
+
 type CartValueResponse struct {
-	Total           float64
-	Discount        float64
+	Total           Money
+	Discount        Money
 	DiscountReasons []string
+	// Coupons holds the normalised codes that were applied to the cart
+	Coupons []string
+	// RejectedCoupons maps each code that couldn't be applied to the reason it was rejected
+	RejectedCoupons map[string]string `json:",omitempty"`
+	Currency        string
+	// ExchangeRate is the rate used to get BaseTotal and BaseDiscount from Total and Discount
+	ExchangeRate float64
+	BaseTotal    Money
+	BaseDiscount Money
+	Tax          *TaxBreakdown
+	// PricedAt is the time the prices were taken from
+	PricedAt time.Time
+	// Lines is only filled in when the request asked for a detailed response
+	Lines []*PricedLine `json:",omitempty"`
+	// Delivery is quoted separately from the products, it's included in Tax and Payable
+	Delivery *DeliveryQuote `json:",omitempty"`
+	// Payable is what's left to pay after discounts and with tax
+	Payable Money
+}
+
+// CartSubtotal returns the value of the cart before any discounts, products must be priced in currency
+func CartSubtotal(cart map[string]*ProductOrder, products map[string]*Product, currency string) (Money, error) {
+	total := NewMoney(0, currency)
+	for _, p := range cart {
+		// get product in map
+		prod, ok := products[p.ID]
+		if !ok {
+			return Money{}, errors.New("product with ID " + p.ID + " not found")
+		}
+		// add price to total if it exists
+		total = total.Add(prod.Price.Mul(p.Quantity))
+	}
+	return total, nil
 }
 
 func calculateCart(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var cart map[string]*ProductOrder
-		c.BindJSON(&cart)
-		res := CartValueResponse{0, 0, make([]string, 0)}
+		var req CalculateCartRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		currency := NormaliseCurrency(req.Currency)
+		rate, err := RateFor(currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		at := req.At
+		if at.IsZero() {
+			at = time.Now()
+		}
+		products, err := ProductsAt(ProductMap, currency, at)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		res := CartValueResponse{NewMoney(0, currency), NewMoney(0, currency), make([]string, 0), make([]string, 0), nil, currency, 1, NewMoney(0, BaseCurrency), NewMoney(0, BaseCurrency), nil, at, nil, nil, NewMoney(0, currency)}
+		res.ExchangeRate, _ = rate.Float64()
 		// calculate total
-		for _, p := range cart {
-			// get product in map
-			prod, ok := ProductMap[p.ID]
-			if !ok {
-				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "product with ID " + p.ID + " not found"})
-				return
-			}
-			// add price to total if it exists
-			res.Total += prod.Price * float64(p.Quantity)
-
+		total, err := CartSubtotal(req.Cart, products, currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
 		}
+		res.Total = total
+		applied := make([]*AppliedDiscount, 0)
 		// apply any discounts
-		for _, d := range DiscountList {
+		for _, p := range DiscountList {
 			// apply discounts to cart
-			discount, reason := d.Discount(cart, ProductMap)
-			if discount != 0.0 && reason != "" {
-				res.Discount += discount
-				res.DiscountReasons = append(res.DiscountReasons, reason)
+			discount, reason := p.Discount.Discount(req.Cart, products)
+			if !discount.IsZero() && reason != "" {
+				applied = append(applied, &AppliedDiscount{p.ID, p.Discount, discount, reason})
 			}
 		}
+		// apply coupons after promotions, these are only validated here, at the time the cart is priced at so it can be
+		// priced again the same. Redemption happens once the order goes through
+		if len(req.CouponCodes) > 0 {
+			couponLock.Lock()
+			codes, discounts, rejected := ApplyCoupons(req.CouponCodes, req.CustomerID, req.Cart, products, total, rate, at)
+			couponLock.Unlock()
+			res.Coupons = codes
+			applied = append(applied, discounts...)
+			if len(rejected) > 0 {
+				res.RejectedCoupons = rejected
+			}
+		}
+		// tax comes last, once every discount has been spread over the lines it came from. Discounts are cut down
+		// to what's left of their lines, so they never take a line below zero
+		lines, shares, err := ApportionDiscounts(req.Cart, products, applied)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
+		for _, d := range applied {
+			if !d.Amount.IsZero() {
+				res.Discount = res.Discount.Add(d.Amount)
+				res.DiscountReasons = append(res.DiscountReasons, d.Reason)
+				continue
+			}
+			// a coupon with nothing left to take off isn't used up
+			if code := strings.TrimPrefix(d.PromotionID, "COUPON-"); code != d.PromotionID {
+				res.Coupons = StringSliceRemove(res.Coupons, code)
+				if res.RejectedCoupons == nil {
+					res.RejectedCoupons = make(map[string]string)
+				}
+				res.RejectedCoupons[code] = "other discounts already take everything the coupon applies to"
+			}
+		}
+		classes := make(map[string]TaxClass)
+		for id, p := range products {
+			classes[id] = p.TaxClass
+		}
+		// delivery is worked out on the value after discounts, and isn't discounted itself
+		if req.Delivery != nil {
+			value := res.Total.Sub(res.Discount).ToBase(rate)
+			quote, err := QuoteDelivery(req.Delivery, CartWeight(req.Cart, products), value)
+			if err != nil {
+				quote.Error = err.Error()
+			}
+			quote.Price = quote.Price.Convert(rate, currency)
+			res.Delivery = quote
+			lines[DeliveryLineID] = quote.Price
+			classes[DeliveryLineID] = DeliveryTaxClass
+		}
+		res.Tax, err = CalculateTax(lines, classes, at, PricingTaxMode, currency)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "Message": err.Error()})
+			return
+		}
+		res.Payable = res.Tax.Gross
+		if req.Detailed {
+			res.Lines = PricedLines(req.Cart, products, applied, lines, shares, at)
+		}
+		res.BaseTotal = res.Total.ToBase(rate)
+		res.BaseDiscount = res.Discount.ToBase(rate)
+		if err := CheckMoney(res.Total, res.Discount, res.Tax.Net, res.Tax.Tax, res.Payable, res.BaseTotal, res.BaseDiscount); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, res)
 	}
 }
+
+// PricedLines builds the explanation of each line of the cart, ordered by product ID
+func PricedLines(cart map[string]*ProductOrder, products map[string]*Product, applied []*AppliedDiscount, lines map[string]Money, shares []map[string]Money, at time.Time) []*PricedLine {
+	orders := make([]*ProductOrder, 0, len(cart))
+	for _, p := range cart {
+		orders = append(orders, p)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	res := make([]*PricedLine, 0, len(orders))
+	for _, p := range orders {
+		prod := products[p.ID]
+		// a missing rate has already failed CalculateTax
+		rate, _ := TaxRateOn(prod.TaxClass, at)
+		line := &PricedLine{p.ID, prod.Name, prod.Price, p.Quantity, prod.Price.Mul(p.Quantity), make([]*LineDiscountAmount, 0), lines[p.ID], rate}
+		for i, d := range applied {
+			if part, ok := shares[i][p.ID]; ok && !part.IsZero() {
+				line.Discounts = append(line.Discounts, &LineDiscountAmount{d.PromotionID, d.Reason, part})
+			}
+		}
+		res = append(res, line)
+	}
+	return res
+}
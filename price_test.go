@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newPriceServer serves calculateCart the way the price service does, without the auth in front of it
+func newPriceServer(t *testing.T) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	s := &Server{gin.New(), "price", &Config{}}
+	s.router.POST("/calculate", calculateCart(s))
+	ts := httptest.NewServer(s.router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestCalculateCartCurrencies(t *testing.T) {
+	ts := newPriceServer(t)
+	// 0001 has a EUR list price, 0002 is converted at the exchange rate. 0001 is 20% off
+	cart := map[string]*ProductOrder{"0001": &ProductOrder{"0001", 1}, "0002": &ProductOrder{"0002", 2}}
+	tests := []struct {
+		currency string
+		total    int64
+		discount int64
+	}{
+		{"", 4550 + 2*545, 910},
+		{"GBP", 4550 + 2*545, 910},
+		// 5.45 x 1.17 = 6.3765
+		{"EUR", 4999 + 2*638, 1000},
+		// 45.50 x 1.27 = 57.785 and 5.45 x 1.27 = 6.9215
+		{"usd", 5779 + 2*692, 1156},
+	}
+	for _, tt := range tests {
+		res, err := SendCalculateCartRequest(ts.URL, "", &CalculateCartRequest{cart, "", nil, tt.currency, time.Time{}, true, nil})
+		if err != nil {
+			t.Errorf("%q: %v", tt.currency, err)
+			continue
+		}
+		currency := NormaliseCurrency(tt.currency)
+		if res.Currency != currency {
+			t.Errorf("%q: priced in %s", tt.currency, res.Currency)
+		}
+		if res.Total != NewMoney(tt.total, currency) || res.Discount != NewMoney(tt.discount, currency) {
+			t.Errorf("%q: total %+v discount %+v, want %d and %d %s", tt.currency, res.Total, res.Discount, tt.total, tt.discount, currency)
+		}
+		if res.Payable != NewMoney(tt.total-tt.discount, currency) || res.Tax.Gross != res.Payable {
+			t.Errorf("%q: payable %+v with tax %+v, want %d %s", tt.currency, res.Payable, res.Tax, tt.total-tt.discount, currency)
+		}
+		lines := NewMoney(0, currency)
+		for _, l := range res.Lines {
+			lines = lines.Add(l.Payable)
+		}
+		if lines != res.Payable {
+			t.Errorf("%q: lines add up to %+v, not %+v", tt.currency, lines, res.Payable)
+		}
+		if res.BaseTotal.Currency != BaseCurrency {
+			t.Errorf("%q: base total in %s", tt.currency, res.BaseTotal.Currency)
+		}
+	}
+}
+
+func TestCalculateCartUnknownCurrency(t *testing.T) {
+	ts := newPriceServer(t)
+	cart := map[string]*ProductOrder{"0002": &ProductOrder{"0002", 1}}
+	if _, err := SendCalculateCartRequest(ts.URL, "", &CalculateCartRequest{cart, "", nil, "CHF", time.Time{}, false, nil}); err == nil {
+		t.Error("cart priced in a currency without an exchange rate")
+	}
+}
+
+func TestCalculateCartStacksCouponsOnPromotions(t *testing.T) {
+	ts := newPriceServer(t)
+	couponLock.Lock()
+	CouponMap["ALLFREE"] = &Coupon{"ALLFREE", DiscountSpec{Type: "percent", ProductID: "0001", Percentage: 100}, 0, 0, time.Time{}, Money{}, 0, map[string]int{}}
+	CouponMap["TENOFF"] = &Coupon{"TENOFF", DiscountSpec{Type: "percent", ProductID: "0001", Percentage: 10}, 0, 0, time.Time{}, Money{}, 0, map[string]int{}}
+	couponLock.Unlock()
+	t.Cleanup(func() {
+		couponLock.Lock()
+		delete(CouponMap, "ALLFREE")
+		delete(CouponMap, "TENOFF")
+		couponLock.Unlock()
+	})
+	cart := map[string]*ProductOrder{"0001": &ProductOrder{"0001", 1}, "0002": &ProductOrder{"0002", 1}}
+	res, err := SendCalculateCartRequest(ts.URL, "", &CalculateCartRequest{cart, "", []string{"allfree", "tenoff"}, "", time.Time{}, true, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0001 is 20% off and the coupon takes the rest of it, 0002 is still paid for
+	if res.Discount != gbp(4550) || res.Payable != gbp(545) || res.Tax.Gross != res.Payable || res.Tax.Tax.Amount < 0 {
+		t.Errorf("discount %s payable %s tax %+v, want 45.50 off and 5.45 to pay", res.Discount, res.Payable, res.Tax)
+	}
+	for _, l := range res.Lines {
+		if l.Payable.Amount < 0 {
+			t.Errorf("line %s left at %s", l.ProductID, l.Payable)
+		}
+	}
+	// the second coupon has nothing left to take, so it isn't used up
+	if len(res.Coupons) != 1 || res.Coupons[0] != "ALLFREE" || res.RejectedCoupons["TENOFF"] == "" {
+		t.Errorf("coupons %v rejected %v", res.Coupons, res.RejectedCoupons)
+	}
+}
+
+func TestCalculateCartRequestBodies(t *testing.T) {
+	ts := newPriceServer(t)
+	tests := []struct {
+		name  string
+		body  string
+		want  int
+		total int64
+	}{
+		{"request", `{"Cart": {"0002": {"ID": "0002", "Quantity": 2}}, "Currency": "GBP"}`, http.StatusOK, 1090},
+		{"fields in any case", `{"cart": {"0002": {"ID": "0002", "Quantity": 1}}}`, http.StatusOK, 545},
+		{"bare cart", `{"0002": {"ID": "0002", "Quantity": 3}}`, http.StatusOK, 1635},
+		{"not json", `{"Cart": `, http.StatusBadRequest, 0},
+		{"not a cart", `{"0002": 3}`, http.StatusBadRequest, 0},
+		{"list", `[{"ID": "0002", "Quantity": 1}]`, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		response, err := http.Post(ts.URL+"/calculate", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res CartValueResponse
+		json.NewDecoder(response.Body).Decode(&res)
+		response.Body.Close()
+		if response.StatusCode != tt.want || (tt.want == http.StatusOK && res.Total != gbp(tt.total)) {
+			t.Errorf("%s: status %d total %+v, want %d and %d", tt.name, response.StatusCode, res.Total, tt.want, tt.total)
+		}
+	}
+}
+
+func TestCalculateCartChecksCouponsAtPricingTime(t *testing.T) {
+	ts := newPriceServer(t)
+	expires := time.Now().Add(-time.Hour)
+	couponLock.Lock()
+	CouponMap["GONE"] = &Coupon{"GONE", DiscountSpec{Type: "percent", ProductID: "0002", Percentage: 50}, 0, 0, expires, Money{}, 0, map[string]int{}}
+	couponLock.Unlock()
+	t.Cleanup(func() {
+		couponLock.Lock()
+		delete(CouponMap, "GONE")
+		couponLock.Unlock()
+	})
+	cart := map[string]*ProductOrder{"0002": &ProductOrder{"0002", 2}}
+	tests := []struct {
+		at      time.Time
+		coupons int
+	}{
+		{expires.Add(-time.Minute), 1},
+		{time.Time{}, 0},
+	}
+	for _, tt := range tests {
+		res, err := SendCalculateCartRequest(ts.URL, "", &CalculateCartRequest{cart, "", []string{"gone"}, "", tt.at, false, nil})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Coupons) != tt.coupons {
+			t.Errorf("priced at %v: coupons %v rejected %v", tt.at, res.Coupons, res.RejectedCoupons)
+		}
+	}
+}
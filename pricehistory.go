@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PriceChange is a versioned entry in the price history of a product
+type PriceChange struct {
+	Version   int
+	ProductID string
+	Currency  string
+	OldPrice  Money
+	NewPrice  Money
+	ChangedBy string
+	ChangedAt time.Time
+	// EffectiveFrom is when the new price starts being charged, it can be in the future to schedule a change
+	EffectiveFrom time.Time
+	// EffectiveUntil ends a temporary sale price, after which the previous price applies again.
+	// The zero value makes the change permanent
+	EffectiveUntil time.Time
+	Cancelled      bool
+}
+
+// PriceHistory holds every price change by product ID, entries are never removed only cancelled.
+// Product.Price and Product.Prices are the prices before any change in the history
+var PriceHistory = make(map[string][]*PriceChange)
+
+// priceLock guards PriceHistory
+var priceLock sync.RWMutex
+
+// listPriceAt returns the price set for the product in currency at the given time, ok is false if the product
+// has no price of its own in that currency. Sale prices win over permanent ones. MUST be called with priceLock held
+func listPriceAt(p *Product, currency string, at time.Time) (Money, bool) {
+	var perm, sale *PriceChange
+	for _, ch := range PriceHistory[p.ID] {
+		if ch.Cancelled || ch.Currency != currency || ch.EffectiveFrom.After(at) {
+			continue
+		}
+		if !ch.EffectiveUntil.IsZero() {
+			if at.Before(ch.EffectiveUntil) && (sale == nil || ch.Version > sale.Version) {
+				sale = ch
+			}
+			continue
+		}
+		if perm == nil || ch.EffectiveFrom.After(perm.EffectiveFrom) || (ch.EffectiveFrom.Equal(perm.EffectiveFrom) && ch.Version > perm.Version) {
+			perm = ch
+		}
+	}
+	switch {
+	case sale != nil:
+		return sale.NewPrice, true
+	case perm != nil:
+		return perm.NewPrice, true
+	case currency == p.Price.Currency:
+		return p.Price, true
+	}
+	price, ok := p.Prices[currency]
+	return price, ok
+}
+
+// overridesAt returns the per-currency overrides of the product at the given time. MUST be called with priceLock held
+func overridesAt(p *Product, at time.Time) map[string]Money {
+	currencies := make([]string, 0)
+	for currency := range p.Prices {
+		currencies = append(currencies, currency)
+	}
+	for _, ch := range PriceHistory[p.ID] {
+		if ch.Currency != p.Price.Currency && !StringSliceContains(currencies, ch.Currency) {
+			currencies = append(currencies, ch.Currency)
+		}
+	}
+	overrides := make(map[string]Money)
+	for _, currency := range currencies {
+		if price, ok := listPriceAt(p, currency, at); ok {
+			overrides[currency] = price
+		}
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+	return overrides
+}
+
+// parseTimeField reads an optional RFC3339 time from a form field, returning def if it's empty
+func parseTimeField(c *gin.Context, field string, def time.Time) (time.Time, bool) {
+	v := c.PostForm(field)
+	if v == "" {
+		return def, true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": field + " value must be a time in RFC3339 format"})
+		return t, false
+	}
+	return t, true
+}
+
+func getPriceHistory(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("ID")
+		if _, ok := ProductMap[id]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "Message": "product with ID " + id + " not found"})
+			return
+		}
+		priceLock.RLock()
+		defer priceLock.RUnlock()
+		history := PriceHistory[id]
+		if history == nil {
+			history = make([]*PriceChange, 0)
+		}
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// cancelPriceChange cancels a scheduled price change, changes that already took effect are history and can't be
+func cancelPriceChange(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("ID")
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "version must be a number"})
+			return
+		}
+		priceLock.Lock()
+		defer priceLock.Unlock()
+		history := PriceHistory[id]
+		if version < 1 || version > len(history) {
+			c.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "Message": "price change " + c.Param("version") + " for product with ID " + id + " not found"})
+			return
+		}
+		ch := history[version-1]
+		if ch.Cancelled || !ch.EffectiveFrom.After(time.Now()) {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": "only scheduled price changes can be cancelled"})
+			return
+		}
+		ch.Cancelled = true
+		c.JSON(http.StatusOK, ch)
+	}
+}
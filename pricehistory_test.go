@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListPriceAt(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	p := &Product{ID: "HIST", Price: gbp(1000), Prices: map[string]Money{"EUR": NewMoney(1200, "EUR")}}
+	change := func(version int, currency string, price int64, from, until time.Duration, cancelled bool) *PriceChange {
+		ch := &PriceChange{version, p.ID, currency, Money{}, NewMoney(price, currency), "antero", t0, t0.Add(from), time.Time{}, cancelled}
+		if until != 0 {
+			ch.EffectiveUntil = t0.Add(until)
+		}
+		return ch
+	}
+	priceLock.Lock()
+	PriceHistory[p.ID] = []*PriceChange{
+		change(1, "GBP", 900, 0, 0, false),
+		// scheduled, and replaced by a later version taking effect at the same time
+		change(2, "GBP", 800, 2*time.Hour, 0, false),
+		change(8, "GBP", 850, 2*time.Hour, 0, false),
+		// overlapping sales, the later version wins while both run
+		change(3, "GBP", 500, time.Hour, 3*time.Hour, false),
+		change(4, "GBP", 450, time.Hour, 2*time.Hour, false),
+		change(5, "GBP", 700, 4*time.Hour, 0, true),
+		change(6, "EUR", 1100, 2*time.Hour, 0, false),
+	}
+	priceLock.Unlock()
+	t.Cleanup(func() {
+		priceLock.Lock()
+		delete(PriceHistory, p.ID)
+		priceLock.Unlock()
+	})
+
+	tests := []struct {
+		name     string
+		currency string
+		at       time.Duration
+		want     Money
+		wantOK   bool
+	}{
+		{"before any change", "GBP", -time.Minute, gbp(1000), true},
+		{"permanent change", "GBP", 30 * time.Minute, gbp(900), true},
+		{"latest sale while both run", "GBP", 90 * time.Minute, gbp(450), true},
+		{"sale over the scheduled price", "GBP", 150 * time.Minute, gbp(500), true},
+		{"sale ended", "GBP", 3 * time.Hour, gbp(850), true},
+		{"cancelled change ignored", "GBP", 5 * time.Hour, gbp(850), true},
+		{"override before its change", "EUR", time.Hour, NewMoney(1200, "EUR"), true},
+		{"override changed", "EUR", 3 * time.Hour, NewMoney(1100, "EUR"), true},
+		{"no price of its own", "USD", 3 * time.Hour, Money{}, false},
+	}
+	priceLock.RLock()
+	defer priceLock.RUnlock()
+	for _, tt := range tests {
+		got, ok := listPriceAt(p, tt.currency, t0.Add(tt.at))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if got := overridesAt(p, t0.Add(3*time.Hour)); len(got) != 1 || got["EUR"] != NewMoney(1100, "EUR") {
+		t.Errorf("overrides are %v, want only the changed EUR price", got)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Supplier struct {
+	ID    string
+	Name  string
+	Email string
+	// LeadTimeDays is how long the supplier usually takes to deliver
+	LeadTimeDays int
+}
+
+// ReorderSetting says how a product is restocked at a location
+type ReorderSetting struct {
+	Product  string
+	Location string
+	Supplier string
+	// LeadTimeDays overrides the supplier's lead time when bigger than 0
+	LeadTimeDays int
+	// ReorderQuantity is the smallest quantity ordered at a time
+	ReorderQuantity int
+	// Min is the stock level that always triggers a reorder, Max caps what's held after ordering (0 means no cap)
+	Min int
+	Max int
+}
+
+var SupplierMap = map[string]*Supplier{
+	"ACME": &Supplier{"ACME", "Acme Gadgets Ltd", "orders@acme.example", 7},
+	"WIDG": &Supplier{"WIDG", "Widgets Wholesale", "sales@widgets.example", 3},
+}
+
+// ReorderMap is keyed by location/product
+var ReorderMap = map[string]*ReorderSetting{
+	"WH1/0001": &ReorderSetting{"0001", "WH1", "ACME", 0, 5, 2, 20},
+	"WH1/0002": &ReorderSetting{"0002", "WH1", "WIDG", 0, 50, 20, 200},
+	"WH1/0003": &ReorderSetting{"0003", "WH1", "WIDG", 0, 50, 20, 200},
+}
+
+// velocityDays is how far back sales are looked at to work out how fast a product sells
+const velocityDays = 28
+
+// PurchaseOrderStatus is where a purchase order is at, orders go draft -> approved -> sent -> received
+type PurchaseOrderStatus string
+
+const (
+	PODraft     PurchaseOrderStatus = "draft"
+	POApproved  PurchaseOrderStatus = "approved"
+	POSent      PurchaseOrderStatus = "sent"
+	POReceived  PurchaseOrderStatus = "received"
+	POCancelled PurchaseOrderStatus = "cancelled"
+)
+
+type PurchaseOrderLine struct {
+	Product  string
+	Quantity int
+	Received int
+	// Reason explains why the line was suggested
+	Reason string `json:",omitempty"`
+}
+
+type PurchaseOrder struct {
+	ID       string
+	Supplier string
+	Location string
+	Status   PurchaseOrderStatus
+	Lines    []*PurchaseOrderLine
+	// History records who moved the order to each status and when
+	History []*POStatusChange
+}
+
+type POStatusChange struct {
+	Status    PurchaseOrderStatus
+	User      string
+	Timestamp time.Time
+}
+
+// PurchaseOrderMap is guarded by inventoryLock
+var PurchaseOrderMap = make(map[string]*PurchaseOrder)
+
+var poSeq = 0
+
+// onOrder returns how many units of the product are on open purchase orders for the location. MUST be called with inventoryLock held
+func onOrder(location, product string) int {
+	qty := 0
+	for _, po := range PurchaseOrderMap {
+		if po.Location != location || po.Status == POReceived || po.Status == POCancelled {
+			continue
+		}
+		for _, l := range po.Lines {
+			if l.Product == product {
+				qty += l.Quantity - l.Received
+			}
+		}
+	}
+	return qty
+}
+
+// salesVelocity returns the average units sold per day over the last velocityDays. MUST be called with inventoryLock held
+func salesVelocity(location, product string, now time.Time) float64 {
+	since := now.AddDate(0, 0, -velocityDays)
+	sold := 0
+	for _, m := range StockLedger {
+		if m.Type == SaleMovement && m.Location == location && m.Product == product && m.Timestamp.After(since) {
+			sold -= m.Delta
+		}
+	}
+	return float64(sold) / velocityDays
+}
+
+// GenerateReorders drafts purchase orders, one per supplier and location, for every product whose stock plus what's
+// on order won't last the supplier's lead time at the current rate of sales. MUST be called with inventoryLock held
+func GenerateReorders(user string, now time.Time) []*PurchaseOrder {
+	keys := make([]string, 0, len(ReorderMap))
+	for k := range ReorderMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	drafts := make(map[string]*PurchaseOrder)
+	created := make([]*PurchaseOrder, 0)
+	for _, k := range keys {
+		r := ReorderMap[k]
+		supplier, ok := SupplierMap[r.Supplier]
+		if !ok {
+			continue
+		}
+		quantity := 0
+		if inv, ok := StockAt(r.Location, r.Product); ok {
+			quantity = inv.Quantity
+		}
+		position := quantity + onOrder(r.Location, r.Product)
+		leadTime := supplier.LeadTimeDays
+		if r.LeadTimeDays > 0 {
+			leadTime = r.LeadTimeDays
+		}
+		velocity := salesVelocity(r.Location, r.Product, now)
+		reorderPoint := r.Min + int(math.Ceil(velocity*float64(leadTime)))
+		if position > reorderPoint {
+			continue
+		}
+		qty := r.ReorderQuantity
+		if need := reorderPoint - position; need > qty {
+			qty = need
+		}
+		if r.Max > 0 && position+qty > r.Max {
+			qty = r.Max - position
+		}
+		if qty <= 0 {
+			continue
+		}
+		draftKey := r.Supplier + "/" + r.Location
+		po, ok := drafts[draftKey]
+		if !ok {
+			poSeq++
+			po = &PurchaseOrder{fmt.Sprintf("PO-%04d", poSeq), r.Supplier, r.Location, PODraft, make([]*PurchaseOrderLine, 0), []*POStatusChange{&POStatusChange{PODraft, user, now}}}
+			drafts[draftKey] = po
+			PurchaseOrderMap[po.ID] = po
+			created = append(created, po)
+		}
+		reason := fmt.Sprintf("%d in stock and %d on order, selling %.1f a day with a %d day lead time", quantity, position-quantity, velocity, leadTime)
+		po.Lines = append(po.Lines, &PurchaseOrderLine{r.Product, qty, 0, reason})
+	}
+	return created
+}
+
+// StartReorderJob drafts purchase orders on an interval until ctx is done
+func StartReorderJob(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				inventoryLock.Lock()
+				GenerateReorders("system", now)
+				inventoryLock.Unlock()
+			}
+		}
+	}()
+}
+
+func generatePurchaseOrders(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		c.JSON(http.StatusOK, GenerateReorders(user.Username, time.Now()))
+	}
+}
+
+func getPurchaseOrders(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		pos := make([]*PurchaseOrder, 0, len(PurchaseOrderMap))
+		for _, po := range PurchaseOrderMap {
+			if status := c.Query("status"); status != "" && string(po.Status) != status {
+				continue
+			}
+			pos = append(pos, po)
+		}
+		sort.Slice(pos, func(i, j int) bool { return pos[i].ID < pos[j].ID })
+		c.JSON(http.StatusOK, pos)
+	}
+}
+
+// poTransitions lists the statuses each status can move to
+var poTransitions = map[PurchaseOrderStatus][]string{
+	PODraft:    []string{string(POApproved), string(POCancelled)},
+	POApproved: []string{string(POSent), string(POCancelled)},
+	POSent:     []string{string(POCancelled)},
+}
+
+// movePurchaseOrder moves a purchase order to status, receiving is done by receivePurchaseOrder as it moves stock
+func movePurchaseOrder(s *Server, status PurchaseOrderStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		po, ok := PurchaseOrderMap[c.Param("ID")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "purchase order " + c.Param("ID") + " not found"})
+			return
+		}
+		if !StringSliceContains(poTransitions[po.Status], string(status)) {
+			c.JSON(http.StatusConflict, gin.H{"Message": "purchase order " + po.ID + " is " + string(po.Status) + " and cannot be " + string(status)})
+			return
+		}
+		po.Status = status
+		po.History = append(po.History, &POStatusChange{status, user.Username, time.Now()})
+		c.JSON(http.StatusOK, po)
+	}
+}
+
+type ReceivePurchaseOrderRequest struct {
+	// Received maps product IDs to the quantity that arrived, everything outstanding is received if it's empty
+	Received map[string]int
+	// Lots maps product IDs to the lot they arrived in, for stock tracked by lot
+	Lots map[string]*ReceivedLot
+}
+
+// ReceivedLot is the lot and expiry of goods that arrived, as in ReceiveStockRequest
+type ReceivedLot struct {
+	Lot    string
+	Expiry time.Time
+}
+
+// receivePurchaseOrder books the goods in, the order stays sent until every line has been received in full.
+// The body can be left out to receive everything outstanding
+func receivePurchaseOrder(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReceivePurchaseOrderRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+		}
+		user := c.MustGet("user").(*User)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		po, ok := PurchaseOrderMap[c.Param("ID")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "purchase order " + c.Param("ID") + " not found"})
+			return
+		}
+		if po.Status != POSent {
+			c.JSON(http.StatusConflict, gin.H{"Message": "purchase order " + po.ID + " is " + string(po.Status) + " and cannot be received"})
+			return
+		}
+		lines := make(map[string]bool)
+		for _, l := range po.Lines {
+			lines[l.Product] = true
+			if q, ok := req.Received[l.Product]; ok && (q < 0 || q > l.Quantity-l.Received) {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "received quantity for product with ID " + l.Product + " must be between 0 and what's outstanding"})
+				return
+			}
+		}
+		for product, lot := range req.Lots {
+			if !lines[product] || lot == nil || lot.Lot == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "lot for product with ID " + product + " needs a number and a line on the purchase order"})
+				return
+			}
+			if lotExpiryConflicts(po.Location, product, lot.Lot, lot.Expiry) {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "lot " + lot.Lot + " is already in stock with a different expiry"})
+				return
+			}
+		}
+		complete := true
+		for _, l := range po.Lines {
+			q := l.Quantity - l.Received
+			if len(req.Received) > 0 {
+				q = req.Received[l.Product]
+			}
+			if q > 0 {
+				l.Received += q
+				m := &StockMovement{Location: po.Location, Product: l.Product, Type: ReceiptMovement, Delta: q, Reference: po.ID, User: user.Username}
+				if lot, ok := req.Lots[l.Product]; ok {
+					m.Lot, m.Expiry = lot.Lot, lot.Expiry
+				}
+				PostMovement(m)
+			}
+			if l.Received < l.Quantity {
+				complete = false
+			}
+		}
+		if complete {
+			po.Status = POReceived
+			po.History = append(po.History, &POStatusChange{POReceived, user.Username, time.Now()})
+		}
+		c.JSON(http.StatusOK, po)
+	}
+}
+
+func getSuppliers(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		c.JSON(http.StatusOK, gin.H{"Suppliers": SupplierMap, "Reorder": ReorderMap})
+	}
+}
+
+func setSupplier(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var supplier Supplier
+		if err := c.BindJSON(&supplier); err != nil {
+			return
+		}
+		supplier.ID = c.Param("ID")
+		if supplier.Name == "" || supplier.LeadTimeDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "a name and a lead time that isn't negative are needed"})
+			return
+		}
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		SupplierMap[supplier.ID] = &supplier
+		c.JSON(http.StatusOK, supplier)
+	}
+}
+
+func setReorderSetting(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var r ReorderSetting
+		if err := c.BindJSON(&r); err != nil {
+			return
+		}
+		r.Location = c.Param("location")
+		r.Product = c.Param("product")
+		if r.ReorderQuantity <= 0 || r.Min < 0 || (r.Max > 0 && r.Max < r.Min) {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "reorder quantity must be bigger than 0 and max, if set, can't be below min"})
+			return
+		}
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		if _, ok := SupplierMap[r.Supplier]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "supplier " + r.Supplier + " not found"})
+			return
+		}
+		if _, ok := LocationMap[r.Location]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "location " + r.Location + " not found"})
+			return
+		}
+		ReorderMap[r.Location+"/"+r.Product] = &r
+		c.JSON(http.StatusOK, r)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReceivePurchaseOrder(t *testing.T) {
+	cl := newCluster(t)
+	manager, _ := UserLogin("antero", "supersafepassword")
+	LoggedInUsers[manager.Token] = manager
+	inventoryLock.Lock()
+	stock := StockMap["GLA"]["0003"]
+	saved := *stock
+	PurchaseOrderMap["PO-TEST-RECEIVE"] = &PurchaseOrder{"PO-TEST-RECEIVE", "ACME", "GLA", POSent, []*PurchaseOrderLine{{"0003", 10, 0, ""}}, nil}
+	inventoryLock.Unlock()
+	t.Cleanup(func() {
+		inventoryLock.Lock()
+		*stock = saved
+		delete(PurchaseOrderMap, "PO-TEST-RECEIVE")
+		inventoryLock.Unlock()
+	})
+	path := "/manager/purchase-orders/PO-TEST-RECEIVE/receive"
+
+	if code := cl.send(t, "inventory", "POST", path, manager.Token, `{"Received":`); code != http.StatusBadRequest {
+		t.Errorf("a body that doesn't decode got %d, want 400", code)
+	}
+	if code := cl.send(t, "inventory", "POST", path, manager.Token, `{"Lots":{"0001":{"Lot":"L1"}}}`); code != http.StatusBadRequest {
+		t.Errorf("a lot for a product not on the order got %d, want 400", code)
+	}
+	if code := cl.send(t, "inventory", "POST", path, manager.Token, `{"Received":{"0003":4},"Lots":{"0003":{"Lot":"PO-LOT-1","Expiry":"2030-01-01T00:00:00Z"}}}`); code != http.StatusOK {
+		t.Fatalf("receiving into a lot got %d", code)
+	}
+	if code := cl.send(t, "inventory", "POST", path, manager.Token, `{"Received":{"0003":1},"Lots":{"0003":{"Lot":"PO-LOT-1"}}}`); code != http.StatusBadRequest {
+		t.Errorf("receiving a lot with a different expiry got %d, want 400", code)
+	}
+	// without a body everything outstanding is received
+	if code := cl.send(t, "inventory", "POST", path, manager.Token, ""); code != http.StatusOK {
+		t.Fatalf("receiving the rest got %d", code)
+	}
+
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+	if po := PurchaseOrderMap["PO-TEST-RECEIVE"]; po.Status != POReceived || po.Lines[0].Received != 10 {
+		t.Errorf("purchase order is %s with %d received, want all 10 received", po.Status, po.Lines[0].Received)
+	}
+	if stock.Quantity != saved.Quantity+10 || len(stock.Lots) != 1 || stock.Lots[0].Number != "PO-LOT-1" || stock.Lots[0].Quantity != 4 || !stock.Lots[0].Expiry.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("stock is %d with lots %+v, want %d with 4 in lot PO-LOT-1", stock.Quantity, stock.Lots, saved.Quantity+10)
+	}
+}
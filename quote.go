@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// quoteTTL is how long the prices of a quote are kept for
+const quoteTTL = 15 * time.Minute
+
+// Quote keeps the prices an order was quoted so POST /new can charge the same, as long as nothing about the
+// order has changed
+type Quote struct {
+	ID     string
+	UserID string
+	// key identifies the order that was quoted
+	key string
+	// Pricing is what the order costs before loyalty points
+	Pricing   *CartValueResponse
+	ExpiresAt time.Time
+}
+
+// quoteLock guards QuoteMap
+var quoteLock sync.Mutex
+var QuoteMap = make(map[string]*Quote)
+
+// quoteKey identifies what's being priced, an order can only use a quote with the same key
+func quoteKey(orderReq *BuyOrderRequest, cart map[string]*ProductOrder) string {
+	key, _ := json.Marshal(struct {
+		Cart            map[string]*ProductOrder
+		CustomerID      string
+		DeliveryAddress *DeliveryAddress
+		DeliveryMethod  DeliveryMethod
+		CouponCodes     []string
+		Currency        string
+		CollectFrom     string
+		Location        string
+	}{cart, orderReq.CustomerID, orderReq.DeliveryAddress, orderReq.DeliveryMethod, orderReq.CouponCodes, orderReq.Currency, orderReq.CollectFrom, orderReq.Location})
+	return string(key)
+}
+
+// clonePricing copies the parts of a pricing that loyalty points change
+func clonePricing(p *CartValueResponse) *CartValueResponse {
+	clone := *p
+	clone.DiscountReasons = append([]string(nil), p.DiscountReasons...)
+	return &clone
+}
+
+// purgeQuotes drops the quotes that have expired. MUST be called with quoteLock held
+func purgeQuotes(now time.Time) {
+	for id, q := range QuoteMap {
+		if now.After(q.ExpiresAt) {
+			delete(QuoteMap, id)
+		}
+	}
+}
+
+// QuotedPricing returns a copy of the prices of the user's quote, as long as it hasn't expired and key matches
+func QuotedPricing(id string, user *User, key string) (*CartValueResponse, error) {
+	quoteLock.Lock()
+	defer quoteLock.Unlock()
+	purgeQuotes(time.Now())
+	q, ok := QuoteMap[id]
+	if !ok || q.UserID != user.Username {
+		return nil, errors.New("quote " + id + " not found or expired, get a new quote")
+	}
+	if q.key != key {
+		return nil, errors.New("order doesn't match quote " + id + ", the cart, coupons, delivery or stock changed since it was quoted")
+	}
+	return clonePricing(q.Pricing), nil
+}
+
+// UseQuote drops a quote once an order has been placed with it
+func UseQuote(id string) {
+	quoteLock.Lock()
+	delete(QuoteMap, id)
+	quoteLock.Unlock()
+}
+
+// quoteOrder runs the same checks and pricing as POST /new without taking stock, redeeming coupons or spending
+// points. The quote ID it returns on the order can be sent to /new to keep the prices for quoteTTL
+func quoteOrder(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		var orderReq BuyOrderRequest
+		if err := c.BindJSON(&orderReq); err != nil {
+			return
+		}
+		if orderReq.QuoteID != "" {
+			c.JSON(http.StatusBadRequest, BuyOrderResponse{nil, "unable to quote order", []string{}, []string{"a quote can't be quoted again"}})
+			return
+		}
+		draft, code, warnings, errors := draftOrder(s, user, &orderReq)
+		if code != 0 {
+			c.JSON(code, BuyOrderResponse{nil, "unable to quote order", warnings, errors})
+			return
+		}
+		now := time.Now()
+		quote := &Quote{uuid.Must(uuid.NewRandom()).String(), user.Username, draft.key, clonePricing(draft.pricing), now.Add(quoteTTL)}
+
+		pointsEarned, pointsUsed := 0, 0
+		var pointsEarnedBy map[string]int
+		if orderReq.CustomerID != "" {
+			loyaltyResp, loyaltyErr := SendUpdatePointsRequest(s.config.loyaltyEndpoint, user.Token, &UpdatePointsRequest{orderReq.CustomerID, "", draft.cart, orderReq.UsePoints, true})
+			if loyaltyErr != nil {
+				errors := append(errors, loyaltyErr.Error())
+				c.JSON(http.StatusServiceUnavailable, BuyOrderResponse{nil, "unable to quote order", warnings, errors})
+				return
+			}
+			pointsEarned, pointsEarnedBy = loyaltyResp.PointsEarned, loyaltyResp.EarnedBy
+			if orderReq.UsePoints > 0 {
+				pointsUsed = orderReq.UsePoints
+			}
+			if err := applyPoints(draft.pricing, loyaltyResp, orderReq.UsePoints); err != nil {
+				errors := append(errors, err.Error())
+				c.JSON(http.StatusBadRequest, BuyOrderResponse{nil, "unable to quote order", warnings, errors})
+				return
+			}
+		}
+
+		quoteLock.Lock()
+		purgeQuotes(now)
+		QuoteMap[quote.ID] = quote
+		quoteLock.Unlock()
+
+		order := newOrder("", user, &orderReq, draft)
+		order.QuoteID = quote.ID
+		order.Backorders = draft.plan.Backorders
+		order.PointsEarned, order.PointsUsed, order.PointsEarnedBy = pointsEarned, pointsUsed, pointsEarnedBy
+		c.JSON(http.StatusOK, BuyOrderResponse{order, "prices held until " + quote.ExpiresAt.Format(time.RFC3339), warnings, errors})
+	}
+}
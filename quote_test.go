@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// quote sends the order to POST /quote
+func (cl *cluster) quote(t *testing.T, orderReq *BuyOrderRequest) (int, *BuyOrderResponse) {
+	body, _ := json.Marshal(orderReq)
+	req, _ := http.NewRequest("POST", cl.servers["order"].URL+"/quote", bytes.NewBuffer(body))
+	req.Header.Add("Authorization", "Bearer "+cl.token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	res := &BuyOrderResponse{}
+	json.NewDecoder(response.Body).Decode(res)
+	return response.StatusCode, res
+}
+
+func TestBuyOrderWithQuote(t *testing.T) {
+	cl := newCluster(t)
+	addGiftCard("QUOTES0000000001", 100000)
+	orderReq := func(quantity int, quoteID string) *BuyOrderRequest {
+		return &BuyOrderRequest{
+			Cart:    map[string]*ProductOrder{"0002": &ProductOrder{"0002", quantity}},
+			Tenders: []*Tender{{GiftCardTender, "QUOTES0000000001", Money{}}},
+			QuoteID: quoteID,
+		}
+	}
+	quoteID := func() string {
+		code, res := cl.quote(t, orderReq(1, ""))
+		if code != http.StatusOK || res.Order == nil || res.Order.QuoteID == "" {
+			t.Fatalf("quoting got %d %+v", code, res)
+		}
+		return res.Order.QuoteID
+	}
+	if code := cl.send(t, "order", "POST", "/quote", cl.token, `{"Cart":`); code != http.StatusBadRequest {
+		t.Errorf("quoting a body that doesn't decode got %d, want 400", code)
+	}
+	before := takeSnapshot("QUOTES0000000001", "000002")
+
+	// the order has to be the one that was quoted
+	id := quoteID()
+	if code, res, _ := cl.buy(t, "", orderReq(2, id)); code != http.StatusConflict {
+		t.Errorf("a different cart got %d %+v, want 409", code, res)
+	}
+	// quotes can't be used once they've expired
+	quoteLock.Lock()
+	QuoteMap[id].ExpiresAt = time.Now().Add(-time.Second)
+	quoteLock.Unlock()
+	if code, res, _ := cl.buy(t, "", orderReq(1, id)); code != http.StatusConflict {
+		t.Errorf("an expired quote got %d %+v, want 409", code, res)
+	}
+	quoteLock.Lock()
+	_, kept := QuoteMap[id]
+	quoteLock.Unlock()
+	if kept {
+		t.Error("the expired quote was kept")
+	}
+	if after := takeSnapshot("QUOTES0000000001", "000002"); after != before {
+		t.Errorf("rejected quotes left %+v, was %+v", after, before)
+	}
+
+	// a quote is used once
+	id = quoteID()
+	if code, res, _ := cl.buy(t, "", orderReq(1, id)); code != http.StatusOK || res.Order.QuoteID != id {
+		t.Fatalf("buying with the quote got %d %+v", code, res)
+	}
+	if code, res, _ := cl.buy(t, "", orderReq(1, id)); code != http.StatusConflict {
+		t.Errorf("using the quote again got %d %+v, want 409", code, res)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// customerCancelWindow is how long after placing an order the user that placed it can still cancel it
+const customerCancelWindow = time.Hour
+
+type RefundLine struct {
+	Product  string
+	Quantity int
+	// Amount is the line's share of what was charged for it, after discounts and with tax
+	Amount Money
+	// PointsReversed are the loyalty points the goods earned, which are taken back
+	PointsReversed int
+}
+
+// Refund is what's given back for goods that were cancelled or returned
+type Refund struct {
+	ID    int
+	Lines []*RefundLine
+	// Delivery is only refunded with whatever is left of the order
+	Delivery Money
+	// Amount is the money given back, PointsRefunded are the loyalty points that paid for the rest
+	Amount         Money
+	PointsRefunded int
+	PointsReversed int
+	Reason         string
+	User           string
+	Timestamp      time.Time
+	// StoreCredit is set when the money went to the customer's store credit instead of back to the payments
+	StoreCredit bool `json:",omitempty"`
+}
+
+// Remaining is the quantity of each product on the order that hasn't been refunded
+func (o *Order) Remaining() map[string]int {
+	remaining := make(map[string]int)
+	for id, p := range o.Cart {
+		remaining[id] = p.Quantity
+	}
+	for _, r := range o.Refunds {
+		for _, l := range r.Lines {
+			remaining[l.Product] -= l.Quantity
+		}
+	}
+	for id, q := range remaining {
+		if q <= 0 {
+			delete(remaining, id)
+		}
+	}
+	return remaining
+}
+
+func (o *Order) pricedLine(product string) *PricedLine {
+	for _, l := range o.Lines {
+		if l.ProductID == product {
+			return l
+		}
+	}
+	return nil
+}
+
+// lineGross is what qty units of a line were charged, the discounts on the line are shared out evenly between them
+func (o *Order) lineGross(l *PricedLine, qty int) Money {
+	net := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(l.Payable.Amount), big.NewInt(int64(qty))), big.NewInt(int64(l.Quantity)))
+	gross := MinorUnits(net, o.Currency, MoneyRounding)
+	if o.Tax != nil && o.Tax.Mode == TaxExclusive.String() {
+		tax := new(big.Rat).Mul(net, DecimalRat(l.TaxRate))
+		gross = gross.Add(MinorUnits(tax.Quo(tax, big.NewRat(100, 1)), o.Currency, MoneyRounding))
+	}
+	return gross
+}
+
+// RefundFor works out the refund for qty units of each product in lines. The last units of a line, and the last
+// of the order, get whatever is left so that everything refunded adds up to what was charged
+func (o *Order) RefundFor(lines map[string]int, reason, user string) (*Refund, error) {
+	remaining := o.Remaining()
+	ids := make([]string, 0, len(lines))
+	for id, q := range lines {
+		if q <= 0 || q > remaining[id] {
+			return nil, errors.New("can't refund " + strconv.Itoa(q) + " of product with ID " + id + ", the order has " + strconv.Itoa(remaining[id]) + " left")
+		}
+		if o.pricedLine(id) == nil {
+			return nil, errors.New("order " + o.ID + " has no pricing for product with ID " + id)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	zero := NewMoney(0, o.Currency)
+	refund := &Refund{len(o.Refunds) + 1, make([]*RefundLine, 0, len(ids)), zero, zero, 0, 0, reason, user, time.Now(), false}
+	// what earlier refunds gave back, in total and for each line
+	prevGross, prevAmount, prevPoints := zero, zero, 0
+	prevLine := make(map[string]*RefundLine)
+	for _, r := range o.Refunds {
+		prevGross = prevGross.Add(r.Delivery)
+		prevAmount = prevAmount.Add(r.Amount)
+		prevPoints += r.PointsRefunded
+		for _, l := range r.Lines {
+			prev, ok := prevLine[l.Product]
+			if !ok {
+				prev = &RefundLine{l.Product, 0, zero, 0}
+				prevLine[l.Product] = prev
+			}
+			prev.Quantity += l.Quantity
+			prev.Amount = prev.Amount.Add(l.Amount)
+			prev.PointsReversed += l.PointsReversed
+			prevGross = prevGross.Add(l.Amount)
+		}
+	}
+	whole := true
+	gross := zero
+	for id, q := range remaining {
+		if q > lines[id] {
+			whole = false
+		}
+	}
+	for _, id := range ids {
+		q := lines[id]
+		pl := o.pricedLine(id)
+		line := &RefundLine{id, q, o.lineGross(pl, q), o.PointsEarnedBy[id] * q / pl.Quantity}
+		if q == remaining[id] {
+			prev, ok := prevLine[id]
+			if !ok {
+				prev = &RefundLine{id, 0, zero, 0}
+			}
+			line.Amount = o.lineGross(pl, pl.Quantity).Sub(prev.Amount)
+			line.PointsReversed = o.PointsEarnedBy[id] - prev.PointsReversed
+		}
+		refund.Lines = append(refund.Lines, line)
+		refund.PointsReversed += line.PointsReversed
+		gross = gross.Add(line.Amount)
+	}
+	if whole {
+		// delivery, and anything rounding left behind, goes back with the last of the order
+		refund.Delivery = o.Tax.Gross.Sub(prevGross).Sub(gross)
+		refund.PointsRefunded = o.PointsUsed - prevPoints
+		refund.Amount = o.Payable.Sub(prevAmount)
+		if err := CheckMoney(refund.Amount, refund.Delivery); err != nil {
+			return nil, err
+		}
+		return refund, nil
+	}
+	// the points paid for the same share of every line, so they're refunded in proportion
+	if o.PointsUsed > 0 && o.Tax.Gross.Amount > 0 {
+		points := new(big.Int).Mul(big.NewInt(int64(o.PointsUsed)), big.NewInt(gross.Amount))
+		refund.PointsRefunded = int(points.Quo(points, big.NewInt(o.Tax.Gross.Amount)).Int64())
+		pointsValue := o.Tax.Gross.Sub(o.Payable)
+		value := new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(pointsValue.Amount), big.NewInt(int64(refund.PointsRefunded))), big.NewInt(int64(o.PointsUsed)))
+		gross = gross.Sub(MinorUnits(value, o.Currency, MoneyRounding))
+	}
+	refund.Amount = gross
+	if err := CheckMoney(refund.Amount); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// refundTarget is who a refund is sent to, it's copied from the order so the refund can be sent without orderLock
+type refundTarget struct {
+	OrderID    string
+	CustomerID string
+	Payments   []*Payment
+}
+
+// refundTo copies who a refund of the order is sent to, it MUST be called with orderLock held
+func (o *Order) refundTo() *refundTarget {
+	return &refundTarget{o.ID, o.CustomerID, append([]*Payment(nil), o.Payments...)}
+}
+
+// refundPayments gives the money of a refund back to the order's payments, in the order they were made, or to the
+// customer's store credit. It returns the payments after the refund, they're only recorded on the order once all of
+// them are refunded so that a retry sends the same refunds again
+func refundPayments(s *Server, to *refundTarget, user *User, refund *Refund) ([]*Payment, error) {
+	if refund.StoreCredit {
+		if to.CustomerID == "" {
+			return nil, errors.New("order " + to.OrderID + " has no customer to give store credit to")
+		}
+		if refund.Amount.Amount <= 0 {
+			return to.Payments, nil
+		}
+		return to.Payments, SendStoreCreditRequest(s.config.paymentEndpoint, user.Token, to.CustomerID, refund.Amount, "refund-"+to.OrderID+"-"+strconv.Itoa(refund.ID))
+	}
+	left := refund.Amount
+	payments := append([]*Payment(nil), to.Payments...)
+	for i, p := range payments {
+		if left.Amount <= 0 {
+			break
+		}
+		amount := p.Captured.Sub(p.Refunded)
+		if amount.Amount <= 0 {
+			continue
+		}
+		if left.LessThan(amount) {
+			amount = left
+		}
+		reference := "refund-" + to.OrderID + "-" + strconv.Itoa(refund.ID) + "-" + p.ID
+		refunded, err := SendRefundPaymentRequest(s.config.paymentEndpoint, s.config.serviceToken, p.ID, amount, reference)
+		if err != nil {
+			return nil, err
+		}
+		payments[i] = refunded
+		left = left.Sub(amount)
+	}
+	return payments, nil
+}
+
+// applyRefund gives back the money and loyalty points of a refund, it returns the payments to record with it
+func applyRefund(s *Server, to *refundTarget, user *User, refund *Refund) ([]*Payment, error) {
+	payments, err := refundPayments(s, to, user, refund)
+	if err != nil {
+		return nil, err
+	}
+	if to.CustomerID != "" && (refund.PointsReversed != 0 || refund.PointsRefunded != 0) {
+		err := SendReversePointsRequest(s.config.loyaltyEndpoint, s.config.serviceToken, &ReversePointsRequest{to.CustomerID, to.OrderID, refund.PointsReversed, refund.PointsRefunded, false})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payments, nil
+}
+
+// recordRefund records a refund that applyRefund gave back on the order, it MUST be called with orderLock held
+func (o *Order) recordRefund(refund *Refund, payments []*Payment) {
+	o.Payments = payments
+	o.Refunds = append(o.Refunds, refund)
+}
+
+// checkTransition returns the status code and reason a user can't move an order to status, or 0 if they can
+func checkTransition(o *Order, status OrderStatus, user *User) (int, string) {
+	role, ok := orderTransitions[o.OrderStatus][status]
+	if !ok {
+		return http.StatusConflict, "order " + o.ID + " is " + string(o.OrderStatus) + " and cannot be " + string(status)
+	}
+	if user.Role < role {
+		return http.StatusForbidden, "insufficient permissions to move an order to " + string(status)
+	}
+	if status == OrderCancelled && user.Role < ManagerRole && time.Since(o.Timestamp) > customerCancelWindow {
+		return http.StatusForbidden, "orders can only be cancelled within " + customerCancelWindow.String() + " of being placed, ask a manager"
+	}
+	return 0, ""
+}
+
+type CancelLinesRequest struct {
+	// Lines maps product IDs to the quantity to cancel
+	Lines  map[string]int
+	Reason string
+	// StoreCredit refunds the customer's store credit instead of the payments, only managers can do it
+	StoreCredit bool
+}
+
+// cancelLines cancels part of an order, putting the stock back and refunding it.
+// The order is cancelled once nothing is left on it, which also refunds delivery
+func cancelLines(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CancelLinesRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if len(req.Lines) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "no lines to cancel"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		var refund *Refund
+		var payments []*Payment
+		changeOrder(c, visibleOrder(c.Param("ID"), user), func(o *Order) (func() error, int, string) {
+			if code, reason := checkTransition(o, OrderCancelled, user); code != 0 {
+				return nil, code, reason
+			}
+			if req.StoreCredit && user.Role < ManagerRole {
+				return nil, http.StatusForbidden, "only managers can refund to store credit"
+			}
+			var err error
+			if refund, err = o.RefundFor(req.Lines, req.Reason, user.Username); err != nil {
+				return nil, http.StatusBadRequest, err.Error()
+			}
+			refund.StoreCredit = req.StoreCredit
+			to := o.refundTo()
+			return func() error {
+				if _, err := SendReleaseRequest(s.config.inventoryEndpoint, s.config.serviceToken, &ReleaseRequest{to.OrderID, req.Lines, "refund " + strconv.Itoa(refund.ID)}); err != nil {
+					return err
+				}
+				payments, err = applyRefund(s, to, user, refund)
+				return err
+			}, 0, ""
+		}, func(o *Order, err error) {
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"Message": err.Error()})
+				return
+			}
+			o.recordRefund(refund, payments)
+			if len(o.Remaining()) == 0 {
+				o.SetStatus(OrderCancelled, user.Username, req.Reason)
+			}
+			c.JSON(http.StatusOK, o)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRefundForAddsUpToWhatWasCharged(t *testing.T) {
+	order := func() *Order {
+		return &Order{
+			ID:             "REFUNDS",
+			Currency:       "GBP",
+			Cart:           map[string]*ProductOrder{"A": &ProductOrder{"A", 3}, "B": &ProductOrder{"B", 1}},
+			Lines:          []*PricedLine{{ProductID: "A", Quantity: 3, Payable: gbp(1000)}, {ProductID: "B", Quantity: 1, Payable: gbp(499)}},
+			Tax:            &TaxBreakdown{Mode: TaxInclusive.String(), Gross: gbp(1799)},
+			Payable:        gbp(1699),
+			PointsEarned:   35,
+			PointsEarnedBy: map[string]int{"A": 30, "B": 5},
+			// 100 points paid for £1, delivery was £3
+			PointsUsed: 100,
+		}
+	}
+	tests := []struct {
+		name  string
+		steps []map[string]int
+	}{
+		{"one refund", []map[string]int{{"A": 3, "B": 1}}},
+		{"a unit at a time", []map[string]int{{"A": 1}, {"A": 1}, {"B": 1}, {"A": 1}}},
+		{"lines together then the rest", []map[string]int{{"A": 2, "B": 1}, {"A": 1}}},
+	}
+	for _, tt := range tests {
+		o := order()
+		amount, delivery, lines := gbp(0), gbp(0), gbp(0)
+		pointsRefunded, pointsReversed := 0, 0
+		for i, step := range tt.steps {
+			refund, err := o.RefundFor(step, "test", "antero")
+			if err != nil {
+				t.Fatalf("%s: refund %d: %v", tt.name, i+1, err)
+			}
+			if refund.ID != i+1 || refund.Amount.Amount < 0 || (i < len(tt.steps)-1 && !refund.Delivery.IsZero()) {
+				t.Errorf("%s: refund %d is %+v, want delivery only on the last", tt.name, i+1, refund)
+			}
+			o.recordRefund(refund, o.Payments)
+			amount, delivery = amount.Add(refund.Amount), delivery.Add(refund.Delivery)
+			pointsRefunded += refund.PointsRefunded
+			pointsReversed += refund.PointsReversed
+			for _, l := range refund.Lines {
+				lines = lines.Add(l.Amount)
+			}
+		}
+		got := fmt.Sprintf("amount %v delivery %v lines %v points %d/%d", amount, delivery, lines, pointsRefunded, pointsReversed)
+		want := fmt.Sprintf("amount %v delivery %v lines %v points %d/%d", gbp(1699), gbp(300), gbp(1499), 100, 35)
+		if got != want {
+			t.Errorf("%s: refunded %s, want %s", tt.name, got, want)
+		}
+		if len(o.Remaining()) != 0 {
+			t.Errorf("%s: %v left after refunding everything", tt.name, o.Remaining())
+		}
+		if _, err := o.RefundFor(map[string]int{"A": 1}, "test", "antero"); err == nil {
+			t.Errorf("%s: refunded more than the order had", tt.name)
+		}
+	}
+}
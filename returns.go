@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReturnReason is why the customer sent goods back
+type ReturnReason string
+
+const (
+	ReturnDamaged        ReturnReason = "damaged"
+	ReturnFaulty         ReturnReason = "faulty"
+	ReturnWrongItem      ReturnReason = "wrong-item"
+	ReturnNotAsDescribed ReturnReason = "not-as-described"
+	ReturnNoLongerWanted ReturnReason = "no-longer-wanted"
+)
+
+var returnReasons = []string{string(ReturnDamaged), string(ReturnFaulty), string(ReturnWrongItem), string(ReturnNotAsDescribed), string(ReturnNoLongerWanted)}
+
+// ReturnStatus is where a return is in the returns workflow
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	// ReturnReceived returns have been inspected and put into stock but not refunded yet
+	ReturnReceived ReturnStatus = "received"
+	ReturnRefunded ReturnStatus = "refunded"
+)
+
+// returnTransitions lists the statuses each status can be moved to by a manager, receiving is done by receiveReturn
+var returnTransitions = map[ReturnStatus][]string{
+	ReturnRequested: []string{string(ReturnApproved), string(ReturnRejected)},
+}
+
+type ReturnLine struct {
+	Product  string
+	Quantity int
+	Reason   ReturnReason
+	// Restocked and Damaged are decided when the goods are inspected, they add up to Quantity
+	Restocked int
+	Damaged   int
+}
+
+type ReturnStatusChange struct {
+	Status    ReturnStatus
+	User      string
+	Timestamp time.Time
+}
+
+// Return is a request to send back goods from an order, it's kept on the order
+type Return struct {
+	ID      string
+	OrderID string
+	Lines   []*ReturnLine
+	Note    string `json:",omitempty"`
+	Status  ReturnStatus
+	History []*ReturnStatusChange
+	// RefundID is the order refund the return was paid back with
+	RefundID int `json:",omitempty"`
+}
+
+func (r *Return) setStatus(status ReturnStatus, user string) {
+	r.Status = status
+	r.History = append(r.History, &ReturnStatusChange{status, user, time.Now()})
+}
+
+// returnSeq numbers returns, it's guarded by orderLock
+var returnSeq = 0
+
+// openReturns is the quantity of each product that's on returns that haven't been rejected or refunded yet
+func (o *Order) openReturns() map[string]int {
+	open := make(map[string]int)
+	for _, r := range o.Returns {
+		if r.Status == ReturnRejected || r.Status == ReturnRefunded {
+			continue
+		}
+		for _, l := range r.Lines {
+			open[l.Product] += l.Quantity
+		}
+	}
+	return open
+}
+
+// findReturn finds a return and the order it's for. MUST be called with orderLock held
+func findReturn(id string) (*Order, *Return) {
+	for _, o := range OrdersMap {
+		for _, r := range o.Returns {
+			if r.ID == id {
+				return o, r
+			}
+		}
+	}
+	return nil, nil
+}
+
+type ReturnRequest struct {
+	Lines []*ReturnLine
+	Note  string
+}
+
+// requestReturn asks to send back goods from a delivered order, by the user that placed it or a manager
+func requestReturn(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReturnRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		user := c.MustGet("user").(*User)
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		o, ok := OrdersMap[c.Param("ID")]
+		if !ok || !o.visibleTo(user) {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "order " + c.Param("ID") + " not found"})
+			return
+		}
+		if o.OrderStatus != OrderDelivered {
+			c.JSON(http.StatusConflict, gin.H{"Message": "order " + o.ID + " is " + string(o.OrderStatus) + ", only delivered orders can be returned"})
+			return
+		}
+		if len(req.Lines) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "no lines to return"})
+			return
+		}
+		remaining := o.Remaining()
+		open := o.openReturns()
+		requested := make(map[string]int)
+		for _, l := range req.Lines {
+			if !StringSliceContains(returnReasons, string(l.Reason)) {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "reason must be one of [" + strings.Join(returnReasons, ", ") + "]"})
+				return
+			}
+			if _, ok := requested[l.Product]; ok {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "product with ID " + l.Product + " is on the return more than once"})
+				return
+			}
+			requested[l.Product] = l.Quantity
+			if l.Quantity <= 0 || l.Quantity > remaining[l.Product]-open[l.Product] {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": fmt.Sprintf("can't return %d of product with ID %s, %d can still be returned", l.Quantity, l.Product, remaining[l.Product]-open[l.Product])})
+				return
+			}
+			l.Restocked, l.Damaged = 0, 0
+		}
+		returnSeq++
+		r := &Return{fmt.Sprintf("RMA-%04d", returnSeq), o.ID, req.Lines, req.Note, "", nil, 0}
+		r.setStatus(ReturnRequested, user.Username)
+		o.Returns = append(o.Returns, r)
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+// moveReturn approves or rejects a return
+func moveReturn(s *Server, status ReturnStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		_, r := findReturn(c.Param("rma"))
+		if r == nil {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "return " + c.Param("rma") + " not found"})
+			return
+		}
+		if !StringSliceContains(returnTransitions[r.Status], string(status)) {
+			c.JSON(http.StatusConflict, gin.H{"Message": "return " + r.ID + " is " + string(r.Status) + " and cannot be " + string(status)})
+			return
+		}
+		r.setStatus(status, user.Username)
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+type ReturnInspection struct {
+	Restocked int
+	Damaged   int
+}
+
+type ReceiveReturnRequest struct {
+	// Lines maps product IDs to how much of the line can be sold again and how much is damaged
+	Lines map[string]*ReturnInspection
+	// StoreCredit refunds the customer's store credit instead of the payments
+	StoreCredit bool
+}
+
+// receiveReturn records the inspection of returned goods, puts them into sellable or damaged stock and refunds them.
+// A return that was received but couldn't be refunded is refunded when it's received again
+func receiveReturn(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReceiveReturnRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		user := c.MustGet("user").(*User)
+		var r *Return
+		// inspected is the return's lines with the inspection, they're recorded once the stock is put back
+		var inspected []*ReturnLine
+		var stocked bool
+		var refund *Refund
+		var payments []*Payment
+		changeOrder(c, func() (*Order, string) {
+			var o *Order
+			o, r = findReturn(c.Param("rma"))
+			return o, "return " + c.Param("rma") + " not found"
+		}, func(o *Order) (func() error, int, string) {
+			if r.Status != ReturnApproved && r.Status != ReturnReceived {
+				return nil, http.StatusConflict, "return " + r.ID + " is " + string(r.Status) + " and cannot be received"
+			}
+			if r.Status == ReturnApproved {
+				inspected = make([]*ReturnLine, 0, len(r.Lines))
+				for _, l := range r.Lines {
+					i, ok := req.Lines[l.Product]
+					if !ok || i.Restocked < 0 || i.Damaged < 0 || i.Restocked+i.Damaged != l.Quantity {
+						return nil, http.StatusBadRequest, "the restocked and damaged quantities of product with ID " + l.Product + " must add up to what was returned"
+					}
+					line := *l
+					line.Restocked, line.Damaged = i.Restocked, i.Damaged
+					inspected = append(inspected, &line)
+				}
+			}
+			lines := make(map[string]int)
+			reasons := make([]string, 0, len(r.Lines))
+			for _, l := range r.Lines {
+				lines[l.Product] += l.Quantity
+				reasons = append(reasons, l.Product+": "+string(l.Reason))
+			}
+			var err error
+			if refund, err = o.RefundFor(lines, "return "+r.ID+" ("+strings.Join(reasons, ", ")+")", user.Username); err != nil {
+				return nil, http.StatusConflict, err.Error()
+			}
+			refund.StoreCredit = req.StoreCredit
+			to, location, rma := o.refundTo(), o.Location, r.ID
+			return func() error {
+				if inspected != nil {
+					if err := SendReturnStockRequest(s.config.inventoryEndpoint, s.config.serviceToken, &ReturnStockRequest{to.OrderID, rma, location, inspected}); err != nil {
+						return err
+					}
+					stocked = true
+				}
+				payments, err = applyRefund(s, to, user, refund)
+				return err
+			}, 0, ""
+		}, func(o *Order, err error) {
+			if stocked {
+				r.Lines = inspected
+				r.setStatus(ReturnReceived, user.Username)
+			}
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"Message": err.Error()})
+				return
+			}
+			o.recordRefund(refund, payments)
+			r.RefundID = refund.ID
+			r.setStatus(ReturnRefunded, user.Username)
+			if len(o.Remaining()) == 0 {
+				o.SetStatus(OrderReturned, user.Username, "everything on the order was returned")
+			}
+			c.JSON(http.StatusOK, r)
+		})
+	}
+}
+
+type ReturnedProduct struct {
+	Returned  int
+	Restocked int
+	Damaged   int
+}
+
+type ReturnsReport struct {
+	Returns   []*Return
+	Units     int
+	ByReason  map[ReturnReason]int
+	ByProduct map[string]*ReturnedProduct
+	// Refunded is the money refunded for returns in each currency
+	Refunded map[string]Money
+}
+
+// getReturnsReport lists the returns requested between from and to, optionally with the given status,
+// and adds up the units returned by reason and product and the money refunded
+func getReturnsReport(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var from, to time.Time
+		var err error
+		if f := c.Query("from"); f != "" {
+			if from, err = time.Parse(time.RFC3339, f); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "from value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		if t := c.Query("to"); t != "" {
+			if to, err = time.Parse(time.RFC3339, t); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"Message": "to value must be a time in RFC3339 format"})
+				return
+			}
+		}
+		status := ReturnStatus(c.Query("status"))
+		orderLock.Lock()
+		defer orderLock.Unlock()
+		report := ReturnsReport{make([]*Return, 0), 0, make(map[ReturnReason]int), make(map[string]*ReturnedProduct), make(map[string]Money)}
+		for _, o := range OrdersMap {
+			for _, r := range o.Returns {
+				requested := r.History[0].Timestamp
+				if (status != "" && r.Status != status) || (!from.IsZero() && requested.Before(from)) || (!to.IsZero() && requested.After(to)) {
+					continue
+				}
+				report.Returns = append(report.Returns, r)
+				for _, l := range r.Lines {
+					p, ok := report.ByProduct[l.Product]
+					if !ok {
+						p = &ReturnedProduct{}
+						report.ByProduct[l.Product] = p
+					}
+					p.Returned += l.Quantity
+					p.Restocked += l.Restocked
+					p.Damaged += l.Damaged
+					report.Units += l.Quantity
+					report.ByReason[l.Reason] += l.Quantity
+				}
+				if r.RefundID > 0 {
+					report.Refunded[o.Currency] = report.Refunded[o.Currency].Add(o.Refunds[r.RefundID-1].Amount)
+				}
+			}
+		}
+		sort.Slice(report.Returns, func(i, j int) bool { return report.Returns[i].ID < report.Returns[j].ID })
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+type ReturnStockRequest struct {
+	OrderID string
+	// Reference is the return the goods came back on, a return is only put into stock once
+	Reference string
+	// Location is where sellable goods go back to, damaged ones go to DamagedStockLocation
+	Location string
+	Lines    []*ReturnLine
+}
+
+// restockReturn puts returned goods back into the lots they were sold from, at the location for ones
+// that can be sold again and at DamagedStockLocation for the rest
+func restockReturn(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ReturnStockRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		user := c.MustGet("user").(*User)
+		location := locationParam(req.Location)
+		inventoryLock.Lock()
+		defer inventoryLock.Unlock()
+		// what's already come back from each lot the order was sold, so later returns don't reuse it
+		returned := make(map[string]int)
+		for _, m := range StockLedger {
+			if m.Type != ReturnMovement || m.OrderID != req.OrderID {
+				continue
+			}
+			if m.Reference == req.Reference {
+				c.JSON(http.StatusOK, gin.H{"Message": "return " + req.Reference + " was already put into stock"})
+				return
+			}
+			returned[m.Product+"/"+m.Lot] += m.Delta
+		}
+		held := HeldForOrder(req.OrderID)
+		for _, l := range req.Lines {
+			for _, part := range []struct {
+				location string
+				qty      int
+			}{{location, l.Restocked}, {DamagedStockLocation, l.Damaged}} {
+				qty := part.qty
+				for _, h := range held {
+					if qty == 0 {
+						break
+					}
+					key := h.product + "/" + h.lot
+					if h.product != l.Product || h.lot == "" || h.quantity-returned[key] <= 0 {
+						continue
+					}
+					take := h.quantity - returned[key]
+					if take > qty {
+						take = qty
+					}
+					PostMovement(&StockMovement{Location: part.location, Product: l.Product, Type: ReturnMovement, Delta: take, OrderID: req.OrderID, Reference: req.Reference, Lot: h.lot, Expiry: h.expiry, User: user.Username})
+					returned[key] += take
+					qty -= take
+				}
+				// goods that weren't sold from a lot, or more than the lots can account for, come back without one
+				if qty > 0 {
+					PostMovement(&StockMovement{Location: part.location, Product: l.Product, Type: ReturnMovement, Delta: qty, OrderID: req.OrderID, Reference: req.Reference, User: user.Username})
+				}
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"Message": "return " + req.Reference + " put into stock"})
+	}
+}
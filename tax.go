@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TaxClass decides which VAT rate applies to a product
+type TaxClass int
+
+const (
+	// StandardTax is the 0 value, so any Product created without a TaxClass gets the standard rate
+	StandardTax TaxClass = iota
+	ReducedTax
+	ZeroTax
+	// ExemptTax is outside the scope of VAT, unlike ZeroTax which is taxed at 0%
+	ExemptTax
+)
+
+func (t TaxClass) String() string {
+	return taxClassToString[t]
+}
+
+var taxClassToString = map[TaxClass]string{
+	StandardTax: "Standard",
+	ReducedTax:  "Reduced",
+	ZeroTax:     "Zero",
+	ExemptTax:   "Exempt",
+}
+
+var taxClassToID = map[string]TaxClass{
+	"Standard": StandardTax,
+	"Reduced":  ReducedTax,
+	"Zero":     ZeroTax,
+	"Exempt":   ExemptTax,
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (t TaxClass) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(taxClassToString[t])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (t *TaxClass) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'StandardTax' in this case.
+	*t = taxClassToID[j]
+	return nil
+}
+
+// TaxMode says whether product prices already include tax
+type TaxMode int
+
+const (
+	// TaxInclusive prices include VAT, as is usual for retail, it's the 0 value so it's the default
+	TaxInclusive TaxMode = iota
+	// TaxExclusive prices have VAT added on top
+	TaxExclusive
+)
+
+var taxModeToString = map[TaxMode]string{
+	TaxInclusive: "inclusive",
+	TaxExclusive: "exclusive",
+}
+
+var taxModeToID = map[string]TaxMode{
+	"inclusive": TaxInclusive,
+	"exclusive": TaxExclusive,
+}
+
+func (m TaxMode) String() string {
+	return taxModeToString[m]
+}
+
+// ParseTaxMode returns the TaxMode with the given name
+func ParseTaxMode(name string) (TaxMode, error) {
+	m, ok := taxModeToID[name]
+	if !ok {
+		return TaxInclusive, errors.New("tax mode " + name + " is not allowed, allowed modes: [inclusive, exclusive]")
+	}
+	return m, nil
+}
+
+// PricingTaxMode is the TaxMode product prices are set in
+var PricingTaxMode = TaxInclusive
+
+// TaxRate is the percentage charged for a TaxClass from EffectiveFrom until a later rate for the class takes over
+type TaxRate struct {
+	Class         TaxClass
+	Rate          float64
+	EffectiveFrom time.Time
+}
+
+var TaxRateList = []*TaxRate{
+	&TaxRate{StandardTax, 17.5, time.Date(1991, 4, 1, 0, 0, 0, 0, time.UTC)},
+	&TaxRate{StandardTax, 20, time.Date(2011, 1, 4, 0, 0, 0, 0, time.UTC)},
+	&TaxRate{ReducedTax, 5, time.Date(1997, 9, 1, 0, 0, 0, 0, time.UTC)},
+	&TaxRate{ZeroTax, 0, time.Date(1973, 4, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+// taxLock guards TaxRateList
+var taxLock sync.RWMutex
+
+// TaxRateOn returns the rate for class in effect at the given time
+func TaxRateOn(class TaxClass, at time.Time) (float64, error) {
+	if class == ExemptTax {
+		return 0, nil
+	}
+	taxLock.RLock()
+	defer taxLock.RUnlock()
+	var current *TaxRate
+	for _, r := range TaxRateList {
+		if r.Class != class || r.EffectiveFrom.After(at) {
+			continue
+		}
+		if current == nil || r.EffectiveFrom.After(current.EffectiveFrom) {
+			current = r
+		}
+	}
+	if current == nil {
+		return 0, errors.New("no " + class.String() + " tax rate in effect at " + at.Format(time.RFC3339))
+	}
+	return current.Rate, nil
+}
+
+// LineDiscount is implemented by discounts that only apply to some lines of the cart.
+// Discounts that don't implement it are spread over the whole cart.
+type LineDiscount interface {
+	// Lines returns the IDs of the products in the cart the discount was taken from
+	Lines(map[string]*ProductOrder) []string
+}
+
+func (d *PercentDiscount) Lines(cart map[string]*ProductOrder) []string {
+	return []string{d.ProductID}
+}
+
+func (d *AnyXForY) Lines(cart map[string]*ProductOrder) []string {
+	lines := make([]string, 0)
+	for _, p := range cart {
+		if StringSliceContains(d.ProductIDs, p.ID) {
+			lines = append(lines, p.ID)
+		}
+	}
+	return lines
+}
+
+// AppliedDiscount is a Discount that was taken off a cart, with the amount it took
+type AppliedDiscount struct {
+	PromotionID string
+	Discount    Discount
+	Amount      Money
+	Reason      string
+}
+
+// ApportionDiscount spreads amount over the eligible lines in proportion to their value.
+// Remainders go to the lines with the biggest fractions so that the parts always add up to amount.
+// A discount can't take more than the lines are worth, so amount is cut down to their value.
+func ApportionDiscount(amount Money, lines map[string]Money, eligible []string) map[string]Money {
+	ids := make([]string, 0)
+	// the products of amounts can be too big for an int64, so the shares are worked out with big.Int
+	total := new(big.Int)
+	for id, v := range lines {
+		if v.Amount <= 0 || (eligible != nil && !StringSliceContains(eligible, id)) {
+			continue
+		}
+		ids = append(ids, id)
+		total.Add(total, big.NewInt(v.Amount))
+	}
+	sort.Strings(ids)
+	parts := make(map[string]Money)
+	if total.Sign() == 0 {
+		return parts
+	}
+	if big.NewInt(amount.Amount).Cmp(total) > 0 {
+		amount = Money{total.Int64(), amount.Currency}
+	}
+	type remainder struct {
+		id  string
+		rem *big.Int
+	}
+	rems := make([]remainder, 0, len(ids))
+	given := int64(0)
+	for _, id := range ids {
+		share := new(big.Int).Mul(big.NewInt(amount.Amount), big.NewInt(lines[id].Amount))
+		// a line is never worth more than the total, so its part is never more than amount
+		part, rem := new(big.Int).QuoRem(share, total, new(big.Int))
+		parts[id] = Money{part.Int64(), amount.Currency}
+		given += part.Int64()
+		rems = append(rems, remainder{id, rem})
+	}
+	sort.SliceStable(rems, func(i, j int) bool { return rems[i].rem.Cmp(rems[j].rem) > 0 })
+	for i := 0; given < amount.Amount; i++ {
+		p := parts[rems[i%len(rems)].id]
+		p.Amount++
+		parts[rems[i%len(rems)].id] = p
+		given++
+	}
+	return parts
+}
+
+// TaxAmount is the tax charged at one rate
+type TaxAmount struct {
+	Class TaxClass
+	Rate  float64
+	Net   Money
+	Tax   Money
+}
+
+// TaxBreakdown is the tax on a cart after discounts
+type TaxBreakdown struct {
+	Mode  string
+	Net   Money
+	Tax   Money
+	Gross Money
+	Rates []*TaxAmount
+}
+
+// ApportionDiscounts takes each discount off the lines it came from, in order. A discount only takes what's left
+// of its lines after the ones before it, so no line goes below zero, and its Amount is changed to what it took.
+// It returns the value of each line after discounts and, for each discount, how much of it was taken from each line
+func ApportionDiscounts(cart map[string]*ProductOrder, products map[string]*Product, discounts []*AppliedDiscount) (map[string]Money, []map[string]Money, error) {
+	lines := make(map[string]Money)
+	for _, p := range cart {
+		prod, ok := products[p.ID]
+		if !ok {
+			return nil, nil, errors.New("product with ID " + p.ID + " not found")
+		}
+		lines[p.ID] = prod.Price.Mul(p.Quantity)
+	}
+	shares := make([]map[string]Money, len(discounts))
+	for i, d := range discounts {
+		var eligible []string
+		if ld, ok := d.Discount.(LineDiscount); ok {
+			eligible = ld.Lines(cart)
+		}
+		shares[i] = ApportionDiscount(d.Amount, lines, eligible)
+		taken := NewMoney(0, d.Amount.Currency)
+		for id, part := range shares[i] {
+			lines[id] = lines[id].Sub(part)
+			taken = taken.Add(part)
+		}
+		d.Amount = taken
+	}
+	return lines, shares, nil
+}
+
+// CalculateTax works out the tax on the lines of a cart after discounts, rounding once per rate.
+// Lines without a class in classes are charged the standard rate
+func CalculateTax(lines map[string]Money, classes map[string]TaxClass, at time.Time, mode TaxMode, currency string) (*TaxBreakdown, error) {
+	byClass := make(map[TaxClass]Money)
+	for id, v := range lines {
+		class := classes[id]
+		byClass[class] = byClass[class].Add(v)
+	}
+	res := &TaxBreakdown{mode.String(), NewMoney(0, currency), NewMoney(0, currency), NewMoney(0, currency), make([]*TaxAmount, 0)}
+	for class := StandardTax; class <= ExemptTax; class++ {
+		amount, ok := byClass[class]
+		if !ok {
+			continue
+		}
+		rate, err := TaxRateOn(class, at)
+		if err != nil {
+			return nil, err
+		}
+		r := new(big.Rat).Mul(new(big.Rat).SetInt64(amount.Amount), DecimalRat(rate))
+		if mode == TaxInclusive {
+			// the tax part of a gross amount is amount x rate / (100 + rate)
+			r.Quo(r, new(big.Rat).Add(big.NewRat(100, 1), DecimalRat(rate)))
+		} else {
+			r.Quo(r, big.NewRat(100, 1))
+		}
+		tax := MinorUnits(r, currency, MoneyRounding)
+		net := amount
+		if mode == TaxInclusive {
+			net = amount.Sub(tax)
+		}
+		res.Rates = append(res.Rates, &TaxAmount{class, rate, net, tax})
+		res.Net = res.Net.Add(net)
+		res.Tax = res.Tax.Add(tax)
+	}
+	res.Gross = res.Net.Add(res.Tax)
+	return res, nil
+}
+
+func getTaxRates(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		taxLock.RLock()
+		defer taxLock.RUnlock()
+		c.JSON(http.StatusOK, gin.H{"Mode": PricingTaxMode.String(), "Rates": TaxRateList})
+	}
+}
+
+func addTaxRate(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		class, ok := taxClassToID[c.PostForm("class")]
+		if !ok || class == ExemptTax {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "class value must be one of [Standard, Reduced, Zero]"})
+			return
+		}
+		rate, err := strconv.ParseFloat(c.PostForm("rate"), 64)
+		if err != nil || rate < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "rate value must be a decimal number and not negative"})
+			return
+		}
+		effective := time.Now()
+		if e := c.PostForm("effective"); e != "" {
+			effective, err = time.Parse("2006-01-02", e)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "effective value must be a date in the format YYYY-MM-DD"})
+				return
+			}
+		}
+		taxLock.Lock()
+		defer taxLock.Unlock()
+		tr := &TaxRate{class, rate, effective}
+		TaxRateList = append(TaxRateList, tr)
+		c.JSON(http.StatusOK, tr)
+	}
+}
+
+func setTaxClass(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("ID")
+		class, ok := taxClassToID[c.PostForm("class")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "class value must be one of [Standard, Reduced, Zero, Exempt]"})
+			return
+		}
+		product, ok := ProductMap[id]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "Message": "product with ID " + id + " not found"})
+			return
+		}
+		product.TaxClass = class
+		c.JSON(http.StatusOK, product)
+	}
+}
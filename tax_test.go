@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func gbp(amount int64) Money {
+	return NewMoney(amount, "GBP")
+}
+
+func TestApportionDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		lines    map[string]Money
+		eligible []string
+		want     map[string]Money
+	}{
+		{"even split", 100, map[string]Money{"a": gbp(100), "b": gbp(100)}, nil, map[string]Money{"a": gbp(50), "b": gbp(50)}},
+		{"in proportion", 10, map[string]Money{"a": gbp(300), "b": gbp(700)}, nil, map[string]Money{"a": gbp(3), "b": gbp(7)}},
+		{"remainder to biggest fraction", 10, map[string]Money{"a": gbp(100), "b": gbp(200)}, nil, map[string]Money{"a": gbp(3), "b": gbp(7)}},
+		{"tied remainders by ID", 100, map[string]Money{"c": gbp(100), "b": gbp(100), "a": gbp(100)}, nil, map[string]Money{"a": gbp(34), "b": gbp(33), "c": gbp(33)}},
+		{"no more than the lines are worth", 500, map[string]Money{"a": gbp(100), "b": gbp(200), "c": gbp(300)}, []string{"a", "b"}, map[string]Money{"a": gbp(100), "b": gbp(200)}},
+		{"only eligible lines", 5, map[string]Money{"a": gbp(100), "b": gbp(200)}, []string{"b"}, map[string]Money{"b": gbp(5)}},
+		{"zero lines skipped", 10, map[string]Money{"a": gbp(0), "b": gbp(100)}, nil, map[string]Money{"b": gbp(10)}},
+		{"nothing eligible", 10, map[string]Money{"a": gbp(100)}, []string{"c"}, map[string]Money{}},
+	}
+	for _, tt := range tests {
+		got := ApportionDiscount(gbp(tt.amount), tt.lines, tt.eligible)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApportionDiscounts(t *testing.T) {
+	products := map[string]*Product{
+		"0001": &Product{"0001", "Gadget", gbp(4550), nil, StandardTax, 1200},
+		"0002": &Product{"0002", "Widget 1.0", gbp(545), nil, StandardTax, 250},
+		"0003": &Product{"0003", "Widget 2.0", gbp(745), nil, ReducedTax, 300},
+	}
+	cart := map[string]*ProductOrder{"0001": &ProductOrder{"0001", 1}, "0002": &ProductOrder{"0002", 2}, "0003": &ProductOrder{"0003", 1}}
+	discounts := []*AppliedDiscount{
+		&AppliedDiscount{"PROMO-0001", &PercentDiscount{"0001", 20}, gbp(910), "20% off"},
+		&AppliedDiscount{"PROMO-0002", &AnyXForY{[]string{"0002", "0003"}, 3, 2}, gbp(545), "3 for 2"},
+	}
+	lines, shares, err := ApportionDiscounts(cart, products, discounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 545 over 1090 and 745 is 323.73 and 221.27, the penny left goes to the bigger fraction
+	wantShares := []map[string]Money{{"0001": gbp(910)}, {"0002": gbp(324), "0003": gbp(221)}}
+	if !reflect.DeepEqual(shares, wantShares) {
+		t.Errorf("shares %v, want %v", shares, wantShares)
+	}
+	wantLines := map[string]Money{"0001": gbp(3640), "0002": gbp(766), "0003": gbp(524)}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("lines %v, want %v", lines, wantLines)
+	}
+	if discounts[1].Amount != gbp(545) {
+		t.Errorf("3 for 2 took %s, want all of it", discounts[1].Amount)
+	}
+
+	// a 100% coupon after 20% off only has the 80% that's left to take
+	stacked := []*AppliedDiscount{
+		&AppliedDiscount{"PROMO-0001", &PercentDiscount{"0001", 20}, gbp(910), "20% off"},
+		&AppliedDiscount{"COUPON-FREE", &PercentDiscount{"0001", 100}, gbp(4550), "100% off"},
+		&AppliedDiscount{"COUPON-MORE", &PercentDiscount{"0001", 10}, gbp(455), "10% off"},
+	}
+	lines, _, err = ApportionDiscounts(map[string]*ProductOrder{"0001": &ProductOrder{"0001", 1}}, products, stacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines["0001"] != gbp(0) {
+		t.Errorf("line left at %s, want 0", lines["0001"])
+	}
+	for i, want := range []int64{910, 3640, 0} {
+		if stacked[i].Amount != gbp(want) {
+			t.Errorf("%s took %s, want %d", stacked[i].PromotionID, stacked[i].Amount, want)
+		}
+	}
+	if _, _, err := ApportionDiscounts(map[string]*ProductOrder{"9999": &ProductOrder{"9999", 1}}, products, nil); err == nil {
+		t.Error("unknown product apportioned")
+	}
+}
+
+func TestCalculateTax(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		lines           map[string]Money
+		classes         map[string]TaxClass
+		at              time.Time
+		mode            TaxMode
+		net, tax, gross int64
+	}{
+		{"inclusive standard", map[string]Money{"a": gbp(12000)}, nil, now, TaxInclusive, 10000, 2000, 12000},
+		{"exclusive standard", map[string]Money{"a": gbp(1000)}, nil, now, TaxExclusive, 1000, 200, 1200},
+		{"inclusive reduced", map[string]Money{"a": gbp(2100)}, map[string]TaxClass{"a": ReducedTax}, now, TaxInclusive, 2000, 100, 2100},
+		{"zero and exempt", map[string]Money{"a": gbp(500), "b": gbp(700)}, map[string]TaxClass{"a": ZeroTax, "b": ExemptTax}, now, TaxInclusive, 1200, 0, 1200},
+		{"mixed classes", map[string]Money{"a": gbp(1200), "b": gbp(2100)}, map[string]TaxClass{"b": ReducedTax}, now, TaxInclusive, 3000, 300, 3300},
+		// each line is half a penny of tax, but tax is rounded once per rate so it's 1p and not 2p
+		{"rounded once per rate", map[string]Money{"a": gbp(3), "b": gbp(3)}, nil, now, TaxInclusive, 5, 1, 6},
+		{"rate in effect at the time", map[string]Money{"a": gbp(1175)}, nil, time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC), TaxInclusive, 1000, 175, 1175},
+	}
+	for _, tt := range tests {
+		got, err := CalculateTax(tt.lines, tt.classes, tt.at, tt.mode, "GBP")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Net != gbp(tt.net) || got.Tax != gbp(tt.tax) || got.Gross != gbp(tt.gross) {
+			t.Errorf("%s: net %s tax %s gross %s, want %d %d %d", tt.name, got.Net, got.Tax, got.Gross, tt.net, tt.tax, tt.gross)
+		}
+	}
+	if _, err := CalculateTax(map[string]Money{"a": gbp(100)}, nil, time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), TaxInclusive, "GBP"); err == nil {
+		t.Error("tax calculated before any standard rate was in effect")
+	}
+}
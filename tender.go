@@ -0,0 +1,501 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TenderType is what an order is paid with
+type TenderType string
+
+const (
+	CardTender        TenderType = "card"
+	GiftCardTender    TenderType = "gift-card"
+	StoreCreditTender TenderType = "store-credit"
+)
+
+// Tender is one of the ways an order is paid for
+type Tender struct {
+	Type TenderType
+	// Token is the payment method for cards, the code for gift cards and the account token for store credit
+	Token string
+	// Amount is what the tender pays, one tender of an order can leave it out to pay whatever's left
+	Amount Money
+}
+
+// splitTenders works out what each tender of the order pays, they have to add up to payable.
+// Orders without tenders are paid by card with their PaymentToken
+func splitTenders(payable Money, orderReq *BuyOrderRequest) ([]*Tender, error) {
+	if payable.Amount <= 0 {
+		return nil, nil
+	}
+	if len(orderReq.Tenders) == 0 {
+		if orderReq.PaymentToken == "" {
+			return nil, errors.New("a payment token or tenders are needed to pay " + payable.String() + " " + payable.Currency)
+		}
+		return []*Tender{{CardTender, orderReq.PaymentToken, payable}}, nil
+	}
+	tenders := make([]*Tender, 0, len(orderReq.Tenders))
+	left := payable
+	var rest *Tender
+	for _, t := range orderReq.Tenders {
+		tender := &Tender{t.Type, t.Token, t.Amount}
+		if tender.Type == "" {
+			tender.Type = CardTender
+		}
+		if tender.Type != CardTender && tender.Type != GiftCardTender && tender.Type != StoreCreditTender {
+			return nil, errors.New("tender type must be one of card, gift-card or store-credit")
+		}
+		if tender.Token == "" {
+			return nil, errors.New("every tender needs a token")
+		}
+		if tender.Type == StoreCreditTender && orderReq.CustomerID == "" {
+			return nil, errors.New("store credit can only be used by the loyalty customer it belongs to")
+		}
+		tenders = append(tenders, tender)
+		if tender.Amount.IsZero() {
+			if rest != nil {
+				return nil, errors.New("only one tender can pay what's left")
+			}
+			rest = tender
+			continue
+		}
+		if tender.Amount.Amount < 0 || tender.Amount.Currency != payable.Currency {
+			return nil, errors.New("tender amounts must be positive and in " + payable.Currency)
+		}
+		left = left.Sub(tender.Amount)
+	}
+	if left.Amount < 0 {
+		return nil, errors.New("tenders add up to more than the " + payable.String() + " " + payable.Currency + " to pay")
+	}
+	if rest != nil {
+		rest.Amount = left
+	} else if left.Amount > 0 {
+		return nil, errors.New("tenders leave " + left.String() + " " + payable.Currency + " to pay")
+	}
+	paying := tenders[:0]
+	for _, t := range tenders {
+		if t.Amount.Amount > 0 {
+			paying = append(paying, t)
+		}
+	}
+	return paying, nil
+}
+
+// providerFor returns the provider that takes payments of a tender type
+func providerFor(tender TenderType) PaymentProvider {
+	switch tender {
+	case GiftCardTender:
+		return GiftCards
+	case StoreCreditTender:
+		return StoreCredit
+	}
+	return Payments
+}
+
+// giftCardValidity is how long gift cards last when they're issued without an expiry
+const giftCardValidity = 365 * 24 * time.Hour
+
+type GiftCardStatus string
+
+const (
+	// GiftCardIssued cards can't be used until they're activated, which is when they're sold
+	GiftCardIssued  GiftCardStatus = "issued"
+	GiftCardActive  GiftCardStatus = "active"
+	GiftCardExpired GiftCardStatus = "expired"
+)
+
+type GiftCard struct {
+	Code   string
+	Status GiftCardStatus
+	// Value is what the card is worth when it's activated
+	Value     Money
+	Balance   Money
+	IssuedBy  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// StoreCreditAccount holds the store credit of a customer, it's in the currency it was first given in
+type StoreCreditAccount struct {
+	CustomerID string
+	// Token is what the customer pays with, it's hard to guess like a gift card code and only managers can look it up
+	Token   string
+	Balance Money
+}
+
+// BalanceEntryType says what changed a gift card or store credit balance
+type BalanceEntryType string
+
+const (
+	ActivateEntry BalanceEntryType = "activate"
+	ReloadEntry   BalanceEntryType = "reload"
+	// RedeemEntry is taken off when a payment is authorized, VoidEntry and RefundEntry give it back
+	RedeemEntry BalanceEntryType = "redeem"
+	VoidEntry   BalanceEntryType = "void"
+	RefundEntry BalanceEntryType = "refund"
+	// CreditEntry gives a customer store credit, from a refund or as goodwill
+	CreditEntry BalanceEntryType = "credit"
+)
+
+// BalanceEntry is an immutable entry in the balance ledger, the balance of an account is the sum of its amounts
+type BalanceEntry struct {
+	ID int
+	// Account is gift-card/<code> or store-credit/<customer ID>
+	Account string
+	Type    BalanceEntryType
+	Amount  Money
+	// Balance is the account's balance after the entry
+	Balance   Money
+	Reference string `json:",omitempty"`
+	User      string
+	Timestamp time.Time
+}
+
+// tenderLock guards GiftCardMap, StoreCreditMap, BalanceLedger and the providers below
+var tenderLock sync.Mutex
+var GiftCardMap = make(map[string]*GiftCard)
+var StoreCreditMap = make(map[string]*StoreCreditAccount)
+
+// BalanceLedger is append only, entries are never changed or removed
+var BalanceLedger = make([]*BalanceEntry, 0)
+
+// postBalance changes balance by amount and records it in the ledger, balances can't go below zero.
+// MUST be called with tenderLock held
+func postBalance(account string, balance *Money, t BalanceEntryType, amount Money, reference, user string) (*BalanceEntry, error) {
+	if amount.Currency != balance.Currency {
+		return nil, errors.New(account + " is in " + balance.Currency + " not " + amount.Currency)
+	}
+	after := balance.Add(amount)
+	if err := CheckMoney(after); err != nil {
+		return nil, err
+	}
+	if after.Amount < 0 {
+		return nil, fmt.Errorf("%w, %s only has %s %s left", ErrPaymentDeclined, account, balance.String(), balance.Currency)
+	}
+	*balance = after
+	e := &BalanceEntry{len(BalanceLedger) + 1, account, t, amount, after, reference, user, time.Now()}
+	BalanceLedger = append(BalanceLedger, e)
+	return e, nil
+}
+
+// usable returns why a gift card can't be used, or nil if it can
+func (g *GiftCard) usable(now time.Time) error {
+	if now.After(g.ExpiresAt) {
+		g.Status = GiftCardExpired
+	}
+	if g.Status != GiftCardActive {
+		return fmt.Errorf("%w, gift card %s is %s", ErrPaymentDeclined, g.Code, g.Status)
+	}
+	return nil
+}
+
+// balanceProvider is a PaymentProvider that pays from a gift card or store credit balance. The money is taken off
+// the balance when it's authorized, so captures don't change it, and voids and refunds put it back
+type balanceProvider struct {
+	// account finds the balance a token stands for. MUST be called with tenderLock held
+	account func(token string) (string, *Money, error)
+	// payments maps the references given out to the account they were paid from and the amount
+	payments map[string]*BalanceEntry
+}
+
+// GiftCards and StoreCredit are the providers for gift card and store credit tenders
+var GiftCards = &balanceProvider{giftCardAccount, make(map[string]*BalanceEntry)}
+var StoreCredit = &balanceProvider{storeCreditAccount, make(map[string]*BalanceEntry)}
+
+func giftCardAccount(code string) (string, *Money, error) {
+	g, ok := GiftCardMap[strings.ToUpper(code)]
+	if !ok {
+		return "", nil, fmt.Errorf("%w, gift card %s not found", ErrPaymentDeclined, code)
+	}
+	if err := g.usable(time.Now()); err != nil {
+		return "", nil, err
+	}
+	return "gift-card/" + g.Code, &g.Balance, nil
+}
+
+func storeCreditAccount(token string) (string, *Money, error) {
+	a := storeCreditByToken(token)
+	if a == nil {
+		return "", nil, fmt.Errorf("%w, store credit not found", ErrPaymentDeclined)
+	}
+	return "store-credit/" + a.CustomerID, &a.Balance, nil
+}
+
+// storeCreditByToken finds the store credit account a token pays from, or nil. MUST be called with tenderLock held
+func storeCreditByToken(token string) *StoreCreditAccount {
+	token = strings.ToUpper(strings.TrimSpace(token))
+	for _, a := range StoreCreditMap {
+		if token != "" && a.Token == token {
+			return a
+		}
+	}
+	return nil
+}
+
+// ownsStoreCredit tells whether the store credit a token pays from belongs to customerID, tokens that aren't
+// found are left for the provider to decline
+func ownsStoreCredit(customerID, token string) bool {
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	a := storeCreditByToken(token)
+	return a == nil || (customerID != "" && a.CustomerID == customerID)
+}
+
+func (p *balanceProvider) Authorize(token string, amount Money, reference string) (string, error) {
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	account, balance, err := p.account(token)
+	if err != nil {
+		return "", err
+	}
+	if amount.Currency != balance.Currency {
+		return "", fmt.Errorf("%w, %s is in %s", ErrPaymentDeclined, account, balance.Currency)
+	}
+	e, err := postBalance(account, balance, RedeemEntry, NewMoney(-amount.Amount, amount.Currency), reference, "payment")
+	if err != nil {
+		return "", err
+	}
+	ref := account + "#" + strconv.Itoa(e.ID)
+	p.payments[ref] = e
+	return ref, nil
+}
+
+func (p *balanceProvider) Capture(ref string, amount Money) error {
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	if _, ok := p.payments[ref]; !ok {
+		return errors.New("unknown payment reference " + ref)
+	}
+	return nil
+}
+
+func (p *balanceProvider) Void(ref string) error {
+	return p.giveBack(ref, VoidEntry, Money{})
+}
+
+func (p *balanceProvider) Refund(ref string, amount Money) error {
+	return p.giveBack(ref, RefundEntry, amount)
+}
+
+// giveBack puts amount of a payment back on the balance it came from, or all of it if amount is zero.
+// Money goes back to expired gift cards too, so it isn't lost
+func (p *balanceProvider) giveBack(ref string, t BalanceEntryType, amount Money) error {
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	paid, ok := p.payments[ref]
+	if !ok {
+		return errors.New("unknown payment reference " + ref)
+	}
+	if amount.IsZero() {
+		amount = NewMoney(-paid.Amount.Amount, paid.Amount.Currency)
+	}
+	var balance *Money
+	if code := strings.TrimPrefix(paid.Account, "gift-card/"); code != paid.Account {
+		balance = &GiftCardMap[code].Balance
+	} else {
+		balance = &StoreCreditMap[strings.TrimPrefix(paid.Account, "store-credit/")].Balance
+	}
+	_, err := postBalance(paid.Account, balance, t, amount, paid.Reference, "payment")
+	return err
+}
+
+type IssueGiftCardRequest struct {
+	Value Money
+	// ExpiresAt defaults to a year after the card is issued
+	ExpiresAt time.Time
+}
+
+type BalanceChangeRequest struct {
+	Amount Money
+	// Reference is where the money came from, like an order or refund
+	Reference string
+}
+
+// giftCardCode makes a new code that's hard to guess
+func giftCardCode() string {
+	return strings.ToUpper(strings.Replace(uuid.Must(uuid.NewRandom()).String(), "-", "", -1))[:16]
+}
+
+// issueGiftCard makes a new gift card, it can't be used until it's activated
+func issueGiftCard(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req IssueGiftCardRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Value.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "gift card value must be positive"})
+			return
+		}
+		now := time.Now()
+		if req.ExpiresAt.IsZero() {
+			req.ExpiresAt = now.Add(giftCardValidity)
+		}
+		if !req.ExpiresAt.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "gift cards must expire in the future"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		g := &GiftCard{giftCardCode(), GiftCardIssued, req.Value, NewMoney(0, req.Value.Currency), user.Username, now, req.ExpiresAt}
+		tenderLock.Lock()
+		GiftCardMap[g.Code] = g
+		tenderLock.Unlock()
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+// changeGiftCard runs change on a gift card with tenderLock held
+func changeGiftCard(c *gin.Context, change func(g *GiftCard, user *User) error) {
+	user := c.MustGet("user").(*User)
+	tenderLock.Lock()
+	defer tenderLock.Unlock()
+	g, ok := GiftCardMap[strings.ToUpper(c.Param("code"))]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"Message": "gift card " + c.Param("code") + " not found"})
+		return
+	}
+	if err := change(g, user); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+// activateGiftCard puts the value of a gift card on it once it's been sold
+func activateGiftCard(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changeGiftCard(c, func(g *GiftCard, user *User) error {
+			if g.Status != GiftCardIssued {
+				return errors.New("gift card " + g.Code + " is " + string(g.Status) + " and cannot be activated")
+			}
+			if time.Now().After(g.ExpiresAt) {
+				g.Status = GiftCardExpired
+				return errors.New("gift card " + g.Code + " has expired")
+			}
+			if _, err := postBalance("gift-card/"+g.Code, &g.Balance, ActivateEntry, g.Value, "", user.Username); err != nil {
+				return err
+			}
+			g.Status = GiftCardActive
+			return nil
+		})
+	}
+}
+
+func reloadGiftCard(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BalanceChangeRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Amount.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "amount must be positive"})
+			return
+		}
+		changeGiftCard(c, func(g *GiftCard, user *User) error {
+			if g.Status == GiftCardIssued {
+				return errors.New("gift card " + g.Code + " has to be activated before it's reloaded")
+			}
+			if err := g.usable(time.Now()); err != nil {
+				return errors.New("gift card " + g.Code + " is " + string(g.Status) + " and cannot be reloaded")
+			}
+			_, err := postBalance("gift-card/"+g.Code, &g.Balance, ReloadEntry, req.Amount, req.Reference, user.Username)
+			return err
+		})
+	}
+}
+
+// getGiftCard checks the balance of a gift card, anyone with the code can see it
+func getGiftCard(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenderLock.Lock()
+		defer tenderLock.Unlock()
+		g, ok := GiftCardMap[strings.ToUpper(c.Param("code"))]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "gift card " + c.Param("code") + " not found"})
+			return
+		}
+		g.usable(time.Now())
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+// getStoreCredit checks the balance of store credit, anyone with the token can see it like a gift card
+func getStoreCredit(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenderLock.Lock()
+		defer tenderLock.Unlock()
+		a := storeCreditByToken(c.Param("token"))
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "store credit not found"})
+			return
+		}
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// getCustomerStoreCredit looks up the store credit of a customer, along with the token they pay with
+func getCustomerStoreCredit(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenderLock.Lock()
+		defer tenderLock.Unlock()
+		a, ok := StoreCreditMap[c.Param("cID")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"Message": "customer " + c.Param("cID") + " has no store credit"})
+			return
+		}
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// creditStore gives a customer store credit, the account is opened in the currency of the first credit and given
+// a token to pay with
+func creditStore(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BalanceChangeRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		if req.Amount.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"Message": "amount must be positive"})
+			return
+		}
+		user := c.MustGet("user").(*User)
+		tenderLock.Lock()
+		defer tenderLock.Unlock()
+		a, ok := StoreCreditMap[c.Param("cID")]
+		if !ok {
+			a = &StoreCreditAccount{c.Param("cID"), giftCardCode(), NewMoney(0, req.Amount.Currency)}
+		}
+		if _, err := postBalance("store-credit/"+a.CustomerID, &a.Balance, CreditEntry, req.Amount, req.Reference, user.Username); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "Message": err.Error()})
+			return
+		}
+		StoreCreditMap[a.CustomerID] = a
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// getBalanceLedger lists the ledger, optionally only for the account in ?account=
+func getBalanceLedger(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account := c.Query("account")
+		tenderLock.Lock()
+		defer tenderLock.Unlock()
+		entries := make([]*BalanceEntry, 0)
+		for _, e := range BalanceLedger {
+			if account == "" || strings.EqualFold(e.Account, account) {
+				entries = append(entries, e)
+			}
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
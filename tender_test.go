@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitTenders(t *testing.T) {
+	tests := []struct {
+		name     string
+		orderReq *BuyOrderRequest
+		want     []int64
+		wantErr  bool
+	}{
+		{"payment token", &BuyOrderRequest{PaymentToken: "tok_visa"}, []int64{1000}, false},
+		{"nothing to pay with", &BuyOrderRequest{}, nil, true},
+		{"rest on the card", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", gbp(300)}, {"", "tok_visa", Money{}}}}, []int64{300, 700}, false},
+		{"exact amounts", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", gbp(400)}, {CardTender, "tok_visa", gbp(600)}}}, []int64{400, 600}, false},
+		{"nothing left for the rest", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", gbp(1000)}, {CardTender, "tok_visa", Money{}}}}, []int64{1000}, false},
+		{"too much", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", gbp(1001)}}}, nil, true},
+		{"too little", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", gbp(999)}}}, nil, true},
+		{"two rests", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", Money{}}, {CardTender, "tok_visa", Money{}}}}, nil, true},
+		{"wrong currency", &BuyOrderRequest{Tenders: []*Tender{{GiftCardTender, "CODE", NewMoney(1000, "EUR")}}}, nil, true},
+		{"no token", &BuyOrderRequest{Tenders: []*Tender{{CardTender, "", Money{}}}}, nil, true},
+		{"unknown type", &BuyOrderRequest{Tenders: []*Tender{{"cheque", "123", Money{}}}}, nil, true},
+		{"store credit of the customer", &BuyOrderRequest{CustomerID: "000001", Tenders: []*Tender{{StoreCreditTender, "TOKEN", Money{}}}}, []int64{1000}, false},
+		{"store credit without a customer", &BuyOrderRequest{Tenders: []*Tender{{StoreCreditTender, "TOKEN", Money{}}}}, nil, true},
+	}
+	for _, tt := range tests {
+		tenders, err := splitTenders(gbp(1000), tt.orderReq)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if len(tenders) != len(tt.want) {
+			t.Errorf("%s: %d tenders, want %d", tt.name, len(tenders), len(tt.want))
+			continue
+		}
+		for i, tender := range tenders {
+			if tender.Amount != gbp(tt.want[i]) {
+				t.Errorf("%s: tender %d pays %+v, want %d", tt.name, i, tender.Amount, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestStoreCreditToken(t *testing.T) {
+	tenderLock.Lock()
+	StoreCreditMap["000001"] = &StoreCreditAccount{"000001", "A1B2C3D4E5F60718", gbp(500)}
+	tenderLock.Unlock()
+	t.Cleanup(func() {
+		tenderLock.Lock()
+		delete(StoreCreditMap, "000001")
+		tenderLock.Unlock()
+	})
+	tests := []struct {
+		customer, token string
+		owns            bool
+		found           bool
+	}{
+		{"000001", "A1B2C3D4E5F60718", true, true},
+		{"000001", " a1b2c3d4e5f60718 ", true, true},
+		// the customer ID isn't a token
+		{"000001", "000001", true, false},
+		{"000002", "A1B2C3D4E5F60718", false, true},
+		{"", "A1B2C3D4E5F60718", false, true},
+	}
+	for _, tt := range tests {
+		if got := ownsStoreCredit(tt.customer, tt.token); got != tt.owns {
+			t.Errorf("%s owns %q: %v, want %v", tt.customer, tt.token, got, tt.owns)
+		}
+		tenderLock.Lock()
+		_, _, err := storeCreditAccount(tt.token)
+		tenderLock.Unlock()
+		if (err == nil) != tt.found {
+			t.Errorf("%q: account error %v", tt.token, err)
+		}
+	}
+}
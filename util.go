@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +23,17 @@ func StringSliceContains(haystack []string, needle string) bool {
 	return false
 }
 
+// StringSliceRemove returns haystack without needle
+func StringSliceRemove(haystack []string, needle string) []string {
+	res := make([]string, 0, len(haystack))
+	for _, h := range haystack {
+		if h != needle {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
 func ParseBearerToken(header string) string {
 	split := strings.Split(header, "Bearer")
 	if len(split) != 2 {
@@ -85,8 +98,8 @@ func FetchUser(authEndpoint, token string) *User {
 	return &user
 }
 
-func FetchInventory(inventoryEndpoint, token string) map[string]*InventoryStock {
-	req, err := http.NewRequest("GET", inventoryEndpoint, nil)
+func FetchInventory(inventoryEndpoint, token, location string) map[string]*InventoryStock {
+	req, err := http.NewRequest("GET", inventoryEndpoint+"?location="+url.QueryEscape(location), nil)
 	if err != nil {
 		return nil
 	}
@@ -100,6 +113,21 @@ func FetchInventory(inventoryEndpoint, token string) map[string]*InventoryStock
 	return stock
 }
 
+func FetchLocations(inventoryEndpoint, token string) map[string]*Location {
+	req, err := http.NewRequest("GET", inventoryEndpoint+"/locations", nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil
+	}
+	var locations map[string]*Location
+	json.NewDecoder(response.Body).Decode(&locations)
+	return locations
+}
+
 func FetchProductPrices(priceEndpoint, token string) map[string]*Product {
 	req, err := http.NewRequest("GET", priceEndpoint, nil)
 	if err != nil {
@@ -115,26 +143,32 @@ func FetchProductPrices(priceEndpoint, token string) map[string]*Product {
 	return prices
 }
 
-func SendDecrementRequest(inventoryEndpoint, token string, decrements map[string]*ProductOrder) error {
+func SendDecrementRequest(inventoryEndpoint, token, orderID, location string, decrements map[string]*ProductOrder) (*DecrementResponse, error) {
 	jsonDecrements, jsonErr := json.Marshal(decrements)
 	if jsonErr != nil {
-		return jsonErr
+		return nil, jsonErr
 	}
-	req, err := http.NewRequest("POST", inventoryEndpoint+"/decrement", bytes.NewBuffer(jsonDecrements))
+	req, err := http.NewRequest("POST", inventoryEndpoint+"/decrement?order="+url.QueryEscape(orderID)+"&location="+url.QueryEscape(location), bytes.NewBuffer(jsonDecrements))
 	if err != nil {
-		return errors.New("unable to send request to inventory server")
+		return nil, errors.New("unable to send request to inventory server")
 	}
 	req.Header.Add("Authorization", "Bearer "+token)
+	if orderID != "" {
+		// stock is only taken once for an order, however many times this is sent
+		req.Header.Add("Idempotency-Key", "decrement-"+orderID)
+	}
 	req.Header.Add("Content-Type", "application/json")
 	response, err := http.DefaultClient.Do(req)
 	if err != nil || response.StatusCode != http.StatusOK {
-		return errors.New("inventory server was unable to fulfil order")
+		return nil, errors.New("inventory server was unable to fulfil order")
 	}
-	return nil
+	var res DecrementResponse
+	json.NewDecoder(response.Body).Decode(&res)
+	return &res, nil
 }
 
-func SendCalculateCartRequest(priceEndpoint, token string, cart map[string]*ProductOrder) (*CartValueResponse, error) {
-	jsonCart, jsonErr := json.Marshal(cart)
+func SendCalculateCartRequest(priceEndpoint, token string, calcReq *CalculateCartRequest) (*CartValueResponse, error) {
+	jsonCart, jsonErr := json.Marshal(calcReq)
 	if jsonErr != nil {
 		return nil, jsonErr
 	}
@@ -153,8 +187,8 @@ func SendCalculateCartRequest(priceEndpoint, token string, cart map[string]*Prod
 	return &res, nil
 }
 
-func SendUpdatePointsRequest(loyaltyEndpoint, token string, customerID string, cart map[string]*ProductOrder, usePoints int) (*UpdatePointsResponse, error) {
-	jsonRequest, jsonErr := json.Marshal(UpdatePointsRequest{customerID, cart, usePoints})
+func SendUpdatePointsRequest(loyaltyEndpoint, token string, pointsReq *UpdatePointsRequest) (*UpdatePointsResponse, error) {
+	jsonRequest, jsonErr := json.Marshal(pointsReq)
 	if jsonErr != nil {
 		return nil, jsonErr
 	}
@@ -163,6 +197,9 @@ func SendUpdatePointsRequest(loyaltyEndpoint, token string, customerID string, c
 		return nil, errors.New("unable to send request to loyalty server")
 	}
 	req.Header.Add("Authorization", "Bearer "+token)
+	if pointsReq.OrderID != "" && !pointsReq.DryRun {
+		req.Header.Add("Idempotency-Key", "update-points-"+pointsReq.OrderID)
+	}
 	req.Header.Add("Content-Type", "application/json")
 	response, err := http.DefaultClient.Do(req)
 	if err != nil || response.StatusCode != http.StatusOK {
@@ -172,3 +209,232 @@ func SendUpdatePointsRequest(loyaltyEndpoint, token string, customerID string, c
 	json.NewDecoder(response.Body).Decode(&res)
 	return &res, nil
 }
+
+func SendRedeemCouponsRequest(priceEndpoint, token string, redeemReq *RedeemCouponsRequest) error {
+	jsonRequest, jsonErr := json.Marshal(redeemReq)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	req, err := http.NewRequest("POST", priceEndpoint+"/coupons/redeem", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return errors.New("unable to send request to price server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return errors.New("price server was unable to redeem coupons")
+	}
+	return nil
+}
+
+func SendReleaseCouponsRequest(priceEndpoint, token string, releaseReq *ReleaseCouponsRequest) error {
+	jsonRequest, jsonErr := json.Marshal(releaseReq)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	req, err := http.NewRequest("POST", priceEndpoint+"/coupons/release", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return errors.New("unable to send request to price server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return errors.New("price server was unable to release coupons")
+	}
+	return nil
+}
+
+func FetchBackorderPolicies(inventoryEndpoint, token string) map[string]*BackorderPolicy {
+	req, err := http.NewRequest("GET", inventoryEndpoint+"/backorder-policies", nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil
+	}
+	var policies map[string]*BackorderPolicy
+	json.NewDecoder(response.Body).Decode(&policies)
+	return policies
+}
+
+func SendBackorderRequest(inventoryEndpoint, token string, backorderReq *BackorderRequest) ([]*BackorderAllocation, error) {
+	jsonRequest, jsonErr := json.Marshal(backorderReq)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	req, err := http.NewRequest("POST", inventoryEndpoint+"/backorders", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, errors.New("unable to send request to inventory server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil, errors.New("inventory server was unable to backorder products")
+	}
+	var res []*BackorderAllocation
+	json.NewDecoder(response.Body).Decode(&res)
+	return res, nil
+}
+
+// SendBackorderAllocations returns the allocations for orders the order server doesn't have yet
+func SendBackorderAllocations(orderEndpoint, token string, allocations []*BackorderAllocation) ([]*BackorderAllocation, error) {
+	jsonRequest, jsonErr := json.Marshal(allocations)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	req, err := http.NewRequest("POST", orderEndpoint+"/backorders/allocated", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, errors.New("unable to send request to order server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil, errors.New("order server was unable to record allocations")
+	}
+	var res BackorderAllocationsResponse
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		return nil, errors.New("order server sent back an invalid response")
+	}
+	return res.Unknown, nil
+}
+
+func SendReleaseRequest(inventoryEndpoint, token string, releaseReq *ReleaseRequest) (*ReleaseResponse, error) {
+	jsonRequest, jsonErr := json.Marshal(releaseReq)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	req, err := http.NewRequest("POST", inventoryEndpoint+"/release", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, errors.New("unable to send request to inventory server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil, errors.New("inventory server was unable to release stock")
+	}
+	var res ReleaseResponse
+	json.NewDecoder(response.Body).Decode(&res)
+	return &res, nil
+}
+
+func SendReversePointsRequest(loyaltyEndpoint, token string, reverseReq *ReversePointsRequest) error {
+	jsonRequest, jsonErr := json.Marshal(reverseReq)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	req, err := http.NewRequest("POST", loyaltyEndpoint+"/reverse-points", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return errors.New("unable to send request to loyalty server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return errors.New("loyalty server was unable to reverse points")
+	}
+	return nil
+}
+
+func SendReturnStockRequest(inventoryEndpoint, token string, returnReq *ReturnStockRequest) error {
+	jsonRequest, jsonErr := json.Marshal(returnReq)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	req, err := http.NewRequest("POST", inventoryEndpoint+"/returns", bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return errors.New("unable to send request to inventory server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return errors.New("inventory server was unable to put the return into stock")
+	}
+	return nil
+}
+
+// sendPaymentRequest posts body to the payment server, declines and timeouts come back as ErrPaymentDeclined and ErrPaymentTimeout
+func sendPaymentRequest(url, token, idempotencyKey string, body interface{}) (*Payment, error) {
+	jsonRequest, jsonErr := json.Marshal(body)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, errors.New("unable to send request to payment server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Add("Idempotency-Key", idempotencyKey)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New("unable to reach payment server")
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusGatewayTimeout:
+		return nil, ErrPaymentTimeout
+	default:
+		var res map[string]interface{}
+		json.NewDecoder(response.Body).Decode(&res)
+		msg, _ := res["Message"].(string)
+		if response.StatusCode == http.StatusPaymentRequired {
+			// keep why it was declined, the message starts with ErrPaymentDeclined's
+			return nil, fmt.Errorf("%w%s", ErrPaymentDeclined, strings.TrimPrefix(msg, ErrPaymentDeclined.Error()))
+		}
+		if msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, errors.New("payment server was unable to process the payment")
+	}
+	var res Payment
+	json.NewDecoder(response.Body).Decode(&res)
+	return &res, nil
+}
+
+// SendAuthorizePaymentRequest authorizes a payment, reference makes it safe to send again
+func SendAuthorizePaymentRequest(paymentEndpoint, token string, authReq *AuthorizePaymentRequest, reference string) (*Payment, error) {
+	return sendPaymentRequest(paymentEndpoint+"/authorize", token, reference, authReq)
+}
+
+func SendCapturePaymentRequest(paymentEndpoint, token, paymentID string) (*Payment, error) {
+	return sendPaymentRequest(paymentEndpoint+"/"+paymentID+"/capture", token, "", PaymentAmountRequest{})
+}
+
+func SendVoidPaymentRequest(paymentEndpoint, token, paymentID string) (*Payment, error) {
+	return sendPaymentRequest(paymentEndpoint+"/"+paymentID+"/void", token, "", PaymentAmountRequest{})
+}
+
+// SendRefundPaymentRequest refunds amount of a payment, reference makes it safe to send again
+func SendRefundPaymentRequest(paymentEndpoint, token, paymentID string, amount Money, reference string) (*Payment, error) {
+	return sendPaymentRequest(paymentEndpoint+"/"+paymentID+"/refund", token, reference, PaymentAmountRequest{amount})
+}
+
+// SendStoreCreditRequest gives a customer store credit, reference makes it safe to send again
+func SendStoreCreditRequest(paymentEndpoint, token, customerID string, amount Money, reference string) error {
+	jsonRequest, jsonErr := json.Marshal(BalanceChangeRequest{amount, reference})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	req, err := http.NewRequest("POST", paymentEndpoint+"/manager/store-credit/"+url.PathEscape(customerID), bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return errors.New("unable to send request to payment server")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Idempotency-Key", reference)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return errors.New("payment server was unable to give store credit")
+	}
+	return nil
+}